@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -11,9 +10,19 @@ import (
 	"time"
 
 	"chat-app/internal/api"
+	"chat-app/internal/auth"
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/chat"
 	"chat-app/internal/database"
 	"chat-app/internal/grpc"
+	"chat-app/internal/invites"
+	"chat-app/internal/messages"
+	"chat-app/internal/moderation"
+	"chat-app/internal/outbox"
+	"chat-app/internal/presence"
 	"chat-app/internal/redis"
+	"chat-app/internal/rooms"
 	"chat-app/internal/websocket"
 
 	"github.com/gin-gonic/gin"
@@ -46,11 +55,47 @@ func main() {
 	}
 	defer redisClient.Close()
 
+	// Initialize the event broker: BROKER is redis (Pub/Sub, the default),
+	// streams (Redis Streams) or memory (a single instance only)
+	eventBroker, err := broker.New(getEnv("BROKER", broker.KindPubSub), redisClient)
+	if err != nil {
+		log.Fatalf("Failed to create event broker: %v", err)
+	}
+
+	// Load JWT signing and verification keys
+	keys, err := auth.LoadKeys()
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+
+	// Start relaying outbox events to the broker
+	relay := outbox.NewRelay(db, eventBroker)
+	relayCtx, stopRelay := context.WithCancel(context.Background())
+	defer stopRelay()
+	go relay.Run(relayCtx)
+
+	// Initialize auth service
+	authService := auth.NewService(db, redisClient, eventBroker, keys)
+
+	// Initialize room authorizer shared by all transports
+	authorizer := authz.NewAuthorizer(db, redisClient)
+
+	// Initialize invitation service
+	inviteService := invites.NewService(db, eventBroker, authorizer)
+	moderationService := moderation.NewService(db, eventBroker, authorizer)
+	roomService := rooms.NewService(db, eventBroker, authorizer)
+	messageService := messages.NewService(db, eventBroker, relay, authorizer)
+	presenceService := presence.NewService(db, redisClient, eventBroker, authorizer)
+
+	// Initialize chat service shared by all transports for sending,
+	// editing and deleting messages and joining and leaving rooms
+	chatService := chat.NewService(db, eventBroker, authorizer, messageService)
+
 	// Initialize API handler
-	handler := api.NewHandler(db, redisClient)
+	handler := api.NewHandler(db, eventBroker, authService, authorizer, inviteService, moderationService, roomService, messageService, presenceService, chatService)
 
 	// Initialize WebSocket handler
-	wsHandler := websocket.NewWebSocketHandler(db, redisClient)
+	wsHandler := websocket.NewWebSocketHandler(db, eventBroker, authService, authorizer, messageService, presenceService, chatService)
 
 	// Setup Gin router
 	router := gin.Default()
@@ -66,20 +111,66 @@ func main() {
 	// Public routes
 	router.POST("/api/auth/register", handler.Register)
 	router.POST("/api/auth/login", handler.Login)
+	router.POST("/api/auth/refresh", handler.RefreshToken)
+	router.GET("/.well-known/jwks.json", handler.JWKS)
 
 	// Protected routes
 	protected := router.Group("/api")
 	protected.Use(handler.AuthMiddleware())
 	{
+		protected.POST("/auth/logout", handler.Logout)
+		protected.GET("/auth/sessions", handler.GetSessions)
+		protected.DELETE("/auth/sessions/:sessionID", handler.RevokeSession)
+
+		protected.GET("/me/mentions", handler.GetMentions)
+		protected.POST("/me/mentions/read", handler.MarkMentionsRead)
+
 		protected.GET("/rooms", handler.GetRooms)
 		protected.POST("/rooms", handler.CreateRoom)
+		protected.GET("/rooms/:roomID", handler.GetRoom)
+		protected.PATCH("/rooms/:roomID", handler.UpdateRoom)
+		protected.DELETE("/rooms/:roomID", handler.DeleteRoom)
+		protected.POST("/rooms/:roomID/archive", handler.ArchiveRoom)
+		protected.POST("/rooms/:roomID/unarchive", handler.UnarchiveRoom)
+		protected.POST("/rooms/:roomID/transfer", handler.TransferOwnership)
+		protected.POST("/rooms/:roomID/join", handler.JoinRoom)
+		protected.POST("/rooms/:roomID/leave", handler.LeaveRoom)
+
+		protected.GET("/dms", handler.GetDMs)
+		protected.POST("/dms", handler.CreateDM)
 		protected.GET("/rooms/:roomID/messages", handler.GetMessages)
+		protected.POST("/rooms/:roomID/read", handler.MarkRead)
 		protected.POST("/rooms/:roomID/messages", handler.SendMessage)
+		protected.PATCH("/rooms/:roomID/messages/:messageID", handler.EditMessage)
+		protected.DELETE("/rooms/:roomID/messages/:messageID", handler.DeleteMessage)
+		protected.GET("/rooms/:roomID/messages/:messageID/revisions", handler.GetMessageRevisions)
+		protected.GET("/rooms/:roomID/messages/:messageID/thread", handler.GetThread)
+		protected.GET("/rooms/:roomID/messages/:messageID/reactions", handler.GetReactions)
+		protected.POST("/rooms/:roomID/messages/:messageID/reactions", handler.AddReaction)
+		protected.DELETE("/rooms/:roomID/messages/:messageID/reactions/:emoji", handler.RemoveReaction)
 		protected.GET("/rooms/:roomID/users", handler.GetOnlineUsers)
+
+		protected.POST("/rooms/:roomID/invitations", handler.InviteUser)
+		protected.GET("/invitations", handler.GetInvitations)
+		protected.POST("/invitations/:invitationID/accept", handler.AcceptInvitation)
+		protected.POST("/invitations/:invitationID/decline", handler.DeclineInvitation)
+		protected.GET("/rooms/:roomID/invite-links", handler.GetInviteLinks)
+		protected.POST("/rooms/:roomID/invite-links", handler.CreateInviteLink)
+		protected.DELETE("/rooms/:roomID/invite-links/:code", handler.RevokeInviteLink)
+		protected.POST("/invite-links/:code/join", handler.JoinWithInviteCode)
+
+		protected.GET("/rooms/:roomID/members", handler.GetRoomMembers)
+		protected.PUT("/rooms/:roomID/members/:userID/role", handler.SetMemberRole)
+		protected.DELETE("/rooms/:roomID/members/:userID", handler.KickMember)
+		protected.POST("/rooms/:roomID/bans", handler.BanUser)
+		protected.DELETE("/rooms/:roomID/bans/:userID", handler.UnbanUser)
+		protected.POST("/rooms/:roomID/mutes", handler.MuteUser)
+		protected.DELETE("/rooms/:roomID/mutes/:userID", handler.UnmuteUser)
 	}
 
 	// WebSocket endpoint
-	router.GET("/ws", wsHandler.HandleWebSocket)
+	router.GET("/ws", gin.WrapF(wsHandler.HandleWebSocket))
+	router.GET("/metrics/hub", gin.WrapF(wsHandler.HubStats))
 
 	// Health check
 	router.GET("/health", func(c *gin.Context) {
@@ -110,11 +201,22 @@ func main() {
 	// Start gRPC server in a goroutine
 	go func() {
 		log.Printf("gRPC server starting on port %s", grpcPort)
-		if err := grpc.StartGRPCServer(db, redisClient, grpcPort); err != nil {
+		if err := grpc.StartGRPCServer(db, eventBroker, authService, authorizer, inviteService, moderationService, roomService, messageService, presenceService, chatService, grpcPort); err != nil {
 			log.Fatalf("gRPC server error: %v", err)
 		}
 	}()
 
+	// Reload JWT keys on SIGHUP so keys can be rotated without a restart
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := keys.Reload(); err != nil {
+				log.Printf("Failed to reload JWT keys: %v", err)
+			}
+		}
+	}()
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -131,6 +233,10 @@ func main() {
 		log.Fatal("HTTP server forced to shutdown:", err)
 	}
 
+	// Announce this instance's users as gone rather than waiting for their
+	// presence to expire
+	presenceService.Shutdown(ctx)
+
 	log.Println("Server exited")
 }
 
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+
+	"chat-app/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// RefreshToken exchanges a refresh token for a new token pair
+func (h *Handler) RefreshToken(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, err := h.auth.Refresh(c.Request.Context(), req.RefreshToken)
+	if err == auth.ErrInvalidRefreshToken || err == auth.ErrRefreshTokenReused {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+	})
+}
+
+// Logout revokes the current session and access token
+func (h *Handler) Logout(c *gin.Context) {
+	claims := c.MustGet("claims").(*auth.Claims)
+
+	if err := h.auth.Logout(c.Request.Context(), claims); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to logout"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
+// GetSessions lists the signed-in devices of the current user
+func (h *Handler) GetSessions(c *gin.Context) {
+	claims := c.MustGet("claims").(*auth.Claims)
+
+	sessions, err := h.auth.ListSessions(c.Request.Context(), claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get sessions"})
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == claims.SessionID
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// RevokeSession signs out one of the current user's devices
+func (h *Handler) RevokeSession(c *gin.Context) {
+	userID := c.GetString("user_id")
+	sessionID := c.Param("sessionID")
+
+	err := h.auth.RevokeSession(c.Request.Context(), userID, sessionID)
+	if err == auth.ErrSessionNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// JWKS publishes the public token verification keys for other services
+func (h *Handler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.auth.Keys().JWKS())
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+
+	"chat-app/internal/rooms"
+
+	"github.com/gin-gonic/gin"
+)
+
+type DMRequest struct {
+	UserIDs []string `json:"user_ids" binding:"required,min=1"`
+}
+
+// CreateDM finds or creates the conversation with a set of users
+func (h *Handler) CreateDM(c *gin.Context) {
+	var req DMRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	dm, created, err := h.rooms.FindOrCreateDM(c.Request.Context(), c.GetString("user_id"), req.UserIDs)
+	if err != nil {
+		switch err {
+		case rooms.ErrTooFewParticipants, rooms.ErrTooManyParticipants:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case rooms.ErrUserNotFound, rooms.ErrNotMember:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open conversation"})
+		}
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"dm": dm})
+}
+
+// GetDMs lists the current user's conversations, most recently active first
+func (h *Handler) GetDMs(c *gin.Context) {
+	dms, err := h.rooms.ListDMs(c.Request.Context(), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get conversations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"dms": dms})
+}
@@ -1,27 +1,40 @@
 package api
 
 import (
-	"context"
 	"database/sql"
-	"encoding/json"
-	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"time"
 
+	"chat-app/internal/auth"
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/chat"
 	"chat-app/internal/database"
+	"chat-app/internal/invites"
+	"chat-app/internal/messages"
 	"chat-app/internal/models"
-	"chat-app/internal/redis"
+	"chat-app/internal/moderation"
+	"chat-app/internal/presence"
+	"chat-app/internal/rooms"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Handler struct {
-	db    *database.DB
-	redis *redis.RedisClient
+	db         *database.DB
+	broker     broker.Broker
+	auth       *auth.Service
+	authz      *authz.Authorizer
+	invites    *invites.Service
+	moderation *moderation.Service
+	rooms      *rooms.Service
+	messages   *messages.Service
+	presence   *presence.Service
+	chat       *chat.Service
 }
 
 type UserRequest struct {
@@ -40,19 +53,30 @@ type MessageRequest struct {
 	RoomID    string            `json:"room_id" binding:"required"`
 	MessageType string          `json:"message_type"`
 	Metadata  map[string]string `json:"metadata"`
+	ParentID  string            `json:"parent_id"` // reply in the thread of this message
+	ClientMsgID string          `json:"client_msg_id"` // retries with the same ID are not stored twice
 }
 
 type RoomRequest struct {
-	Name        string `json:"name" binding:"required"`
-	Description string `json:"description"`
-	IsPrivate   bool   `json:"is_private"`
+	Name          string   `json:"name" binding:"required"`
+	Description   string   `json:"description"`
+	IsPrivate     bool     `json:"is_private"`
+	InviteUserIDs []string `json:"invite_user_ids"`
 }
 
 // NewHandler creates a new API handler
-func NewHandler(db *database.DB, redis *redis.RedisClient) *Handler {
+func NewHandler(db *database.DB, broker broker.Broker, authService *auth.Service, authorizer *authz.Authorizer, inviteService *invites.Service, moderationService *moderation.Service, roomService *rooms.Service, messageService *messages.Service, presenceService *presence.Service, chatService *chat.Service) *Handler {
 	return &Handler{
-		db:    db,
-		redis: redis,
+		db:         db,
+		broker:     broker,
+		auth:       authService,
+		authz:      authorizer,
+		invites:    inviteService,
+		moderation: moderationService,
+		rooms:      roomService,
+		messages:   messageService,
+		presence:   presenceService,
+		chat:       chatService,
 	}
 }
 
@@ -95,15 +119,18 @@ func (h *Handler) Register(c *gin.Context) {
 	}
 
 	// Generate JWT token
-	token, err := h.generateJWT(userID, req.Username)
+	tokens, err := h.auth.IssueTokens(c.Request.Context(), userID, req.Username,
+		c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusCreated, gin.H{
-		"message": "User created successfully",
-		"token":   token,
+		"message":       "User created successfully",
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 		"user": gin.H{
 			"id":       userID,
 			"username": req.Username,
@@ -137,20 +164,23 @@ func (h *Handler) Login(c *gin.Context) {
 		return
 	}
 
-	// Update user status to online
-	updateQuery := `UPDATE users SET status = 'online', last_seen = NOW() WHERE id = $1`
+	// Status is kept by the presence service once the user connects
+	updateQuery := `UPDATE users SET last_seen = NOW() WHERE id = $1`
 	h.db.ExecContext(c.Request.Context(), updateQuery, user.ID)
 
 	// Generate JWT token
-	token, err := h.generateJWT(user.ID, user.Username)
+	tokens, err := h.auth.IssueTokens(c.Request.Context(), user.ID, user.Username,
+		c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"message": "Login successful",
-		"token":   token,
+		"message":       "Login successful",
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
 		"user": gin.H{
 			"id":       user.ID,
 			"username": user.Username,
@@ -163,10 +193,10 @@ func (h *Handler) Login(c *gin.Context) {
 func (h *Handler) GetRooms(c *gin.Context) {
 	userID := c.GetString("user_id")
 	
-	query := `SELECT r.id, r.name, r.description, r.is_private, r.created_by, r.created_at, r.updated_at
+	query := `SELECT r.id, r.name, r.description, r.is_private, r.created_by, r.created_at, r.updated_at, r.archived_at
 			  FROM rooms r
 			  LEFT JOIN room_members rm ON r.id = rm.room_id AND rm.user_id = $1
-			  WHERE r.is_private = false OR rm.user_id = $1
+			  WHERE (r.is_private = false OR rm.user_id = $1) AND r.kind = 'room'
 			  ORDER BY r.created_at DESC`
 	
 	rows, err := h.db.QueryContext(c.Request.Context(), query, userID)
@@ -180,13 +210,27 @@ func (h *Handler) GetRooms(c *gin.Context) {
 	for rows.Next() {
 		var room models.Room
 		err := rows.Scan(&room.ID, &room.Name, &room.Description, &room.IsPrivate, 
-			&room.CreatedBy, &room.CreatedAt, &room.UpdatedAt)
+			&room.CreatedBy, &room.CreatedAt, &room.UpdatedAt, &room.ArchivedAt)
 		if err != nil {
 			continue
 		}
 		rooms = append(rooms, room)
 	}
 
+	roomIDs := make([]string, len(rooms))
+	for i := range rooms {
+		roomIDs[i] = rooms[i].ID
+	}
+	cursors, err := h.messages.UnreadCounts(c.Request.Context(), userID, roomIDs)
+	if err != nil {
+		log.Printf("Error counting unread messages for %s: %v", userID, err)
+	}
+	for i := range rooms {
+		cursor := cursors[rooms[i].ID]
+		rooms[i].LastReadID = cursor.LastReadID
+		rooms[i].UnreadCount = cursor.UnreadCount
+	}
+
 	c.JSON(http.StatusOK, gin.H{"rooms": rooms})
 }
 
@@ -213,8 +257,16 @@ func (h *Handler) CreateRoom(c *gin.Context) {
 	}
 
 	// Add creator to room members
-	memberQuery := `INSERT INTO room_members (room_id, user_id) VALUES ($1, $2)`
+	memberQuery := `INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, 'owner')`
 	h.db.ExecContext(c.Request.Context(), memberQuery, roomID, userID)
+	h.authz.Invalidate(c.Request.Context(), roomID, userID)
+
+	// Invite the initial members
+	for _, inviteeID := range req.InviteUserIDs {
+		if _, err := h.invites.InviteUser(c.Request.Context(), roomID, userID, inviteeID); err != nil {
+			log.Printf("Error inviting %s to room %s: %v", inviteeID, roomID, err)
+		}
+	}
 
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Room created successfully",
@@ -231,6 +283,10 @@ func (h *Handler) CreateRoom(c *gin.Context) {
 // GetMessages gets messages for a room
 func (h *Handler) GetMessages(c *gin.Context) {
 	roomID := c.Param("roomID")
+	if !h.authorizeRoom(c, roomID, authz.PermRead) {
+		return
+	}
+
 	limitStr := c.DefaultQuery("limit", "50")
 	beforeStr := c.Query("before")
 
@@ -239,9 +295,9 @@ func (h *Handler) GetMessages(c *gin.Context) {
 		limit = 50
 	}
 
-	query := `SELECT m.id, m.user_id, m.username, m.room_id, m.content, m.message_type, m.timestamp, m.metadata
+	query := `SELECT m.id, m.user_id, m.username, m.room_id, m.content, m.message_type, m.timestamp, m.metadata, m.edited_at, m.deleted_at, m.deleted_by, COALESCE(m.seq, 0)
 			  FROM messages m
-			  WHERE m.room_id = $1
+			  WHERE m.room_id = $1 AND m.thread_root_id IS NULL
 			  ORDER BY m.timestamp DESC
 			  LIMIT $2`
 
@@ -249,9 +305,9 @@ func (h *Handler) GetMessages(c *gin.Context) {
 	if beforeStr != "" {
 		before, err := strconv.ParseInt(beforeStr, 10, 64)
 		if err == nil {
-			query = `SELECT m.id, m.user_id, m.username, m.room_id, m.content, m.message_type, m.timestamp, m.metadata
+			query = `SELECT m.id, m.user_id, m.username, m.room_id, m.content, m.message_type, m.timestamp, m.metadata, m.edited_at, m.deleted_at, m.deleted_by, COALESCE(m.seq, 0)
 					 FROM messages m
-					 WHERE m.room_id = $1 AND m.timestamp < $2
+					 WHERE m.room_id = $1 AND m.thread_root_id IS NULL AND m.timestamp < $2
 					 ORDER BY m.timestamp DESC
 					 LIMIT $3`
 			rows, err = h.db.QueryContext(c.Request.Context(), query, roomID, time.Unix(before, 0), limit)
@@ -272,7 +328,7 @@ func (h *Handler) GetMessages(c *gin.Context) {
 		var metadataJSON []byte
 		
 		err := rows.Scan(&msg.ID, &msg.UserID, &msg.Username, &msg.RoomID, 
-			&msg.Content, &msg.MessageType, &msg.Timestamp, &metadataJSON)
+			&msg.Content, &msg.MessageType, &msg.Timestamp, &metadataJSON, &msg.EditedAt, &msg.DeletedAt, &msg.DeletedBy, &msg.Seq)
 		if err != nil {
 			continue
 		}
@@ -285,6 +341,10 @@ func (h *Handler) GetMessages(c *gin.Context) {
 		messages = append(messages, msg)
 	}
 
+	if err := h.messages.Annotate(c.Request.Context(), c.GetString("user_id"), messages); err != nil {
+		log.Printf("Error annotating messages for room %s: %v", roomID, err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"messages": messages,
 		"has_more": len(messages) == limit,
@@ -299,118 +359,75 @@ func (h *Handler) SendMessage(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetString("user_id")
-	username := c.GetString("username")
-	messageID := uuid.New().String()
-	timestamp := time.Now()
-
-	// Store message in database
-	query := `INSERT INTO messages (id, user_id, username, room_id, content, message_type, timestamp, metadata) 
-			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	
-	_, err := h.db.ExecContext(c.Request.Context(), query, 
-		messageID, userID, username, req.RoomID, 
-		req.Content, req.MessageType, timestamp, req.Metadata)
-	
+	message, duplicate, err := h.chat.Send(c.Request.Context(), chat.Send{
+		RoomID:      req.RoomID,
+		UserID:      c.GetString("user_id"),
+		Username:    c.GetString("username"),
+		Content:     req.Content,
+		MessageType: req.MessageType,
+		Metadata:    req.Metadata,
+		ParentID:    req.ParentID,
+		ClientMsgID: req.ClientMsgID,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
+		writeMessageError(c, err, "Failed to send message")
 		return
 	}
 
-	// Publish to Redis for real-time delivery
-	messageData := map[string]interface{}{
-		"id":           messageID,
-		"user_id":      userID,
-		"username":     username,
-		"room_id":      req.RoomID,
-		"content":      req.Content,
-		"message_type": req.MessageType,
-		"timestamp":    timestamp.Unix(),
-		"metadata":     req.Metadata,
+	if duplicate {
+		c.JSON(http.StatusOK, gin.H{
+			"message":       "Message already sent",
+			"message_id":    message.ID,
+			"client_msg_id": message.ClientMsgID,
+			"timestamp":     message.Timestamp.Unix(),
+			"seq":           message.Seq,
+		})
+		return
 	}
 
-	channel := fmt.Sprintf("room:%s", req.RoomID)
-	h.redis.Publish(c.Request.Context(), channel, messageData)
-
 	c.JSON(http.StatusCreated, gin.H{
 		"message": "Message sent successfully",
-		"message_id": messageID,
+		"message_id": message.ID,
+		"client_msg_id": message.ClientMsgID,
+		"timestamp": message.Timestamp.Unix(),
+		"seq": message.Seq,
 	})
 }
 
-// GetOnlineUsers gets online users in a room
+// GetOnlineUsers gets the members of a room who are online, away or idle
 func (h *Handler) GetOnlineUsers(c *gin.Context) {
 	roomID := c.Param("roomID")
-
-	// Try Redis first
-	roomKey := fmt.Sprintf("room:%s:users", roomID)
-	userIDs, err := h.redis.SMembers(c.Request.Context(), roomKey)
-	
-	if err != nil {
-		// Fallback to database
-		query := `SELECT u.id, u.username, u.status, u.last_seen 
-				  FROM users u 
-				  JOIN room_members rm ON u.id = rm.user_id 
-				  WHERE rm.room_id = $1 AND u.status = 'online'`
-		
-		rows, err := h.db.QueryContext(c.Request.Context(), query, roomID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get online users"})
-			return
-		}
-		defer rows.Close()
-
-		var users []models.User
-		for rows.Next() {
-			var user models.User
-			err := rows.Scan(&user.ID, &user.Username, &user.Status, &user.LastSeen)
-			if err != nil {
-				continue
-			}
-			users = append(users, user)
-		}
-
-		c.JSON(http.StatusOK, gin.H{"users": users})
-		return
-	}
-
-	if len(userIDs) == 0 {
-		c.JSON(http.StatusOK, gin.H{"users": []models.User{}})
+	if !h.authorizeRoom(c, roomID, authz.PermRead) {
 		return
 	}
 
-	// Get user details from database
-	query := `SELECT id, username, status, last_seen FROM users WHERE id = ANY($1)`
-	rows, err := h.db.QueryContext(c.Request.Context(), query, userIDs)
+	users, err := h.presence.Online(c.Request.Context(), roomID, c.GetString("user_id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user details"})
+		log.Printf("Error getting online users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get online users"})
 		return
 	}
-	defer rows.Close()
-
-	var users []models.User
-	for rows.Next() {
-		var user models.User
-		err := rows.Scan(&user.ID, &user.Username, &user.Status, &user.LastSeen)
-		if err != nil {
-			continue
-		}
-		users = append(users, user)
-	}
 
 	c.JSON(http.StatusOK, gin.H{"users": users})
 }
 
-// generateJWT generates a JWT token
-func (h *Handler) generateJWT(userID, username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id":  userID,
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 24).Unix(),
-	})
-
-	// In production, use environment variable for secret
-	return token.SignedString([]byte("your-secret-key"))
+// authorizeRoom writes a 403/404 response and returns false unless the
+// current user holds perm in the room
+func (h *Handler) authorizeRoom(c *gin.Context, roomID string, perm authz.Permission) bool {
+	err := h.authz.Authorize(c.Request.Context(), c.GetString("user_id"), roomID, perm)
+	switch err {
+	case nil:
+		return true
+	case authz.ErrRoomNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+	case authz.ErrForbidden:
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access to room denied"})
+	case authz.ErrBanned, authz.ErrMuted, authz.ErrNotPermitted, authz.ErrArchived:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check room access"})
+	}
+	return false
 }
 
 // AuthMiddleware validates JWT tokens
@@ -423,44 +440,21 @@ func (h *Handler) AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// Remove "Bearer " prefix
-		if len(tokenString) > 7 && tokenString[:7] == "Bearer " {
-			tokenString = tokenString[7:]
-		}
-
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte("your-secret-key"), nil
-		})
-
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
-			return
-		}
-
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		claims, err := h.auth.Authenticate(c.Request.Context(), auth.BearerToken(tokenString))
+		if err == auth.ErrTokenExpired || err == auth.ErrTokenRevoked {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			c.Abort()
 			return
 		}
-
-		userID, ok := claims["user_id"].(string)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user ID"})
-			c.Abort()
-			return
-		}
-
-		username, ok := claims["username"].(string)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username"})
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
-		c.Set("user_id", userID)
-		c.Set("username", username)
+		c.Set("user_id", claims.UserID)
+		c.Set("username", claims.Username)
+		c.Set("claims", claims)
 		c.Next()
 	}
 }
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/invites"
+
+	"github.com/gin-gonic/gin"
+)
+
+type InvitationRequest struct {
+	UserID string `json:"user_id" binding:"required"`
+}
+
+type InviteLinkRequest struct {
+	ExpiresIn int `json:"expires_in" binding:"min=0"` // seconds, 0 = never
+	MaxUses   int `json:"max_uses" binding:"min=0"`   // 0 = unlimited
+}
+
+// InviteUser invites a user to a room
+func (h *Handler) InviteUser(c *gin.Context) {
+	var req InvitationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	invitation, err := h.invites.InviteUser(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"), req.UserID)
+	if err != nil {
+		writeInviteError(c, err, "Failed to invite user")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"invitation": invitation})
+}
+
+// GetInvitations lists the current user's pending invitations
+func (h *Handler) GetInvitations(c *gin.Context) {
+	invitations, err := h.invites.ListInvitations(c.Request.Context(), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get invitations"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitations": invitations})
+}
+
+// AcceptInvitation accepts an invitation and joins its room
+func (h *Handler) AcceptInvitation(c *gin.Context) {
+	invitation, err := h.invites.AcceptInvitation(c.Request.Context(), c.Param("invitationID"), c.GetString("user_id"))
+	if err != nil {
+		writeInviteError(c, err, "Failed to accept invitation")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitation": invitation})
+}
+
+// DeclineInvitation declines an invitation
+func (h *Handler) DeclineInvitation(c *gin.Context) {
+	invitation, err := h.invites.DeclineInvitation(c.Request.Context(), c.Param("invitationID"), c.GetString("user_id"))
+	if err != nil {
+		writeInviteError(c, err, "Failed to decline invitation")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invitation": invitation})
+}
+
+// CreateInviteLink mints a shareable invite code for a room
+func (h *Handler) CreateInviteLink(c *gin.Context) {
+	var req InviteLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	link, err := h.invites.CreateLink(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"),
+		time.Duration(req.ExpiresIn)*time.Second, req.MaxUses)
+	if err != nil {
+		writeInviteError(c, err, "Failed to create invite link")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"invite_link": link})
+}
+
+// GetInviteLinks lists the active invite links of a room
+func (h *Handler) GetInviteLinks(c *gin.Context) {
+	links, err := h.invites.ListLinks(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"))
+	if err != nil {
+		writeInviteError(c, err, "Failed to get invite links")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"invite_links": links})
+}
+
+// RevokeInviteLink disables an invite code
+func (h *Handler) RevokeInviteLink(c *gin.Context) {
+	err := h.invites.RevokeLink(c.Request.Context(), c.Param("roomID"), c.Param("code"), c.GetString("user_id"))
+	if err != nil {
+		writeInviteError(c, err, "Failed to revoke invite link")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invite link revoked"})
+}
+
+// JoinWithInviteCode redeems an invite code
+func (h *Handler) JoinWithInviteCode(c *gin.Context) {
+	roomID, err := h.invites.JoinWithCode(c.Request.Context(), c.Param("code"), c.GetString("user_id"))
+	if err != nil {
+		writeInviteError(c, err, "Failed to join room")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Joined room successfully",
+		"room_id": roomID,
+	})
+}
+
+func writeInviteError(c *gin.Context, err error, fallback string) {
+	switch err {
+	case authz.ErrRoomNotFound, invites.ErrUserNotFound, invites.ErrInvitationNotFound, invites.ErrLinkNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case authz.ErrForbidden, authz.ErrBanned, authz.ErrNotPermitted, authz.ErrArchived:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case invites.ErrAlreadyMember:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case invites.ErrLinkExpired, invites.ErrLinkExhausted:
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type MarkMentionsReadRequest struct {
+	MessageIDs []string `json:"message_ids"` // empty marks every mention read
+}
+
+// GetMentions lists the messages that mentioned the current user, newest
+// first. ?unread=true skips read mentions; ?before=<unix> pages backwards.
+func (h *Handler) GetMentions(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.GetString("user_id")
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	var before time.Time
+	if beforeStr := c.Query("before"); beforeStr != "" {
+		if unix, err := strconv.ParseInt(beforeStr, 10, 64); err == nil {
+			before = time.Unix(unix, 0)
+		}
+	}
+
+	mentions, err := h.messages.ListMentions(ctx, userID, c.Query("unread") == "true", before, limit)
+	if err != nil {
+		log.Printf("Error listing mentions for %s: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get mentions"})
+		return
+	}
+
+	unread, err := h.messages.UnreadMentions(ctx, userID)
+	if err != nil {
+		log.Printf("Error counting mentions for %s: %v", userID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"mentions":     mentions,
+		"unread_count": unread,
+		"has_more":     len(mentions) == limit,
+	})
+}
+
+// MarkMentionsRead marks some or all of the current user's mentions read
+func (h *Handler) MarkMentionsRead(c *gin.Context) {
+	var req MarkMentionsReadRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	marked, err := h.messages.MarkMentionsRead(c.Request.Context(), c.GetString("user_id"), req.MessageIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark mentions read"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"marked": marked})
+}
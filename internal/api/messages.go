@@ -0,0 +1,163 @@
+package api
+
+import (
+	"net/http"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/chat"
+	"chat-app/internal/messages"
+
+	"github.com/gin-gonic/gin"
+)
+
+type EditMessageRequest struct {
+	Content string `json:"content" binding:"required"`
+}
+
+// EditMessage changes the content of the current user's message
+func (h *Handler) EditMessage(c *gin.Context) {
+	var req EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message, err := h.chat.Edit(c.Request.Context(), chat.Edit{
+		RoomID:    c.Param("roomID"),
+		MessageID: c.Param("messageID"),
+		UserID:    c.GetString("user_id"),
+		Content:   req.Content,
+	})
+	if err != nil {
+		writeMessageError(c, err, "Failed to edit message")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// DeleteMessage deletes a message, leaving a tombstone in the history.
+// Admins may pass ?purge=true to remove it entirely.
+func (h *Handler) DeleteMessage(c *gin.Context) {
+	purge := c.Query("purge") == "true"
+	message, err := h.chat.Delete(c.Request.Context(), chat.Delete{
+		RoomID:    c.Param("roomID"),
+		MessageID: c.Param("messageID"),
+		UserID:    c.GetString("user_id"),
+		Purge:     purge,
+	})
+	if err != nil {
+		writeMessageError(c, err, "Failed to delete message")
+		return
+	}
+
+	if purge {
+		c.JSON(http.StatusOK, gin.H{"message": "Message purged"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// GetMessageRevisions lists the prior versions of an edited message
+func (h *Handler) GetMessageRevisions(c *gin.Context) {
+	revisions, err := h.messages.Revisions(c.Request.Context(), c.Param("roomID"), c.Param("messageID"), c.GetString("user_id"))
+	if err != nil {
+		writeMessageError(c, err, "Failed to get revisions")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revisions": revisions})
+}
+
+// GetThread returns a thread root and its replies, oldest first. messageID
+// may be the root or any reply in the thread.
+func (h *Handler) GetThread(c *gin.Context) {
+	root, replies, err := h.messages.Thread(c.Request.Context(), c.Param("roomID"), c.Param("messageID"), c.GetString("user_id"))
+	if err != nil {
+		writeMessageError(c, err, "Failed to get thread")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"root": root, "replies": replies})
+}
+
+type MarkReadRequest struct {
+	MessageID string `json:"message_id" binding:"required"`
+}
+
+// MarkRead moves the current user's read cursor in a room forward
+func (h *Handler) MarkRead(c *gin.Context) {
+	var req MarkReadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	cursor, err := h.messages.MarkRead(c.Request.Context(), c.Param("roomID"), req.MessageID, c.GetString("user_id"))
+	if err != nil {
+		writeMessageError(c, err, "Failed to mark room read")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"cursor": cursor})
+}
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji" binding:"required"`
+}
+
+// AddReaction reacts to a message with an emoji
+func (h *Handler) AddReaction(c *gin.Context) {
+	var req ReactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	messageID := c.Param("messageID")
+	count, err := h.messages.AddReaction(c.Request.Context(), c.Param("roomID"), messageID, c.GetString("user_id"), req.Emoji)
+	if err != nil {
+		writeMessageError(c, err, "Failed to add reaction")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message_id": messageID, "emoji": req.Emoji, "count": count})
+}
+
+// RemoveReaction removes one of the current user's reactions
+func (h *Handler) RemoveReaction(c *gin.Context) {
+	messageID, emoji := c.Param("messageID"), c.Param("emoji")
+	count, err := h.messages.RemoveReaction(c.Request.Context(), c.Param("roomID"), messageID, c.GetString("user_id"), emoji)
+	if err != nil {
+		writeMessageError(c, err, "Failed to remove reaction")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message_id": messageID, "emoji": emoji, "count": count})
+}
+
+// GetReactions lists who reacted to a message
+func (h *Handler) GetReactions(c *gin.Context) {
+	reactions, err := h.messages.ListReactions(c.Request.Context(), c.Param("roomID"), c.Param("messageID"), c.GetString("user_id"))
+	if err != nil {
+		writeMessageError(c, err, "Failed to get reactions")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reactions": reactions})
+}
+
+func writeMessageError(c *gin.Context, err error, fallback string) {
+	switch err {
+	case authz.ErrRoomNotFound, messages.ErrMessageNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case authz.ErrForbidden, authz.ErrBanned, authz.ErrMuted, authz.ErrNotPermitted, authz.ErrArchived, messages.ErrNotAuthor, messages.ErrEditWindowExpired, messages.ErrCannotDelete:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case messages.ErrMessageDeleted:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case messages.ErrEmptyContent, messages.ErrInvalidEmoji, messages.ErrInvalidClientMsgID:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
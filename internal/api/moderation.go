@@ -0,0 +1,136 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/moderation"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type BanRequest struct {
+	UserID   string `json:"user_id" binding:"required"`
+	Duration int    `json:"duration" binding:"min=0"` // seconds, 0 = permanent
+	Reason   string `json:"reason"`
+}
+
+type MuteRequest struct {
+	UserID   string `json:"user_id" binding:"required"`
+	Duration int    `json:"duration" binding:"min=0"` // seconds, 0 = permanent
+}
+
+// GetRoomMembers lists the members of a room with their roles
+func (h *Handler) GetRoomMembers(c *gin.Context) {
+	members, err := h.moderation.ListMembers(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"))
+	if err != nil {
+		writeModerationError(c, err, "Failed to get room members")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// SetMemberRole changes a member's role
+func (h *Handler) SetMemberRole(c *gin.Context) {
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.moderation.SetRole(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"), c.Param("userID"), req.Role)
+	if err != nil {
+		writeModerationError(c, err, "Failed to change role")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role updated"})
+}
+
+// KickMember removes a member from a room
+func (h *Handler) KickMember(c *gin.Context) {
+	err := h.moderation.Kick(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"), c.Param("userID"))
+	if err != nil {
+		writeModerationError(c, err, "Failed to kick member")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Member removed"})
+}
+
+// BanUser bans a user from a room
+func (h *Handler) BanUser(c *gin.Context) {
+	var req BanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.moderation.Ban(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"), req.UserID,
+		time.Duration(req.Duration)*time.Second, req.Reason)
+	if err != nil {
+		writeModerationError(c, err, "Failed to ban user")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User banned"})
+}
+
+// UnbanUser lifts a ban
+func (h *Handler) UnbanUser(c *gin.Context) {
+	err := h.moderation.Unban(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"), c.Param("userID"))
+	if err != nil {
+		writeModerationError(c, err, "Failed to unban user")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unbanned"})
+}
+
+// MuteUser stops a user from posting in a room
+func (h *Handler) MuteUser(c *gin.Context) {
+	var req MuteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := h.moderation.Mute(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"), req.UserID,
+		time.Duration(req.Duration)*time.Second)
+	if err != nil {
+		writeModerationError(c, err, "Failed to mute user")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User muted"})
+}
+
+// UnmuteUser lifts a mute
+func (h *Handler) UnmuteUser(c *gin.Context) {
+	err := h.moderation.Unmute(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"), c.Param("userID"))
+	if err != nil {
+		writeModerationError(c, err, "Failed to unmute user")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unmuted"})
+}
+
+func writeModerationError(c *gin.Context, err error, fallback string) {
+	switch err {
+	case authz.ErrRoomNotFound, moderation.ErrNotMember:
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case authz.ErrForbidden, authz.ErrBanned, authz.ErrNotPermitted, authz.ErrArchived, moderation.ErrCannotTarget, moderation.ErrCannotPromote:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case moderation.ErrInvalidRole:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"net/http"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/chat"
+	"chat-app/internal/rooms"
+
+	"github.com/gin-gonic/gin"
+)
+
+type UpdateRoomRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	IsPrivate   *bool   `json:"is_private"`
+}
+
+type TransferOwnershipRequest struct {
+	UserID string `json:"user_id" binding:"required"`
+}
+
+// GetRoom gets a single room
+func (h *Handler) GetRoom(c *gin.Context) {
+	room, err := h.rooms.Get(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"))
+	if err != nil {
+		writeRoomError(c, err, "Failed to get room")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+// UpdateRoom changes a room's name, description or visibility
+func (h *Handler) UpdateRoom(c *gin.Context) {
+	var req UpdateRoomRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	room, err := h.rooms.Update(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"), rooms.Update{
+		Name:        req.Name,
+		Description: req.Description,
+		IsPrivate:   req.IsPrivate,
+	})
+	if err != nil {
+		writeRoomError(c, err, "Failed to update room")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+// DeleteRoom deletes a room
+func (h *Handler) DeleteRoom(c *gin.Context) {
+	if err := h.rooms.Delete(c.Request.Context(), c.Param("roomID"), c.GetString("user_id")); err != nil {
+		writeRoomError(c, err, "Failed to delete room")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Room deleted"})
+}
+
+// ArchiveRoom makes a room read-only
+func (h *Handler) ArchiveRoom(c *gin.Context) {
+	room, err := h.rooms.Archive(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"))
+	if err != nil {
+		writeRoomError(c, err, "Failed to archive room")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+// UnarchiveRoom makes an archived room writable again
+func (h *Handler) UnarchiveRoom(c *gin.Context) {
+	room, err := h.rooms.Unarchive(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"))
+	if err != nil {
+		writeRoomError(c, err, "Failed to unarchive room")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+// TransferOwnership hands a room over to another member
+func (h *Handler) TransferOwnership(c *gin.Context) {
+	var req TransferOwnershipRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	room, err := h.rooms.TransferOwnership(c.Request.Context(), c.Param("roomID"), c.GetString("user_id"), req.UserID)
+	if err != nil {
+		writeRoomError(c, err, "Failed to transfer ownership")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"room": room})
+}
+
+// JoinRoom makes the caller a member of a room they may read
+func (h *Handler) JoinRoom(c *gin.Context) {
+	err := h.chat.Join(c.Request.Context(), chat.Join{
+		RoomID:   c.Param("roomID"),
+		UserID:   c.GetString("user_id"),
+		Username: c.GetString("username"),
+	})
+	if err != nil {
+		writeRoomError(c, err, "Failed to join room")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Joined room"})
+}
+
+// LeaveRoom ends the caller's membership of a room
+func (h *Handler) LeaveRoom(c *gin.Context) {
+	err := h.chat.Leave(c.Request.Context(), chat.Leave{
+		RoomID:   c.Param("roomID"),
+		UserID:   c.GetString("user_id"),
+		Username: c.GetString("username"),
+	})
+	if err != nil {
+		writeRoomError(c, err, "Failed to leave room")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Left room"})
+}
+
+func writeRoomError(c *gin.Context, err error, fallback string) {
+	switch err {
+	case authz.ErrRoomNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Room not found"})
+	case authz.ErrForbidden, authz.ErrBanned, authz.ErrNotPermitted, authz.ErrArchived:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case rooms.ErrInvalidName, rooms.ErrNotMember, rooms.ErrAlreadyOwner:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case rooms.ErrNotArchived, rooms.ErrAlreadyArchived:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// SubprotocolBearer is the WebSocket subprotocol clients offer alongside
+// their token, e.g. Sec-WebSocket-Protocol: bearer, <jwt>
+const SubprotocolBearer = "bearer"
+
+// TokenCookie is the cookie name checked for a token on WebSocket upgrades
+const TokenCookie = "token"
+
+var (
+	ErrMissingToken = errors.New("token required")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// Claims are the JWT claims issued to chat users. The token ID (jti) is
+// carried in RegisteredClaims.ID and SessionID ties the token to the
+// refresh-token family it was issued from.
+type Claims struct {
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// GenerateToken issues a signed access token for the given user and session
+func (km *KeyManager) GenerateToken(userID, username, sessionID string, ttl time.Duration) (string, *Claims, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	signed, err := km.Sign(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return signed, claims, nil
+}
+
+// ValidateToken parses a token and returns its claims. Expired tokens
+// return ErrTokenExpired so callers can tell them apart from bad ones.
+func (km *KeyManager) ValidateToken(tokenString string) (*Claims, error) {
+	if tokenString == "" {
+		return nil, ErrMissingToken
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, km.Keyfunc,
+		jwt.WithValidMethods([]string{AlgHS256, AlgRS256, AlgEdDSA}), jwt.WithExpirationRequired())
+
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrTokenExpired
+		}
+		return nil, ErrInvalidToken
+	}
+
+	if !token.Valid || claims.UserID == "" || claims.Username == "" {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+// BearerToken strips an optional "Bearer " prefix from an Authorization header
+func BearerToken(header string) string {
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return header[7:]
+	}
+	return header
+}
+
+// TokenFromRequest extracts a token from a WebSocket upgrade request. Browsers
+// cannot set headers on WebSocket connections, so the token may arrive as the
+// "token" query parameter, as the second value of the bearer subprotocol, or
+// as a cookie. The Authorization header is honoured for non-browser clients.
+func TokenFromRequest(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return BearerToken(header)
+	}
+
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+
+	if token, ok := TokenFromSubprotocols(r); ok {
+		return token
+	}
+
+	if cookie, err := r.Cookie(TokenCookie); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// TokenFromSubprotocols returns the token offered via Sec-WebSocket-Protocol
+func TokenFromSubprotocols(r *http.Request) (string, bool) {
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(header, ",") {
+			protocols = append(protocols, strings.TrimSpace(p))
+		}
+	}
+
+	for i := 0; i+1 < len(protocols); i++ {
+		if protocols[i] == SubprotocolBearer {
+			return protocols[i+1], true
+		}
+	}
+
+	return "", false
+}
+
+type contextKey struct{}
+
+// WithClaims returns a context carrying the authenticated caller
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// ClaimsFromContext returns the authenticated caller stored by WithClaims
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(*Claims)
+	return claims, ok
+}
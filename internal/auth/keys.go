@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+// devSecret is only used when no key material is configured at all
+const devSecret = "your-secret-key"
+
+// Key is a single signing or verification key identified by its kid
+type Key struct {
+	ID        string
+	Algorithm string
+	signKey   interface{} // nil for verification-only keys
+	verifyKey interface{}
+}
+
+// CanSign reports whether the key holds private material
+func (k *Key) CanSign() bool {
+	return k.signKey != nil
+}
+
+// KeyManager holds the active signing key and every key accepted for
+// verification. Keeping retired keys around lets tokens signed before a
+// rotation stay valid until they expire.
+type KeyManager struct {
+	mu      sync.RWMutex
+	signing *Key
+	keys    map[string]*Key
+}
+
+// LoadKeys builds a KeyManager from the environment:
+//
+//	JWT_KEYS_DIR        directory of <kid>.pem (RSA/Ed25519, private or public)
+//	                    and <kid>.hs256 (raw HMAC secret) files
+//	JWT_SECRET          HMAC secret, registered under JWT_SECRET_KID
+//	JWT_SIGNING_KEY_ID  kid used to sign new tokens
+func LoadKeys() (*KeyManager, error) {
+	km := &KeyManager{}
+	if err := km.Reload(); err != nil {
+		return nil, err
+	}
+	return km, nil
+}
+
+// Reload re-reads key material, e.g. after a new key was dropped into
+// JWT_KEYS_DIR. On error the current keys are kept.
+func (km *KeyManager) Reload() error {
+	keys := make(map[string]*Key)
+
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		dirKeys, err := loadKeysDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, key := range dirKeys {
+			keys[key.ID] = key
+		}
+	}
+
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		kid := getEnv("JWT_SECRET_KID", "default")
+		if _, exists := keys[kid]; exists {
+			return fmt.Errorf("duplicate key id %q", kid)
+		}
+		keys[kid] = newHMACKey(kid, []byte(secret))
+	}
+
+	if len(keys) == 0 {
+		log.Println("WARNING: no JWT keys configured, using insecure development secret")
+		keys["default"] = newHMACKey("default", []byte(devSecret))
+	}
+
+	signing, err := selectSigningKey(keys, os.Getenv("JWT_SIGNING_KEY_ID"))
+	if err != nil {
+		return err
+	}
+
+	km.mu.Lock()
+	km.keys = keys
+	km.signing = signing
+	km.mu.Unlock()
+
+	log.Printf("Loaded %d JWT key(s), signing with %q (%s)", len(keys), signing.ID, signing.Algorithm)
+	return nil
+}
+
+// SigningKey returns the key new tokens are signed with
+func (km *KeyManager) SigningKey() *Key {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return km.signing
+}
+
+// Sign signs claims with the active key and stamps its kid in the header
+func (km *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	key := km.SigningKey()
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.signKey)
+}
+
+// Keyfunc resolves the verification key from the token's kid header and
+// refuses tokens whose alg does not match that key
+func (km *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	km.mu.RLock()
+	key, ok := km.keys[kid]
+	km.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+	}
+
+	return key.verifyKey, nil
+}
+
+// JWK is a JSON Web Key as published in the JWKS document
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public verification keys. HMAC secrets are never published.
+func (km *KeyManager) JWKS() JWKS {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range km.keys {
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Algorithm,
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JWK{
+				Kty: "OKP",
+				Kid: key.ID,
+				Use: "sig",
+				Alg: key.Algorithm,
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+func newHMACKey(kid string, secret []byte) *Key {
+	return &Key{ID: kid, Algorithm: AlgHS256, signKey: secret, verifyKey: secret}
+}
+
+func selectSigningKey(keys map[string]*Key, kid string) (*Key, error) {
+	if kid != "" {
+		key, ok := keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("signing key %q not found", kid)
+		}
+		if !key.CanSign() {
+			return nil, fmt.Errorf("signing key %q has no private key", kid)
+		}
+		return key, nil
+	}
+
+	var candidates []*Key
+	for _, key := range keys {
+		if key.CanSign() {
+			candidates = append(candidates, key)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return nil, errors.New("no JWT signing key configured")
+	case 1:
+		return candidates[0], nil
+	default:
+		return nil, errors.New("several JWT signing keys configured, set JWT_SIGNING_KEY_ID")
+	}
+}
+
+func loadKeysDir(dir string) ([]*Key, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading JWT_KEYS_DIR: %v", err)
+	}
+
+	var keys []*Key
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		ext := filepath.Ext(entry.Name())
+		kid := strings.TrimSuffix(entry.Name(), ext)
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		switch ext {
+		case ".hs256":
+			keys = append(keys, newHMACKey(kid, []byte(strings.TrimSpace(string(data)))))
+		case ".pem":
+			key, err := parsePEMKey(kid, data)
+			if err != nil {
+				return nil, fmt.Errorf("error loading key %s: %v", entry.Name(), err)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// parsePEMKey accepts PKCS#1/PKCS#8 private keys and PKCS#1/PKIX public
+// keys, deriving the algorithm from the key type
+func parsePEMKey(kid string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &Key{ID: kid, Algorithm: AlgRS256, signKey: k, verifyKey: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &Key{ID: kid, Algorithm: AlgRS256, verifyKey: k}, nil
+	case ed25519.PrivateKey:
+		return &Key{ID: kid, Algorithm: AlgEdDSA, signKey: k, verifyKey: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &Key{ID: kid, Algorithm: AlgEdDSA, verifyKey: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
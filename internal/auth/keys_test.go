@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeRSAKey(t *testing.T, dir, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0600))
+}
+
+func writeEd25519Key(t *testing.T, dir, kid string) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, kid+".pem"), data, 0600))
+}
+
+func TestKeyManagerHMAC(t *testing.T) {
+	t.Setenv("JWT_KEYS_DIR", "")
+	t.Setenv("JWT_SECRET", "test-secret")
+	t.Setenv("JWT_SIGNING_KEY_ID", "")
+
+	km, err := LoadKeys()
+	require.NoError(t, err)
+	assert.Equal(t, AlgHS256, km.SigningKey().Algorithm)
+
+	token, _, err := km.GenerateToken("user-1", "alice", "session-1", time.Minute)
+	require.NoError(t, err)
+
+	claims, err := km.ValidateToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", claims.UserID)
+	assert.Equal(t, "session-1", claims.SessionID)
+
+	// HMAC secrets must never be published
+	assert.Empty(t, km.JWKS().Keys)
+}
+
+func TestKeyManagerRotation(t *testing.T) {
+	dir := t.TempDir()
+	writeRSAKey(t, dir, "rsa-old")
+	writeEd25519Key(t, dir, "ed-new")
+
+	t.Setenv("JWT_KEYS_DIR", dir)
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_SIGNING_KEY_ID", "rsa-old")
+
+	km, err := LoadKeys()
+	require.NoError(t, err)
+
+	oldToken, _, err := km.GenerateToken("user-1", "alice", "", time.Minute)
+	require.NoError(t, err)
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(oldToken, &Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, "rsa-old", parsed.Header["kid"])
+	assert.Equal(t, AlgRS256, parsed.Method.Alg())
+
+	// Rotate: sign with the new key, keep accepting the old one
+	t.Setenv("JWT_SIGNING_KEY_ID", "ed-new")
+	require.NoError(t, km.Reload())
+
+	newToken, _, err := km.GenerateToken("user-1", "alice", "", time.Minute)
+	require.NoError(t, err)
+
+	for _, token := range []string{oldToken, newToken} {
+		_, err := km.ValidateToken(token)
+		assert.NoError(t, err)
+	}
+
+	jwks := km.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	assert.Equal(t, "OKP", jwks.Keys[0].Kty)
+	assert.Equal(t, "RSA", jwks.Keys[1].Kty)
+
+	// Retiring the old key invalidates tokens it signed
+	require.NoError(t, os.Remove(filepath.Join(dir, "rsa-old.pem")))
+	require.NoError(t, km.Reload())
+
+	_, err = km.ValidateToken(oldToken)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestKeyManagerRequiresSigningKeyID(t *testing.T) {
+	dir := t.TempDir()
+	writeRSAKey(t, dir, "a")
+	writeRSAKey(t, dir, "b")
+
+	t.Setenv("JWT_KEYS_DIR", dir)
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("JWT_SIGNING_KEY_ID", "")
+
+	_, err := LoadKeys()
+	assert.Error(t, err)
+}
@@ -0,0 +1,374 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+	"chat-app/internal/models"
+	"chat-app/internal/redis"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// ActionSessionRevoked is the action of the system event sent to a user's
+// channel when one of their sessions is revoked, so that sockets opened
+// with it are closed
+const ActionSessionRevoked = "session_revoked"
+
+// TokenPair is returned to clients on login and refresh
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// Service issues access/refresh token pairs and tracks sessions. Sessions
+// and refresh tokens live in Postgres; revocations are written through to
+// Redis so the per-request check stays off the database.
+type Service struct {
+	db         *database.DB
+	redis      *redis.RedisClient
+	broker     broker.Broker
+	keys       *KeyManager
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+// NewService creates a new auth service
+func NewService(db *database.DB, redis *redis.RedisClient, broker broker.Broker, keys *KeyManager) *Service {
+	return &Service{
+		db:         db,
+		redis:      redis,
+		broker:     broker,
+		keys:       keys,
+		accessTTL:  getDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		refreshTTL: getDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+	}
+}
+
+// Keys returns the key manager used to sign and verify tokens
+func (s *Service) Keys() *KeyManager {
+	return s.keys
+}
+
+// Authenticate validates an access token and rejects revoked ones
+func (s *Service) Authenticate(ctx context.Context, tokenString string) (*Claims, error) {
+	claims, err := s.keys.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.isRevoked(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	return claims, nil
+}
+
+// IssueTokens starts a new session for a user and returns its first token pair
+func (s *Service) IssueTokens(ctx context.Context, userID, username, userAgent, ipAddress string) (*TokenPair, error) {
+	sessionID := uuid.New().String()
+	expiresAt := time.Now().Add(s.refreshTTL)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO sessions (id, user_id, user_agent, ip_address, created_at, last_used_at, expires_at)
+			  VALUES ($1, $2, $3, $4, NOW(), NOW(), $5)`
+	if _, err := tx.ExecContext(ctx, query, sessionID, userID, userAgent, ipAddress, expiresAt); err != nil {
+		return nil, fmt.Errorf("error creating session: %v", err)
+	}
+
+	refreshToken, err := s.insertRefreshToken(ctx, tx, sessionID, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.tokenPair(userID, username, sessionID, refreshToken)
+}
+
+// Refresh rotates a refresh token. Presenting a token that was already
+// rotated means it leaked, so the whole session (token family) is revoked.
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var tokenID, sessionID, userID, username string
+	var expiresAt time.Time
+	var usedAt, revokedAt sql.NullTime
+
+	query := `SELECT rt.id, rt.session_id, rt.expires_at, rt.used_at, s.revoked_at, s.user_id, u.username
+			  FROM refresh_tokens rt
+			  JOIN sessions s ON s.id = rt.session_id
+			  JOIN users u ON u.id = s.user_id
+			  WHERE rt.token_hash = $1
+			  FOR UPDATE OF rt`
+	err = tx.QueryRowContext(ctx, query, hashToken(refreshToken)).Scan(
+		&tokenID, &sessionID, &expiresAt, &usedAt, &revokedAt, &userID, &username)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		tx.Rollback()
+		if err := s.revokeSession(ctx, sessionID); err != nil {
+			log.Printf("Error revoking reused session %s: %v", sessionID, err)
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET used_at = NOW() WHERE id = $1`, tokenID); err != nil {
+		return nil, err
+	}
+
+	newExpiresAt := time.Now().Add(s.refreshTTL)
+	newRefreshToken, err := s.insertRefreshToken(ctx, tx, sessionID, newExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	updateQuery := `UPDATE sessions SET last_used_at = NOW(), expires_at = $2 WHERE id = $1`
+	if _, err := tx.ExecContext(ctx, updateQuery, sessionID, newExpiresAt); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.tokenPair(userID, username, sessionID, newRefreshToken)
+}
+
+// Logout revokes the session behind an access token and the token itself
+func (s *Service) Logout(ctx context.Context, claims *Claims) error {
+	if claims.SessionID != "" {
+		if err := s.revokeSession(ctx, claims.SessionID); err != nil {
+			return err
+		}
+	}
+
+	return s.revokeToken(ctx, claims)
+}
+
+// ListSessions returns a user's active sessions, most recently used first
+func (s *Service) ListSessions(ctx context.Context, userID string) ([]models.Session, error) {
+	query := `SELECT id, user_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, last_used_at, expires_at
+			  FROM sessions
+			  WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+			  ORDER BY last_used_at DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		err := rows.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IPAddress,
+			&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession revokes one of the user's own sessions
+func (s *Service) RevokeSession(ctx context.Context, userID, sessionID string) error {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM sessions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL)`
+	if err := s.db.QueryRowContext(ctx, query, sessionID, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrSessionNotFound
+	}
+
+	return s.revokeSession(ctx, sessionID)
+}
+
+// revokeSession marks a session revoked in Postgres and Redis. Access tokens
+// of the session stay valid for at most accessTTL, so the Redis marker only
+// needs to outlive them. Sockets opened with the session are told to close.
+func (s *Service) revokeSession(ctx context.Context, sessionID string) error {
+	var userID string
+	query := `UPDATE sessions SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL RETURNING user_id`
+	err := s.db.QueryRowContext(ctx, query, sessionID).Scan(&userID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err := s.redis.Set(ctx, revokedSessionKey(sessionID), true, s.accessTTL); err != nil {
+		log.Printf("Error caching session revocation: %v", err)
+	}
+
+	if userID != "" {
+		s.announceRevoked(ctx, userID, sessionID)
+	}
+	return nil
+}
+
+// announceRevoked publishes a session_revoked system event to the user
+func (s *Service) announceRevoked(ctx context.Context, userID, sessionID string) {
+	event := map[string]interface{}{
+		"type":       "system",
+		"user_id":    "system",
+		"username":   "System",
+		"content":    "Session revoked",
+		"message_id": uuid.New().String(),
+		"timestamp":  time.Now().Unix(),
+		"metadata": map[string]interface{}{
+			"action":     ActionSessionRevoked,
+			"session_id": sessionID,
+		},
+	}
+
+	channel := fmt.Sprintf("user:%s", userID)
+	if err := s.broker.Publish(ctx, channel, event); err != nil {
+		log.Printf("Error publishing session revocation: %v", err)
+	}
+}
+
+// revokeToken adds an access token's jti to the revocation list
+func (s *Service) revokeToken(ctx context.Context, claims *Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+
+	query := `INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	if _, err := s.db.ExecContext(ctx, query, claims.ID, claims.ExpiresAt.Time); err != nil {
+		return err
+	}
+
+	// Expired entries are useless; prune them opportunistically
+	s.db.ExecContext(ctx, `DELETE FROM revoked_tokens WHERE expires_at < NOW()`)
+
+	if ttl := time.Until(claims.ExpiresAt.Time); ttl > 0 {
+		if err := s.redis.Set(ctx, revokedTokenKey(claims.ID), true, ttl); err != nil {
+			log.Printf("Error caching token revocation: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// isRevoked checks the revocation list, falling back to Postgres if Redis
+// is unavailable
+func (s *Service) isRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	keys := []string{revokedTokenKey(claims.ID)}
+	if claims.SessionID != "" {
+		keys = append(keys, revokedSessionKey(claims.SessionID))
+	}
+
+	count, err := s.redis.Exists(ctx, keys...)
+	if err == nil {
+		return count > 0, nil
+	}
+	log.Printf("Error checking revocation in Redis: %v", err)
+
+	var revoked bool
+	query := `SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $1)
+			  OR EXISTS(SELECT 1 FROM sessions WHERE id = $2 AND revoked_at IS NOT NULL)`
+	if err := s.db.QueryRowContext(ctx, query, claims.ID, claims.SessionID).Scan(&revoked); err != nil {
+		return false, err
+	}
+
+	return revoked, nil
+}
+
+func (s *Service) insertRefreshToken(ctx context.Context, tx *sql.Tx, sessionID string, expiresAt time.Time) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	query := `INSERT INTO refresh_tokens (id, session_id, token_hash, created_at, expires_at)
+			  VALUES ($1, $2, $3, NOW(), $4)`
+	if _, err := tx.ExecContext(ctx, query, uuid.New().String(), sessionID, hashToken(token), expiresAt); err != nil {
+		return "", fmt.Errorf("error storing refresh token: %v", err)
+	}
+
+	return token, nil
+}
+
+func (s *Service) tokenPair(userID, username, sessionID, refreshToken string) (*TokenPair, error) {
+	accessToken, _, err := s.keys.GenerateToken(userID, username, sessionID, s.accessTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(s.accessTTL.Seconds()),
+	}, nil
+}
+
+// hashToken is used so that refresh tokens are never stored in clear
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func revokedTokenKey(jti string) string {
+	return fmt.Sprintf("auth:revoked:%s", jti)
+}
+
+func revokedSessionKey(sessionID string) string {
+	return fmt.Sprintf("auth:session:%s:revoked", sessionID)
+}
+
+func getDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("Invalid duration for %s: %q, using %s", key, value, defaultValue)
+	}
+	return defaultValue
+}
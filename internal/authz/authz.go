@@ -0,0 +1,211 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"chat-app/internal/database"
+	"chat-app/internal/redis"
+)
+
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrForbidden    = errors.New("not a member of this room")
+	ErrBanned       = errors.New("banned from this room")
+	ErrMuted        = errors.New("muted in this room")
+	ErrNotPermitted = errors.New("insufficient room permissions")
+	ErrArchived     = errors.New("room is archived")
+)
+
+const cacheTTL = 10 * time.Minute
+
+// Membership is what the authorizer knows about a user in a room. It is
+// cached as JSON in a per-room Redis hash keyed by user ID. Ban and mute
+// expiries are stored rather than evaluated so cached entries never outlive
+// a temporary ban.
+type Membership struct {
+	RoomExists  bool   `json:"room_exists"`
+	IsPrivate   bool   `json:"is_private"`
+	Archived    bool   `json:"archived,omitempty"`
+	IsDM        bool   `json:"is_dm,omitempty"`
+	IsMember    bool   `json:"is_member"`
+	Role        string `json:"role,omitempty"`
+	Banned      bool   `json:"banned,omitempty"`
+	BannedUntil int64  `json:"banned_until,omitempty"` // 0 = permanent
+	Muted       bool   `json:"muted,omitempty"`
+	MutedUntil  int64  `json:"muted_until,omitempty"` // 0 = permanent
+}
+
+// IsBanned reports whether a ban is in effect
+func (m *Membership) IsBanned() bool {
+	return m.Banned && (m.BannedUntil == 0 || time.Now().Unix() < m.BannedUntil)
+}
+
+// IsMuted reports whether a mute is in effect
+func (m *Membership) IsMuted() bool {
+	return m.Muted && (m.MutedUntil == 0 || time.Now().Unix() < m.MutedUntil)
+}
+
+// EffectiveRole is the member's role, or RoleMember for non-members of
+// public rooms, who may read and post like members
+func (m *Membership) EffectiveRole() string {
+	if m.IsMember && m.Role != "" {
+		return m.Role
+	}
+	return RoleMember
+}
+
+// Authorizer decides what a user may do in a room. It is the single place
+// REST, WebSocket and gRPC consult: public rooms are open to everyone,
+// private rooms only to rows in room_members, banned users to nobody, and
+// moderation actions depend on the member's role.
+type Authorizer struct {
+	db    *database.DB
+	redis *redis.RedisClient
+}
+
+// NewAuthorizer creates a new room authorizer
+func NewAuthorizer(db *database.DB, redis *redis.RedisClient) *Authorizer {
+	return &Authorizer{
+		db:    db,
+		redis: redis,
+	}
+}
+
+// CanAccessRoom returns nil if the user may read the room, ErrForbidden for
+// private rooms the user is not a member of, ErrBanned for banned users and
+// ErrRoomNotFound otherwise
+func (a *Authorizer) CanAccessRoom(ctx context.Context, userID, roomID string) error {
+	return a.Authorize(ctx, userID, roomID, PermRead)
+}
+
+// Authorize checks room access and that the user's role grants perm.
+// Muted users are refused PermPost; archived rooms are read-only.
+func (a *Authorizer) Authorize(ctx context.Context, userID, roomID string, perm Permission) error {
+	m, err := a.Membership(ctx, userID, roomID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !m.RoomExists:
+		return ErrRoomNotFound
+	case m.IsBanned():
+		return ErrBanned
+	case m.IsPrivate && !m.IsMember:
+		return ErrForbidden
+	case !RoleCan(m.EffectiveRole(), perm):
+		return ErrNotPermitted
+	case m.IsDM && perm == PermInvite:
+		// A DM is identified by its participants; a different set is a new DM
+		return ErrNotPermitted
+	case m.Archived && (perm == PermPost || perm == PermInvite):
+		return ErrArchived
+	case perm == PermPost && m.IsMuted():
+		return ErrMuted
+	}
+
+	return nil
+}
+
+// Membership returns the cached membership record of a user in a room
+func (a *Authorizer) Membership(ctx context.Context, userID, roomID string) (*Membership, error) {
+	if cached, err := a.redis.HGet(ctx, cacheKey(roomID), userID); err == nil {
+		var m Membership
+		if err := json.Unmarshal([]byte(cached), &m); err == nil {
+			return &m, nil
+		}
+	}
+
+	m, err := a.load(ctx, userID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	a.cache(ctx, roomID, userID, m)
+
+	return m, nil
+}
+
+// IsMember reports whether the user has a room_members row for the room,
+// regardless of the room's visibility
+func (a *Authorizer) IsMember(ctx context.Context, userID, roomID string) (bool, error) {
+	m, err := a.Membership(ctx, userID, roomID)
+	if err != nil {
+		return false, err
+	}
+	return m.IsMember, nil
+}
+
+// Invalidate drops the cached decision for one user, e.g. on join, leave,
+// role change, ban or mute
+func (a *Authorizer) Invalidate(ctx context.Context, roomID, userID string) {
+	if err := a.redis.HDel(ctx, cacheKey(roomID), userID); err != nil {
+		log.Printf("Error invalidating room access cache: %v", err)
+	}
+}
+
+// InvalidateRoom drops every cached decision for a room, e.g. when it
+// changes visibility or is archived
+func (a *Authorizer) InvalidateRoom(ctx context.Context, roomID string) {
+	if err := a.redis.Del(ctx, cacheKey(roomID)); err != nil {
+		log.Printf("Error invalidating room access cache: %v", err)
+	}
+}
+
+func (a *Authorizer) load(ctx context.Context, userID, roomID string) (*Membership, error) {
+	m := &Membership{}
+	var role sql.NullString
+	var bannedUntil, mutedUntil sql.NullTime
+
+	query := `SELECT r.is_private, r.archived_at IS NOT NULL, r.kind = 'dm', rm.user_id IS NOT NULL, rm.role,
+				b.user_id IS NOT NULL, b.expires_at,
+				mu.user_id IS NOT NULL, mu.expires_at
+			  FROM rooms r
+			  LEFT JOIN room_members rm ON rm.room_id = r.id AND rm.user_id = $2
+			  LEFT JOIN room_bans b ON b.room_id = r.id AND b.user_id = $2
+			  LEFT JOIN room_mutes mu ON mu.room_id = r.id AND mu.user_id = $2
+			  WHERE r.id = $1`
+
+	err := a.db.QueryRowContext(ctx, query, roomID, userID).Scan(
+		&m.IsPrivate, &m.Archived, &m.IsDM, &m.IsMember, &role, &m.Banned, &bannedUntil, &m.Muted, &mutedUntil)
+	if err == sql.ErrNoRows {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error checking room access: %v", err)
+	}
+
+	m.RoomExists = true
+	m.Role = role.String
+	if bannedUntil.Valid {
+		m.BannedUntil = bannedUntil.Time.Unix()
+	}
+	if mutedUntil.Valid {
+		m.MutedUntil = mutedUntil.Time.Unix()
+	}
+
+	return m, nil
+}
+
+func (a *Authorizer) cache(ctx context.Context, roomID, userID string, m *Membership) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	key := cacheKey(roomID)
+	if err := a.redis.HSet(ctx, key, userID, string(data)); err != nil {
+		log.Printf("Error caching room access: %v", err)
+		return
+	}
+	a.redis.Expire(ctx, key, cacheTTL)
+}
+
+func cacheKey(roomID string) string {
+	return fmt.Sprintf("authz:room:%s", roomID)
+}
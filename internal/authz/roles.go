@@ -0,0 +1,63 @@
+package authz
+
+// Room roles, from most to least privileged
+const (
+	RoleOwner     = "owner"
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// Permission is an action a role may be allowed to take in a room
+type Permission string
+
+const (
+	PermRead           Permission = "read"
+	PermPost           Permission = "post"
+	PermInvite         Permission = "invite"
+	PermKick           Permission = "kick"
+	PermBan            Permission = "ban"
+	PermMute           Permission = "mute"
+	PermEditRoom       Permission = "edit_room"
+	PermDeleteMessages Permission = "delete_messages" // delete others' messages
+	PermManageRoles    Permission = "manage_roles"
+	PermPurgeMessages  Permission = "purge_messages" // hard-delete messages
+	PermDeleteRoom     Permission = "delete_room"
+	PermTransferOwner  Permission = "transfer_ownership"
+)
+
+var roleRank = map[string]int{
+	RoleMember:    1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+	RoleOwner:     4,
+}
+
+var rolePermissions = map[string][]Permission{
+	RoleMember:    {PermRead, PermPost, PermInvite},
+	RoleModerator: {PermRead, PermPost, PermInvite, PermKick, PermMute, PermDeleteMessages},
+	RoleAdmin:     {PermRead, PermPost, PermInvite, PermKick, PermBan, PermMute, PermEditRoom, PermDeleteMessages, PermPurgeMessages, PermManageRoles},
+	RoleOwner:     {PermRead, PermPost, PermInvite, PermKick, PermBan, PermMute, PermEditRoom, PermDeleteMessages, PermPurgeMessages, PermManageRoles, PermDeleteRoom, PermTransferOwner},
+}
+
+// ValidRole reports whether role is a known room role
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// RoleCan reports whether role grants perm
+func RoleCan(role string, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Outranks reports whether role a is strictly more privileged than role b.
+// Moderators can only act on members with a lower role than their own.
+func Outranks(a, b string) bool {
+	return roleRank[a] > roleRank[b]
+}
@@ -0,0 +1,34 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolePermissions(t *testing.T) {
+	assert.True(t, RoleCan(RoleMember, PermPost))
+	assert.True(t, RoleCan(RoleMember, PermInvite))
+	assert.False(t, RoleCan(RoleMember, PermKick))
+
+	assert.True(t, RoleCan(RoleModerator, PermKick))
+	assert.True(t, RoleCan(RoleModerator, PermMute))
+	assert.False(t, RoleCan(RoleModerator, PermBan))
+	assert.False(t, RoleCan(RoleModerator, PermManageRoles))
+
+	assert.True(t, RoleCan(RoleAdmin, PermBan))
+	assert.True(t, RoleCan(RoleOwner, PermEditRoom))
+	assert.False(t, RoleCan("", PermRead))
+}
+
+func TestMembershipBansExpire(t *testing.T) {
+	m := &Membership{RoomExists: true, Banned: true, BannedUntil: 1}
+	assert.False(t, m.IsBanned())
+
+	m.BannedUntil = 0
+	assert.True(t, m.IsBanned())
+	assert.Equal(t, RoleMember, m.EffectiveRole())
+
+	assert.True(t, Outranks(RoleAdmin, RoleModerator))
+	assert.False(t, Outranks(RoleModerator, RoleModerator))
+}
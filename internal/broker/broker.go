@@ -0,0 +1,84 @@
+// Package broker carries events between the parts of the app and between
+// instances. Room events are published on room:<id> channels and events
+// for one user on user:<id>.
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"chat-app/internal/redis"
+)
+
+// Backends selectable with New
+const (
+	KindMemory  = "memory"
+	KindPubSub  = "redis"
+	KindStreams = "streams"
+)
+
+// Message is a payload received on a channel
+type Message struct {
+	Channel string
+	Payload []byte
+}
+
+// Broker publishes events to subscribers
+type Broker interface {
+	// Publish sends an event, encoded as JSON, to a channel's subscribers
+	Publish(ctx context.Context, channel string, event interface{}) error
+	// Subscribe opens a subscription to no channels. A backend that keeps
+	// events resumes a named subscription, opened again under the same
+	// name, where the last one left off; without a name it starts afresh.
+	Subscribe(ctx context.Context, name string) Subscription
+}
+
+// Subscription receives the events published on the channels added to it
+type Subscription interface {
+	// Add returns once events published on the channels will be received
+	Add(ctx context.Context, channels ...string) error
+	Remove(ctx context.Context, channels ...string) error
+	// Receive returns the next event. After an error, such as a dropped
+	// connection, calling it again reconnects and restores the channels.
+	Receive(ctx context.Context) (Message, error)
+	Close() error
+}
+
+// New creates a broker of the given kind: memory for a single instance,
+// redis for Redis Pub/Sub or streams for Redis Streams
+func New(kind string, client *redis.RedisClient) (Broker, error) {
+	switch kind {
+	case KindMemory:
+		return NewMemory(), nil
+	case KindPubSub:
+		return NewPubSub(client), nil
+	case KindStreams:
+		return NewStreams(client), nil
+	default:
+		return nil, fmt.Errorf("unknown broker %q", kind)
+	}
+}
+
+func getInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+		log.Printf("Invalid integer for %s: %q, using %d", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func getDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid duration for %s: %q, using %s", key, value, defaultValue)
+	}
+	return defaultValue
+}
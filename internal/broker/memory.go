@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// memoryQueue is how many events a subscription holds before it drops them
+const memoryQueue = 4096
+
+var (
+	errSubscriptionClosed = errors.New("subscription closed")
+	errSubscriberBehind   = errors.New("subscriber fell behind, events were dropped")
+)
+
+// Memory is a broker within one process, for a single instance and for
+// tests
+type Memory struct {
+	mu   sync.RWMutex
+	subs map[*memorySubscription]struct{}
+}
+
+// NewMemory creates an empty broker
+func NewMemory() *Memory {
+	return &Memory{subs: make(map[*memorySubscription]struct{})}
+}
+
+// Publish hands the event to every subscription to the channel. Like
+// Redis does with slow subscribers, a subscription whose queue is full
+// loses the event, and its next Receive reports it.
+func (b *Memory) Publish(ctx context.Context, channel string, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	var subs []*memorySubscription
+	for sub := range b.subs {
+		if sub.has(channel) {
+			subs = append(subs, sub)
+		}
+	}
+	b.mu.RUnlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.messages <- Message{Channel: channel, Payload: payload}:
+		default:
+			sub.behind.Store(true)
+		}
+	}
+	return nil
+}
+
+// Subscribe opens a subscription to no channels. Memory keeps no events,
+// so the name is ignored.
+func (b *Memory) Subscribe(ctx context.Context, name string) Subscription {
+	sub := &memorySubscription{
+		broker:   b,
+		channels: make(map[string]bool),
+		messages: make(chan Message, memoryQueue),
+		closed:   make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Subscribed reports whether any subscription is on the channel
+func (b *Memory) Subscribed(channel string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs {
+		if sub.has(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+type memorySubscription struct {
+	broker   *Memory
+	mu       sync.RWMutex
+	channels map[string]bool
+	messages chan Message
+	closed   chan struct{}
+	once     sync.Once
+	behind   atomic.Bool
+}
+
+func (s *memorySubscription) has(channel string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.channels[channel]
+}
+
+func (s *memorySubscription) Add(ctx context.Context, channels ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, channel := range channels {
+		s.channels[channel] = true
+	}
+	return nil
+}
+
+func (s *memorySubscription) Remove(ctx context.Context, channels ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, channel := range channels {
+		delete(s.channels, channel)
+	}
+	return nil
+}
+
+func (s *memorySubscription) Receive(ctx context.Context) (Message, error) {
+	if s.behind.Swap(false) {
+		return Message{}, errSubscriberBehind
+	}
+
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-s.closed:
+		return Message{}, errSubscriptionClosed
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (s *memorySubscription) Close() error {
+	s.once.Do(func() {
+		s.broker.mu.Lock()
+		delete(s.broker.subs, s)
+		s.broker.mu.Unlock()
+		close(s.closed)
+	})
+	return nil
+}
@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+
+	sub := b.Subscribe(ctx, "")
+	defer sub.Close()
+	require.NoError(t, sub.Add(ctx, "room:1", "room:2"))
+
+	require.NoError(t, b.Publish(ctx, "room:1", map[string]string{"type": "typing"}))
+	require.NoError(t, b.Publish(ctx, "room:3", map[string]string{"type": "typing"}))
+	msg, err := sub.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "room:1", msg.Channel)
+	assert.JSONEq(t, `{"type":"typing"}`, string(msg.Payload))
+
+	require.NoError(t, sub.Remove(ctx, "room:1"))
+	assert.False(t, b.Subscribed("room:1"))
+	assert.True(t, b.Subscribed("room:2"))
+
+	require.NoError(t, sub.Close())
+	assert.False(t, b.Subscribed("room:2"))
+	_, err = sub.Receive(ctx)
+	assert.Equal(t, errSubscriptionClosed, err)
+}
+
+func TestMemoryBehind(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemory()
+
+	sub := b.Subscribe(ctx, "")
+	defer sub.Close()
+	require.NoError(t, sub.Add(ctx, "room:1"))
+
+	// Events past the queue are dropped and reported once, after which
+	// the queued ones are received
+	for i := 0; i <= memoryQueue; i++ {
+		require.NoError(t, b.Publish(ctx, "room:1", i))
+	}
+	_, err := sub.Receive(ctx)
+	assert.Equal(t, errSubscriberBehind, err)
+
+	msg, err := sub.Receive(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "0", string(msg.Payload))
+}
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"context"
+	"sync"
+
+	chatredis "chat-app/internal/redis"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PubSub is a broker over Redis Pub/Sub. Events published while a
+// subscriber is disconnected are lost to it.
+type PubSub struct {
+	client *chatredis.RedisClient
+}
+
+// NewPubSub creates a broker on a Redis client
+func NewPubSub(client *chatredis.RedisClient) *PubSub {
+	return &PubSub{client: client}
+}
+
+func (b *PubSub) Publish(ctx context.Context, channel string, event interface{}) error {
+	return b.client.Publish(ctx, channel, event)
+}
+
+// Subscribe opens a Pub/Sub connection. go-redis reconnects it on the
+// next Receive after an error and subscribes to its channels again.
+// Pub/Sub keeps no events, so the name is ignored.
+func (b *PubSub) Subscribe(ctx context.Context, name string) Subscription {
+	return &redisSubscription{
+		pubsub:  b.client.Subscribe(ctx),
+		waiting: make(map[string][]chan struct{}),
+	}
+}
+
+type redisSubscription struct {
+	pubsub *redis.PubSub
+
+	// waiting holds the Add calls waiting for Redis to confirm a channel
+	mu      sync.Mutex
+	waiting map[string][]chan struct{}
+}
+
+// Add subscribes to channels and waits for Redis to confirm them, which
+// happens through Receive
+func (s *redisSubscription) Add(ctx context.Context, channels ...string) error {
+	waits := make([]chan struct{}, len(channels))
+	s.mu.Lock()
+	for i, channel := range channels {
+		waits[i] = make(chan struct{})
+		s.waiting[channel] = append(s.waiting[channel], waits[i])
+	}
+	s.mu.Unlock()
+
+	if err := s.pubsub.Subscribe(ctx, channels...); err != nil {
+		return err
+	}
+	for _, wait := range waits {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (s *redisSubscription) Remove(ctx context.Context, channels ...string) error {
+	return s.pubsub.Unsubscribe(ctx, channels...)
+}
+
+func (s *redisSubscription) Receive(ctx context.Context) (Message, error) {
+	for {
+		msg, err := s.pubsub.Receive(ctx)
+		if err != nil {
+			return Message{}, err
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Message:
+			return Message{Channel: msg.Channel, Payload: []byte(msg.Payload)}, nil
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" {
+				s.confirm(msg.Channel)
+			}
+		}
+	}
+}
+
+func (s *redisSubscription) confirm(channel string) {
+	s.mu.Lock()
+	waits := s.waiting[channel]
+	delete(s.waiting, channel)
+	s.mu.Unlock()
+
+	for _, wait := range waits {
+		close(wait)
+	}
+}
+
+func (s *redisSubscription) Close() error {
+	return s.pubsub.Close()
+}
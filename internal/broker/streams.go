@@ -0,0 +1,318 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	chatredis "chat-app/internal/redis"
+
+	"github.com/google/uuid"
+)
+
+// Each channel is the stream streamPrefix+channel, whose entries hold the
+// event under payloadField. Consumer groups are named groupPrefix plus the
+// subscription's name.
+const (
+	streamPrefix = "stream:"
+	payloadField = "payload"
+	groupPrefix  = "chat-"
+	readCount    = 100
+	readBlock    = time.Second
+)
+
+// Streams is a broker over Redis Streams. Each channel is a stream trimmed
+// to about BROKER_STREAM_MAXLEN entries (default 10000), which every
+// subscription reads through a consumer group of its own. The group
+// remembers how far a named subscription got, so events published while
+// it was down are read once it is back. Groups whose consumers have been
+// idle for BROKER_STREAM_GROUP_IDLE (default 1h) are taken to belong to
+// instances that are gone, and removed.
+type Streams struct {
+	client *chatredis.RedisClient
+	maxLen int64
+	idle   time.Duration
+}
+
+// NewStreams creates a broker on a Redis client
+func NewStreams(client *chatredis.RedisClient) *Streams {
+	return &Streams{
+		client: client,
+		maxLen: int64(getInt("BROKER_STREAM_MAXLEN", 10000)),
+		idle:   getDuration("BROKER_STREAM_GROUP_IDLE", time.Hour),
+	}
+}
+
+func (b *Streams) Publish(ctx context.Context, channel string, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return b.client.XAdd(ctx, streamPrefix+channel, b.maxLen, map[string]interface{}{payloadField: payload})
+}
+
+// Subscribe creates a subscription reading through the consumer group of
+// its name. A named group outlives the subscription, and one opened again
+// under the same name first gets what it read but did not deliver, then
+// what was published in between. Without a name the group is a new one,
+// removed when the subscription is closed.
+func (b *Streams) Subscribe(ctx context.Context, name string) Subscription {
+	durable := name != ""
+	if !durable {
+		name = uuid.New().String()
+	}
+
+	return &streamSubscription{
+		client:    b.client,
+		group:     groupPrefix + name,
+		durable:   durable,
+		idle:      b.idle,
+		streams:   make(map[string]bool),
+		pending:   true,
+		delivered: make(map[string][]string),
+		added:     make(chan struct{}, 1),
+	}
+}
+
+type streamSubscription struct {
+	client  *chatredis.RedisClient
+	group   string // also the name of its only consumer
+	durable bool
+	idle    time.Duration
+
+	mu        sync.Mutex
+	streams   map[string]bool
+	pending   bool                // entries read before may be unacknowledged
+	delivered map[string][]string // returned by Receive, not yet acknowledged
+	added     chan struct{}       // wakes a Receive waiting for streams
+
+	read []streamEntry // read, not yet returned by Receive
+}
+
+type streamEntry struct {
+	stream string
+	id     string
+	msg    Message
+}
+
+// Add creates the group on the channels' streams, starting from their
+// current end unless it is already there. Streams whose group could not be
+// created are still read: Receive creates it once Redis is back.
+func (s *streamSubscription) Add(ctx context.Context, channels ...string) error {
+	var err error
+	for _, channel := range channels {
+		stream := streamPrefix + channel
+		s.mu.Lock()
+		s.streams[stream] = true
+		s.pending = true
+		s.mu.Unlock()
+
+		if groupErr := s.createGroup(ctx, stream); groupErr != nil {
+			err = groupErr
+			continue
+		}
+		s.prune(ctx, stream)
+	}
+
+	select {
+	case s.added <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+func (s *streamSubscription) Remove(ctx context.Context, channels ...string) error {
+	for _, channel := range channels {
+		stream := streamPrefix + channel
+		s.mu.Lock()
+		delete(s.streams, stream)
+		delete(s.delivered, stream)
+		s.mu.Unlock()
+
+		if err := s.client.XGroupDestroy(ctx, stream, s.group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Receive returns the next entry. Entries are acknowledged once returned,
+// in a batch before the next read, so whatever was read but not returned
+// is read again when the group is next subscribed to.
+func (s *streamSubscription) Receive(ctx context.Context) (Message, error) {
+	for len(s.read) == 0 {
+		streams := s.snapshot()
+		if len(streams) == 0 {
+			select {
+			case <-s.added:
+				continue
+			case <-ctx.Done():
+				return Message{}, ctx.Err()
+			}
+		}
+
+		s.ack(ctx)
+
+		// Entries left unacknowledged by an earlier subscription come
+		// first, until there are none
+		s.mu.Lock()
+		start := ">"
+		if s.pending {
+			start = "0"
+			s.pending = false
+		}
+		s.mu.Unlock()
+
+		results, err := s.client.XReadGroup(ctx, s.group, s.group, streams, start, readCount, readBlock)
+		if err != nil {
+			s.mu.Lock()
+			s.pending = s.pending || start == "0"
+			s.mu.Unlock()
+
+			// A stream was removed meanwhile, or Redis lost the groups,
+			// in which case they start over from now
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				s.restoreGroups(ctx)
+				continue
+			}
+			return Message{}, err
+		}
+
+		for _, result := range results {
+			if start == "0" && len(result.Messages) > 0 {
+				s.mu.Lock()
+				s.pending = true
+				s.mu.Unlock()
+			}
+
+			for _, entry := range result.Messages {
+				// Entries trimmed from the stream while pending come
+				// back without values; they are only acknowledged
+				payload, ok := entry.Values[payloadField].(string)
+				if !ok {
+					s.mu.Lock()
+					s.delivered[result.Stream] = append(s.delivered[result.Stream], entry.ID)
+					s.mu.Unlock()
+					continue
+				}
+				s.read = append(s.read, streamEntry{
+					stream: result.Stream,
+					id:     entry.ID,
+					msg: Message{
+						Channel: strings.TrimPrefix(result.Stream, streamPrefix),
+						Payload: []byte(payload),
+					},
+				})
+			}
+		}
+	}
+
+	entry := s.read[0]
+	s.read = s.read[1:]
+
+	s.mu.Lock()
+	if s.streams[entry.stream] {
+		s.delivered[entry.stream] = append(s.delivered[entry.stream], entry.id)
+	}
+	s.mu.Unlock()
+	return entry.msg, nil
+}
+
+// Close acknowledges what was delivered and leaves a named group in place
+// for the next subscription under its name. Any other group is removed
+// from every stream it reads.
+func (s *streamSubscription) Close() error {
+	ctx := context.Background()
+	if s.durable {
+		s.ack(ctx)
+		return nil
+	}
+
+	for _, stream := range s.snapshot() {
+		if err := s.client.XGroupDestroy(ctx, stream, s.group); err != nil {
+			log.Printf("Error removing consumer group from %s: %v", stream, err)
+		}
+	}
+	return nil
+}
+
+func (s *streamSubscription) snapshot() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	streams := make([]string, 0, len(s.streams))
+	for stream := range s.streams {
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// ack acknowledges the entries Receive returned. Those it fails to are
+// delivered again to the next subscription under the group's name.
+func (s *streamSubscription) ack(ctx context.Context) {
+	s.mu.Lock()
+	delivered := s.delivered
+	s.delivered = make(map[string][]string)
+	s.mu.Unlock()
+
+	for stream, ids := range delivered {
+		if err := s.client.XAck(ctx, stream, s.group, ids...); err != nil {
+			log.Printf("Error acknowledging %d entries of %s: %v", len(ids), stream, err)
+		}
+	}
+}
+
+func (s *streamSubscription) createGroup(ctx context.Context, stream string) error {
+	err := s.client.XGroupCreate(ctx, stream, s.group, "$")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+func (s *streamSubscription) restoreGroups(ctx context.Context) {
+	for _, stream := range s.snapshot() {
+		if err := s.createGroup(ctx, stream); err != nil {
+			log.Printf("Error restoring consumer group on %s: %v", stream, err)
+		}
+	}
+}
+
+// prune removes the stream's other groups whose consumers have all been
+// idle too long, such as those of crashed instances. A live subscription
+// reads at least every readBlock, so its consumer never idles that long.
+func (s *streamSubscription) prune(ctx context.Context, stream string) {
+	groups, err := s.client.XInfoGroups(ctx, stream)
+	if err != nil {
+		log.Printf("Error listing consumer groups of %s: %v", stream, err)
+		return
+	}
+
+	for _, group := range groups {
+		if group.Name == s.group || !strings.HasPrefix(group.Name, groupPrefix) {
+			continue
+		}
+
+		consumers, err := s.client.XInfoConsumers(ctx, stream, group.Name)
+		if err != nil || len(consumers) == 0 {
+			continue
+		}
+		stale := true
+		for _, consumer := range consumers {
+			if consumer.Idle < s.idle {
+				stale = false
+				break
+			}
+		}
+		if !stale {
+			continue
+		}
+
+		if err := s.client.XGroupDestroy(ctx, stream, group.Name); err != nil {
+			log.Printf("Error removing stale consumer group %s from %s: %v", group.Name, stream, err)
+		}
+	}
+}
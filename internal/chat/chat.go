@@ -0,0 +1,189 @@
+// Package chat carries out what clients ask of a room: sending, editing and
+// deleting messages, and joining and leaving. REST, WebSocket and gRPC all
+// go through it, so a command is validated, stored, followed up and
+// announced the same way whichever transport it came in on.
+package chat
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+	"chat-app/internal/messages"
+	"chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// Send posts a new message. MessageType defaults to "text"; a retry with
+// the same ClientMsgID returns the original message.
+type Send struct {
+	RoomID      string
+	UserID      string
+	Username    string
+	Content     string
+	MessageType string
+	Metadata    interface{}
+	ParentID    string
+	ClientMsgID string
+}
+
+// Edit replaces the content of the sender's own message
+type Edit struct {
+	RoomID    string
+	MessageID string
+	UserID    string
+	Content   string
+}
+
+// Delete leaves a tombstone of a message, or with Purge removes it
+// entirely
+type Delete struct {
+	RoomID    string
+	MessageID string
+	UserID    string
+	Purge     bool
+}
+
+// Join makes a user a member of a room they may read
+type Join struct {
+	RoomID   string
+	UserID   string
+	Username string
+}
+
+// Leave ends a user's membership of a room
+type Leave struct {
+	RoomID   string
+	UserID   string
+	Username string
+}
+
+// Service runs chat commands. Messages are stored and announced by the
+// message service; joins and leaves are announced here, as join and leave
+// events, when they change the membership.
+type Service struct {
+	db       *database.DB
+	broker   broker.Broker
+	authz    *authz.Authorizer
+	messages *messages.Service
+}
+
+// NewService creates a new chat service
+func NewService(db *database.DB, broker broker.Broker, authorizer *authz.Authorizer, messageService *messages.Service) *Service {
+	return &Service{
+		db:       db,
+		broker:   broker,
+		authz:    authorizer,
+		messages: messageService,
+	}
+}
+
+// Send stores a message and runs its follow-ups. duplicate is set when the
+// message was sent before, in which case nothing is stored or run again.
+func (s *Service) Send(ctx context.Context, cmd Send) (message *models.Message, duplicate bool, err error) {
+	if err := s.authz.Authorize(ctx, cmd.UserID, cmd.RoomID, authz.PermPost); err != nil {
+		return nil, false, err
+	}
+
+	message, duplicate, err = s.messages.Store(ctx, messages.Draft{
+		RoomID:      cmd.RoomID,
+		UserID:      cmd.UserID,
+		Username:    cmd.Username,
+		Content:     cmd.Content,
+		MessageType: cmd.MessageType,
+		Metadata:    cmd.Metadata,
+		ParentID:    cmd.ParentID,
+		ClientMsgID: cmd.ClientMsgID,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Store queued the message event through the outbox; only new
+	// messages get follow-ups
+	if !duplicate {
+		s.messages.Sent(ctx, message.ID)
+	}
+	return message, duplicate, nil
+}
+
+// Edit changes a message and returns it
+func (s *Service) Edit(ctx context.Context, cmd Edit) (*models.Message, error) {
+	return s.messages.Edit(ctx, cmd.RoomID, cmd.MessageID, cmd.UserID, cmd.Content)
+}
+
+// Delete deletes a message and returns its tombstone, or nil if it was
+// purged
+func (s *Service) Delete(ctx context.Context, cmd Delete) (*models.Message, error) {
+	if cmd.Purge {
+		return nil, s.messages.Purge(ctx, cmd.RoomID, cmd.MessageID, cmd.UserID)
+	}
+	return s.messages.Delete(ctx, cmd.RoomID, cmd.MessageID, cmd.UserID)
+}
+
+// Join adds the user to the room's members. Joining a room the user is
+// already a member of succeeds without announcing it again.
+func (s *Service) Join(ctx context.Context, cmd Join) error {
+	if err := s.authz.CanAccessRoom(ctx, cmd.UserID, cmd.RoomID); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO room_members (room_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	result, err := s.db.ExecContext(ctx, query, cmd.RoomID, cmd.UserID)
+	if err != nil {
+		return fmt.Errorf("error joining room: %v", err)
+	}
+	s.authz.Invalidate(ctx, cmd.RoomID, cmd.UserID)
+
+	if n, _ := result.RowsAffected(); n > 0 {
+		s.publish(ctx, membershipEvent("join", cmd.RoomID, cmd.UserID, cmd.Username))
+	}
+	return nil
+}
+
+// Leave removes the user from the room's members. Leaving a room the user
+// is not a member of succeeds without announcing it.
+func (s *Service) Leave(ctx context.Context, cmd Leave) error {
+	query := `DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`
+	result, err := s.db.ExecContext(ctx, query, cmd.RoomID, cmd.UserID)
+	if err != nil {
+		return fmt.Errorf("error leaving room: %v", err)
+	}
+	s.authz.Invalidate(ctx, cmd.RoomID, cmd.UserID)
+
+	if n, _ := result.RowsAffected(); n > 0 {
+		s.publish(ctx, membershipEvent("leave", cmd.RoomID, cmd.UserID, cmd.Username))
+	}
+	return nil
+}
+
+// membershipEvent announces that a user joined or left a room
+func membershipEvent(eventType, roomID, userID, username string) models.Event {
+	verb := "joined"
+	if eventType == "leave" {
+		verb = "left"
+	}
+
+	return models.Event{
+		Type:      eventType,
+		MessageID: uuid.New().String(),
+		UserID:    userID,
+		Username:  username,
+		RoomID:    roomID,
+		Content:   fmt.Sprintf("%s %s the room", username, verb),
+		Timestamp: time.Now().Unix(),
+	}
+}
+
+// publish sends an event to every instance via the room channel
+func (s *Service) publish(ctx context.Context, event models.Event) {
+	channel := fmt.Sprintf("room:%s", event.RoomID)
+	if err := s.broker.Publish(ctx, channel, event); err != nil {
+		log.Printf("Error publishing %s to room %s: %v", event.Type, event.RoomID, err)
+	}
+}
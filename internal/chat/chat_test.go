@@ -0,0 +1,26 @@
+package chat
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMembershipEvent(t *testing.T) {
+	event := membershipEvent("join", "r1", "u1", "alice")
+	assert.Equal(t, "alice joined the room", event.Content)
+	assert.NotEmpty(t, event.MessageID)
+
+	data, err := json.Marshal(membershipEvent("leave", "r1", "u1", "alice"))
+	require.NoError(t, err)
+
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &fields))
+	assert.Equal(t, "leave", fields["type"])
+	assert.Equal(t, "alice left the room", fields["content"])
+	assert.Equal(t, "r1", fields["room_id"])
+	assert.NotContains(t, fields, "seq")
+	assert.NotContains(t, fields, "metadata")
+}
@@ -76,9 +76,161 @@ func (db *DB) InitTables() error {
 			joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			PRIMARY KEY (room_id, user_id)
 		)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_by VARCHAR(36)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS parent_id VARCHAR(36) REFERENCES messages(id) ON DELETE SET NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS client_msg_id VARCHAR(64)`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_root_id VARCHAR(36) REFERENCES messages(id) ON DELETE SET NULL`,
+		`ALTER TABLE messages ADD COLUMN IF NOT EXISTS seq BIGINT`,
+		`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS last_seq BIGINT NOT NULL DEFAULT 0`,
+		// Number messages sent before sequence numbers existed, in order. The
+		// partial index keeps this to the messages left unnumbered on later
+		// startups, which is none once every instance numbers its messages.
+		`CREATE INDEX IF NOT EXISTS idx_messages_unnumbered ON messages(room_id) WHERE seq IS NULL`,
+		`WITH numbered AS (
+			SELECT m.id, r.last_seq + ROW_NUMBER() OVER (PARTITION BY m.room_id ORDER BY m.timestamp, m.id) AS seq
+			FROM messages m JOIN rooms r ON r.id = m.room_id
+			WHERE m.seq IS NULL
+		), backfilled AS (
+			UPDATE messages m SET seq = n.seq FROM numbered n WHERE m.id = n.id
+			RETURNING m.room_id, m.seq
+		)
+		UPDATE rooms r SET last_seq = b.last_seq
+		FROM (SELECT room_id, MAX(seq) AS last_seq FROM backfilled GROUP BY room_id) b
+		WHERE r.id = b.room_id`,
+		`CREATE TABLE IF NOT EXISTS message_revisions (
+			id VARCHAR(36) PRIMARY KEY,
+			message_id VARCHAR(36) REFERENCES messages(id) ON DELETE CASCADE,
+			content TEXT NOT NULL,
+			edited_by VARCHAR(36) REFERENCES users(id),
+			edited_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS message_reactions (
+			message_id VARCHAR(36) REFERENCES messages(id) ON DELETE CASCADE,
+			user_id VARCHAR(36) REFERENCES users(id),
+			emoji VARCHAR(32) NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (message_id, user_id, emoji)
+		)`,
+		`CREATE TABLE IF NOT EXISTS message_mentions (
+			message_id VARCHAR(36) REFERENCES messages(id) ON DELETE CASCADE,
+			user_id VARCHAR(36) REFERENCES users(id),
+			room_id VARCHAR(36) REFERENCES rooms(id) ON DELETE CASCADE,
+			kind VARCHAR(10) NOT NULL,
+			read_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (message_id, user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS room_reads (
+			room_id VARCHAR(36) REFERENCES rooms(id) ON DELETE CASCADE,
+			user_id VARCHAR(36) REFERENCES users(id),
+			last_read_id VARCHAR(36),
+			last_read_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (room_id, user_id)
+		)`,
+		`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP`,
+		`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS kind VARCHAR(10) DEFAULT 'room'`,
+		`ALTER TABLE rooms ADD COLUMN IF NOT EXISTS dm_key VARCHAR(64)`,
+		`ALTER TABLE room_members ADD COLUMN IF NOT EXISTS role VARCHAR(20) DEFAULT 'member'`,
+		`UPDATE room_members rm SET role = 'owner'
+			FROM rooms r
+			WHERE r.id = rm.room_id AND r.created_by = rm.user_id AND rm.role = 'member'`,
+		`CREATE TABLE IF NOT EXISTS room_bans (
+			room_id VARCHAR(36) REFERENCES rooms(id) ON DELETE CASCADE,
+			user_id VARCHAR(36) REFERENCES users(id),
+			banned_by VARCHAR(36) REFERENCES users(id),
+			reason TEXT,
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (room_id, user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS room_mutes (
+			room_id VARCHAR(36) REFERENCES rooms(id) ON DELETE CASCADE,
+			user_id VARCHAR(36) REFERENCES users(id),
+			muted_by VARCHAR(36) REFERENCES users(id),
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (room_id, user_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS room_invitations (
+			id VARCHAR(36) PRIMARY KEY,
+			room_id VARCHAR(36) REFERENCES rooms(id) ON DELETE CASCADE,
+			inviter_id VARCHAR(36) REFERENCES users(id),
+			invitee_id VARCHAR(36) REFERENCES users(id),
+			status VARCHAR(20) DEFAULT 'pending',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			responded_at TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS room_invite_links (
+			code VARCHAR(32) PRIMARY KEY,
+			room_id VARCHAR(36) REFERENCES rooms(id) ON DELETE CASCADE,
+			created_by VARCHAR(36) REFERENCES users(id),
+			max_uses INTEGER DEFAULT 0,
+			uses INTEGER DEFAULT 0,
+			expires_at TIMESTAMP,
+			revoked_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id VARCHAR(36) PRIMARY KEY,
+			user_id VARCHAR(36) REFERENCES users(id),
+			user_agent TEXT,
+			ip_address VARCHAR(45),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id VARCHAR(36) PRIMARY KEY,
+			session_id VARCHAR(36) REFERENCES sessions(id) ON DELETE CASCADE,
+			token_hash VARCHAR(64) UNIQUE NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS revoked_tokens (
+			jti VARCHAR(36) PRIMARY KEY,
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS outbox (
+			id BIGSERIAL PRIMARY KEY,
+			channel VARCHAR(100) NOT NULL,
+			payload JSONB NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			delivered_at TIMESTAMP
+		)`,
+		// Edits, deletions and reactions, each after the last message of its
+		// room at the time, for replay to clients that missed them
+		`CREATE TABLE IF NOT EXISTS message_changes (
+			id BIGSERIAL PRIMARY KEY,
+			room_id VARCHAR(36) REFERENCES rooms(id) ON DELETE CASCADE,
+			after_seq BIGINT NOT NULL,
+			event JSONB NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_room_id ON messages(room_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_timestamp ON messages(timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_room_timestamp ON messages(room_id, timestamp)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_room_seq ON messages(room_id, seq)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_client_msg_id ON messages(user_id, client_msg_id) WHERE client_msg_id IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_messages_thread_root ON messages(thread_root_id, timestamp) WHERE thread_root_id IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_message_revisions_message_id ON message_revisions(message_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_message_mentions_user ON message_mentions(user_id, created_at)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_rooms_dm_key ON rooms(dm_key) WHERE dm_key IS NOT NULL`,
 		`CREATE INDEX IF NOT EXISTS idx_users_status ON users(status)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_room_invitations_pending ON room_invitations(room_id, invitee_id) WHERE status = 'pending'`,
+		`CREATE INDEX IF NOT EXISTS idx_room_invitations_invitee ON room_invitations(invitee_id, status)`,
+		`CREATE INDEX IF NOT EXISTS idx_room_invite_links_room_id ON room_invite_links(room_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON refresh_tokens(session_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_outbox_pending ON outbox(id) WHERE delivered_at IS NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_outbox_delivered ON outbox(delivered_at) WHERE delivered_at IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_message_changes_room_seq ON message_changes(room_id, after_seq)`,
 	}
 
 	for _, query := range queries {
@@ -0,0 +1,212 @@
+// Package fanout carries room and user events between instances. Each
+// instance subscribes only to the channels it has local members for, and
+// delivers what it publishes itself locally instead of waiting for the echo.
+package fanout
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"chat-app/internal/broker"
+
+	"github.com/google/uuid"
+)
+
+// Reconnect backoff bounds, and how long a new subscription may take to be
+// confirmed before Ready gives up on it
+const (
+	minBackoff     = 100 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+	confirmTimeout = 5 * time.Second
+)
+
+// Envelope is what an instance publishes: an event stamped with the
+// instance it came from
+type Envelope struct {
+	Origin string          `json:"origin"`
+	Event  json.RawMessage `json:"event"`
+}
+
+// Open returns the event in a payload and the instance that published it.
+// Payloads published without an envelope, as services do, have no origin.
+func Open(payload []byte) ([]byte, string) {
+	var envelope Envelope
+	if err := json.Unmarshal(payload, &envelope); err != nil || envelope.Origin == "" || len(envelope.Event) == 0 {
+		return payload, ""
+	}
+	return envelope.Event, envelope.Origin
+}
+
+// Node is one instance's end of the broker. The channels it listens on
+// follow Want, which the hub calls as rooms and users gain and lose local
+// members.
+type Node struct {
+	instance string
+	broker   broker.Broker
+	sub      broker.Subscription
+	deliver  func(channel string, event []byte)
+
+	mu      sync.Mutex
+	changes []change
+	ready   map[string]chan struct{} // closed once a wanted channel is subscribed
+	wake    chan struct{}
+}
+
+// change is a channel to subscribe to or unsubscribe from, applied in order
+type change struct {
+	channel string
+	want    bool
+	ready   chan struct{}
+}
+
+// NewNode creates a node delivering events from other instances through
+// deliver. INSTANCE_ID names this instance (default random); when it is
+// set, a broker that keeps events resumes the instance's subscription
+// after a restart.
+func NewNode(b broker.Broker, deliver func(channel string, event []byte)) *Node {
+	name := os.Getenv("INSTANCE_ID")
+	instance := name
+	if instance == "" {
+		instance = uuid.New().String()
+	}
+
+	return &Node{
+		instance: instance,
+		broker:   b,
+		sub:      b.Subscribe(context.Background(), name),
+		deliver:  deliver,
+		ready:    make(map[string]chan struct{}),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Instance returns the ID stamped on what this node publishes
+func (n *Node) Instance() string {
+	return n.instance
+}
+
+// Publish delivers an event locally, then sends it to the other instances
+func (n *Node) Publish(ctx context.Context, channel string, event interface{}) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	n.deliver(channel, data)
+	return n.broker.Publish(ctx, channel, Envelope{Origin: n.instance, Event: data})
+}
+
+// Want subscribes to or unsubscribes from a channel. Changes are applied
+// in the order they are made, in the background; it does not block.
+func (n *Node) Want(channel string, want bool) {
+	c := change{channel: channel, want: want}
+
+	n.mu.Lock()
+	if want {
+		c.ready = make(chan struct{})
+		n.ready[channel] = c.ready
+	} else {
+		delete(n.ready, channel)
+	}
+	n.changes = append(n.changes, c)
+	n.mu.Unlock()
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Ready waits until a wanted channel is subscribed, so that nothing
+// published on it afterwards is missed. Unwanted channels are ready.
+func (n *Node) Ready(ctx context.Context, channel string) error {
+	n.mu.Lock()
+	ready := n.ready[channel]
+	n.mu.Unlock()
+
+	if ready == nil {
+		return nil
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run receives events from the other instances until ctx is done, skipping
+// the echo of this node's own. When the connection drops it retries with
+// exponential backoff.
+func (n *Node) Run(ctx context.Context) {
+	go n.apply(ctx)
+	defer n.sub.Close()
+
+	backoff := minBackoff
+	for {
+		msg, err := n.sub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Fan-out receive failed, retrying in %s: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+
+		event, origin := Open(msg.Payload)
+		if origin == n.instance {
+			continue
+		}
+		n.deliver(msg.Channel, event)
+	}
+}
+
+// apply makes the subscription follow Want
+func (n *Node) apply(ctx context.Context) {
+	for {
+		select {
+		case <-n.wake:
+		case <-ctx.Done():
+			return
+		}
+
+		for {
+			n.mu.Lock()
+			if len(n.changes) == 0 {
+				n.mu.Unlock()
+				break
+			}
+			c := n.changes[0]
+			n.changes = n.changes[1:]
+			n.mu.Unlock()
+
+			if !c.want {
+				if err := n.sub.Remove(ctx, c.channel); err != nil {
+					log.Printf("Error unsubscribing from %s: %v", c.channel, err)
+				}
+				continue
+			}
+
+			// A channel that could not be confirmed is still subscribed to
+			// once the connection is back, so its waiters are let go
+			confirmCtx, cancel := context.WithTimeout(ctx, confirmTimeout)
+			if err := n.sub.Add(confirmCtx, c.channel); err != nil {
+				log.Printf("Error subscribing to %s: %v", c.channel, err)
+			}
+			cancel()
+			close(c.ready)
+		}
+	}
+}
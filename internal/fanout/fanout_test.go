@@ -0,0 +1,121 @@
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-app/internal/broker"
+	"chat-app/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// instance is a hub whose rooms are shared with other instances through a
+// node, as the WebSocket handler wires them
+type instance struct {
+	hub  *models.Hub
+	node *Node
+}
+
+func newInstance(t *testing.T, b broker.Broker) *instance {
+	in := &instance{}
+	in.node = NewNode(b, func(channel string, event []byte) {
+		in.hub.Broadcast(strings.TrimPrefix(channel, "room:"), models.Outbound{Data: event}, nil)
+	})
+	in.hub = models.NewHub(models.HubConfig{
+		Shards: 4,
+		RoomActive: func(roomID string, active bool) {
+			in.node.Want("room:"+roomID, active)
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		in.node.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		in.hub.Stop()
+	})
+	return in
+}
+
+func (in *instance) join(t *testing.T, userID, roomID string) *models.Connection {
+	conn := models.NewConnection(userID, userID, "", nil, in.hub)
+	in.hub.Register(conn)
+	require.NoError(t, in.hub.Subscribe(conn, roomID, 0))
+	require.NoError(t, in.node.Ready(context.Background(), "room:"+roomID))
+	return conn
+}
+
+func receive(t *testing.T, conn *models.Connection) string {
+	select {
+	case data := <-conn.Send:
+		return string(data)
+	case <-time.After(time.Second):
+		t.Fatalf("nothing received by %s", conn.UserID)
+		return ""
+	}
+}
+
+func assertNothing(t *testing.T, conn *models.Connection) {
+	select {
+	case data := <-conn.Send:
+		t.Fatalf("%s received %s", conn.UserID, data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestOpen(t *testing.T) {
+	event, origin := Open([]byte(`{"origin":"a","event":{"type":"typing"}}`))
+	assert.Equal(t, `{"type":"typing"}`, string(event))
+	assert.Equal(t, "a", origin)
+
+	event, origin = Open([]byte(`{"type":"message"}`))
+	assert.Equal(t, `{"type":"message"}`, string(event))
+	assert.Empty(t, origin)
+}
+
+func TestTwoInstances(t *testing.T) {
+	ctx := context.Background()
+	bus := broker.NewMemory()
+	a := newInstance(t, bus)
+	b := newInstance(t, bus)
+	require.NotEqual(t, a.node.Instance(), b.node.Instance())
+
+	alice := a.join(t, "alice", "room-1")
+	bob := b.join(t, "bob", "room-1")
+	assert.True(t, bus.Subscribed("room:room-1"))
+	assert.False(t, bus.Subscribed("room:room-2"))
+
+	// Each event arrives once on both instances: locally from the
+	// publisher, and from the bus elsewhere, the echo being skipped
+	for n, in := range []*instance{a, b} {
+		require.NoError(t, in.node.Publish(ctx, "room:room-1", map[string]int{"n": n}))
+		for _, conn := range []*models.Connection{alice, bob} {
+			assert.Equal(t, fmt.Sprintf(`{"n":%d}`, n), receive(t, conn))
+		}
+	}
+	assertNothing(t, alice)
+	assertNothing(t, bob)
+
+	// Events published without an envelope reach every instance
+	require.NoError(t, bus.Publish(ctx, "room:room-1", map[string]int{"n": 3}))
+	assert.Equal(t, `{"n":3}`, receive(t, alice))
+	assert.Equal(t, `{"n":3}`, receive(t, bob))
+
+	// An instance whose last member leaves stops listening to the room
+	b.hub.Unregister(bob)
+	require.NoError(t, a.node.Publish(ctx, "room:room-1", map[string]int{"n": 4}))
+	assert.Equal(t, `{"n":4}`, receive(t, alice))
+
+	a.hub.Unsubscribe(alice, "room-1")
+	assert.Eventually(t, func() bool { return !bus.Subscribed("room:room-1") }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,68 @@
+package grpc
+
+import (
+	"context"
+	"log"
+
+	"chat-app/internal/models"
+	"chat-app/internal/rooms"
+	pb "chat-app/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CreateDM finds or creates the conversation with a set of users
+func (s *ChatServer) CreateDM(ctx context.Context, req *pb.CreateDMRequest) (*pb.DirectMessage, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	dm, _, err := s.rooms.FindOrCreateDM(ctx, caller.UserID, req.UserIds)
+	if err != nil {
+		switch err {
+		case rooms.ErrTooFewParticipants, rooms.ErrTooManyParticipants:
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case rooms.ErrUserNotFound, rooms.ErrNotMember:
+			return nil, status.Error(codes.NotFound, err.Error())
+		default:
+			log.Printf("Error opening DM: %v", err)
+			return nil, status.Error(codes.Internal, "Failed to open conversation")
+		}
+	}
+
+	return toPBDirectMessage(dm), nil
+}
+
+// ListDMs lists the caller's conversations, most recently active first
+func (s *ChatServer) ListDMs(ctx context.Context, req *pb.ListDMsRequest) (*pb.ListDMsResponse, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	dms, err := s.rooms.ListDMs(ctx, caller.UserID)
+	if err != nil {
+		log.Printf("Error listing DMs: %v", err)
+		return nil, status.Error(codes.Internal, "Failed to retrieve conversations")
+	}
+
+	resp := &pb.ListDMsResponse{}
+	for i := range dms {
+		resp.Dms = append(resp.Dms, toPBDirectMessage(&dms[i]))
+	}
+	return resp, nil
+}
+
+func toPBDirectMessage(dm *models.DirectMessage) *pb.DirectMessage {
+	pbDM := &pb.DirectMessage{
+		Id:             dm.ID,
+		CreatedAt:      dm.CreatedAt.Unix(),
+		LastActivityAt: dm.LastActivityAt.Unix(),
+	}
+	for _, participant := range dm.Participants {
+		pbDM.Participants = append(pbDM.Participants, toPBMember(participant))
+	}
+	return pbDM
+}
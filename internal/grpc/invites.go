@@ -0,0 +1,125 @@
+package grpc
+
+import (
+	"context"
+	"log"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/invites"
+	"chat-app/internal/models"
+	pb "chat-app/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// InviteUser invites a user to a room
+func (s *ChatServer) InviteUser(ctx context.Context, req *pb.InviteUserRequest) (*pb.Invitation, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	invitation, err := s.invites.InviteUser(ctx, req.RoomId, caller.UserID, req.UserId)
+	if err != nil {
+		return nil, inviteStatus(err, "Failed to invite user")
+	}
+
+	return toPBInvitation(invitation), nil
+}
+
+// ListInvitations lists the caller's pending invitations
+func (s *ChatServer) ListInvitations(ctx context.Context, req *pb.ListInvitationsRequest) (*pb.ListInvitationsResponse, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	invitations, err := s.invites.ListInvitations(ctx, caller.UserID)
+	if err != nil {
+		return nil, inviteStatus(err, "Failed to retrieve invitations")
+	}
+
+	resp := &pb.ListInvitationsResponse{}
+	for i := range invitations {
+		resp.Invitations = append(resp.Invitations, toPBInvitation(&invitations[i]))
+	}
+	return resp, nil
+}
+
+// AcceptInvitation accepts an invitation and joins its room
+func (s *ChatServer) AcceptInvitation(ctx context.Context, req *pb.InvitationRequest) (*pb.Invitation, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	invitation, err := s.invites.AcceptInvitation(ctx, req.InvitationId, caller.UserID)
+	if err != nil {
+		return nil, inviteStatus(err, "Failed to accept invitation")
+	}
+
+	return toPBInvitation(invitation), nil
+}
+
+// DeclineInvitation declines an invitation
+func (s *ChatServer) DeclineInvitation(ctx context.Context, req *pb.InvitationRequest) (*pb.Invitation, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	invitation, err := s.invites.DeclineInvitation(ctx, req.InvitationId, caller.UserID)
+	if err != nil {
+		return nil, inviteStatus(err, "Failed to decline invitation")
+	}
+
+	return toPBInvitation(invitation), nil
+}
+
+// JoinWithInviteCode redeems a shareable invite code
+func (s *ChatServer) JoinWithInviteCode(ctx context.Context, req *pb.InviteCodeRequest) (*pb.RoomResponse, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	roomID, err := s.invites.JoinWithCode(ctx, req.Code, caller.UserID)
+	if err != nil {
+		return nil, inviteStatus(err, "Failed to join room")
+	}
+
+	return &pb.RoomResponse{
+		Success: true,
+		RoomId:  roomID,
+	}, nil
+}
+
+func toPBInvitation(invitation *models.Invitation) *pb.Invitation {
+	return &pb.Invitation{
+		Id:              invitation.ID,
+		RoomId:          invitation.RoomID,
+		RoomName:        invitation.RoomName,
+		InviterId:       invitation.InviterID,
+		InviterUsername: invitation.InviterUsername,
+		InviteeId:       invitation.InviteeID,
+		Status:          invitation.Status,
+		CreatedAt:       invitation.CreatedAt.Unix(),
+	}
+}
+
+func inviteStatus(err error, fallback string) error {
+	switch err {
+	case authz.ErrRoomNotFound, invites.ErrUserNotFound, invites.ErrInvitationNotFound, invites.ErrLinkNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case authz.ErrForbidden, authz.ErrBanned, authz.ErrNotPermitted, authz.ErrArchived:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case invites.ErrAlreadyMember:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case invites.ErrLinkExpired, invites.ErrLinkExhausted:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		log.Printf("%s: %v", fallback, err)
+		return status.Error(codes.Internal, fallback)
+	}
+}
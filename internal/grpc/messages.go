@@ -0,0 +1,213 @@
+package grpc
+
+import (
+	"context"
+	"log"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/chat"
+	"chat-app/internal/messages"
+	"chat-app/internal/models"
+	pb "chat-app/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// EditMessage changes the content of one of the caller's messages
+func (s *ChatServer) EditMessage(ctx context.Context, req *pb.EditMessageRequest) (*pb.Message, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := s.chat.Edit(ctx, chat.Edit{
+		RoomID:    req.RoomId,
+		MessageID: req.MessageId,
+		UserID:    caller.UserID,
+		Content:   req.Content,
+	})
+	if err != nil {
+		return nil, messageStatus(err, "Failed to edit message")
+	}
+
+	return toPBMessage(message), nil
+}
+
+// DeleteMessage deletes a message, leaving a tombstone in the history.
+// Admins may set purge to remove it entirely.
+func (s *ChatServer) DeleteMessage(ctx context.Context, req *pb.DeleteMessageRequest) (*pb.MessageResponse, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.chat.Delete(ctx, chat.Delete{
+		RoomID:    req.RoomId,
+		MessageID: req.MessageId,
+		UserID:    caller.UserID,
+		Purge:     req.Purge,
+	})
+	if err != nil {
+		st := messageStatus(err, "Failed to delete message")
+		return &pb.MessageResponse{Success: false, Error: status.Convert(st).Message()}, st
+	}
+
+	return &pb.MessageResponse{Success: true, MessageId: req.MessageId}, nil
+}
+
+// GetThread returns a thread root and its replies, oldest first
+func (s *ChatServer) GetThread(ctx context.Context, req *pb.ThreadRequest) (*pb.ThreadResponse, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	root, replies, err := s.messages.Thread(ctx, req.RoomId, req.MessageId, caller.UserID)
+	if err != nil {
+		return nil, messageStatus(err, "Failed to get thread")
+	}
+
+	response := &pb.ThreadResponse{Root: toPBMessage(root)}
+	for i := range replies {
+		response.Replies = append(response.Replies, toPBMessage(&replies[i]))
+	}
+	return response, nil
+}
+
+// MarkRead moves the caller's read cursor in a room forward
+func (s *ChatServer) MarkRead(ctx context.Context, req *pb.MarkReadRequest) (*pb.ReadCursor, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := s.messages.MarkRead(ctx, req.RoomId, req.MessageId, caller.UserID)
+	if err != nil {
+		return nil, messageStatus(err, "Failed to mark room read")
+	}
+
+	pbCursor := &pb.ReadCursor{RoomId: cursor.RoomID, UserId: cursor.UserID}
+	if cursor.LastReadID != nil {
+		pbCursor.LastReadId = *cursor.LastReadID
+	}
+	if cursor.LastReadAt != nil {
+		pbCursor.LastReadAt = cursor.LastReadAt.Unix()
+	}
+	return pbCursor, nil
+}
+
+// AddReaction reacts to a message with an emoji
+func (s *ChatServer) AddReaction(ctx context.Context, req *pb.ReactionRequest) (*pb.ReactionResponse, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := s.messages.AddReaction(ctx, req.RoomId, req.MessageId, caller.UserID, req.Emoji)
+	return reactionResponse(req, count, err, "Failed to add reaction")
+}
+
+// RemoveReaction removes one of the caller's reactions
+func (s *ChatServer) RemoveReaction(ctx context.Context, req *pb.ReactionRequest) (*pb.ReactionResponse, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := s.messages.RemoveReaction(ctx, req.RoomId, req.MessageId, caller.UserID, req.Emoji)
+	return reactionResponse(req, count, err, "Failed to remove reaction")
+}
+
+// ListReactions lists who reacted to a message
+func (s *ChatServer) ListReactions(ctx context.Context, req *pb.ReactionRequest) (*pb.ListReactionsResponse, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	reactions, err := s.messages.ListReactions(ctx, req.RoomId, req.MessageId, caller.UserID)
+	if err != nil {
+		return nil, messageStatus(err, "Failed to list reactions")
+	}
+
+	response := &pb.ListReactionsResponse{}
+	for _, reaction := range reactions {
+		response.Reactions = append(response.Reactions, &pb.Reaction{
+			MessageId: reaction.MessageID,
+			UserId:    reaction.UserID,
+			Username:  reaction.Username,
+			Emoji:     reaction.Emoji,
+			CreatedAt: reaction.CreatedAt.Unix(),
+		})
+	}
+	return response, nil
+}
+
+func reactionResponse(req *pb.ReactionRequest, count int, err error, fallback string) (*pb.ReactionResponse, error) {
+	if err != nil {
+		st := messageStatus(err, fallback)
+		return &pb.ReactionResponse{Success: false, Error: status.Convert(st).Message()}, st
+	}
+	return &pb.ReactionResponse{Success: true, MessageId: req.MessageId, Emoji: req.Emoji, Count: int32(count)}, nil
+}
+
+func toPBReactionCounts(counts []models.ReactionCount) []*pb.ReactionCount {
+	var pbCounts []*pb.ReactionCount
+	for _, count := range counts {
+		pbCounts = append(pbCounts, &pb.ReactionCount{Emoji: count.Emoji, Count: int32(count.Count), Me: count.Me})
+	}
+	return pbCounts
+}
+
+func toPBMessage(message *models.Message) *pb.Message {
+	pbMessage := &pb.Message{
+		Id:          message.ID,
+		UserId:      message.UserID,
+		Username:    message.Username,
+		RoomId:      message.RoomID,
+		Content:     message.Content,
+		MessageType: message.MessageType,
+		Timestamp:   message.Timestamp.Unix(),
+		Metadata:    message.Metadata,
+		Reactions:   toPBReactionCounts(message.Reactions),
+		ClientMsgId: message.ClientMsgID,
+		Seq:         message.Seq,
+	}
+	if message.EditedAt != nil {
+		pbMessage.EditedAt = message.EditedAt.Unix()
+	}
+	if message.DeletedAt != nil {
+		pbMessage.DeletedAt = message.DeletedAt.Unix()
+	}
+	if message.DeletedBy != nil {
+		pbMessage.DeletedBy = *message.DeletedBy
+	}
+	if message.ParentID != nil {
+		pbMessage.ParentId = *message.ParentID
+	}
+	if message.ThreadRootID != nil {
+		pbMessage.ThreadRootId = *message.ThreadRootID
+	}
+	if message.LastReplyAt != nil {
+		pbMessage.ReplyCount = int32(message.ReplyCount)
+		pbMessage.LastReplyAt = message.LastReplyAt.Unix()
+	}
+	return pbMessage
+}
+
+func messageStatus(err error, fallback string) error {
+	switch err {
+	case authz.ErrRoomNotFound, messages.ErrMessageNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case authz.ErrForbidden, authz.ErrBanned, authz.ErrMuted, authz.ErrNotPermitted, authz.ErrArchived, messages.ErrNotAuthor, messages.ErrCannotDelete:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case messages.ErrEditWindowExpired, messages.ErrMessageDeleted:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case messages.ErrEmptyContent, messages.ErrInvalidEmoji, messages.ErrInvalidClientMsgID:
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		log.Printf("%s: %v", fallback, err)
+		return status.Error(codes.Internal, fallback)
+	}
+}
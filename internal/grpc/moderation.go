@@ -0,0 +1,116 @@
+package grpc
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/models"
+	"chat-app/internal/moderation"
+	pb "chat-app/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ListMembers lists the members of a room with their roles
+func (s *ChatServer) ListMembers(ctx context.Context, req *pb.RoomRequest) (*pb.ListMembersResponse, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := s.moderation.ListMembers(ctx, req.RoomId, caller.UserID)
+	if err != nil {
+		return nil, moderationStatus(err, "Failed to retrieve members")
+	}
+
+	resp := &pb.ListMembersResponse{}
+	for _, member := range members {
+		resp.Members = append(resp.Members, toPBMember(member))
+	}
+	return resp, nil
+}
+
+// SetMemberRole changes a member's role
+func (s *ChatServer) SetMemberRole(ctx context.Context, req *pb.ModerationRequest) (*pb.ModerationResponse, error) {
+	return s.moderate(ctx, "Failed to change role", func(actorID string) error {
+		return s.moderation.SetRole(ctx, req.RoomId, actorID, req.UserId, req.Role)
+	})
+}
+
+// KickMember removes a member from a room
+func (s *ChatServer) KickMember(ctx context.Context, req *pb.ModerationRequest) (*pb.ModerationResponse, error) {
+	return s.moderate(ctx, "Failed to kick member", func(actorID string) error {
+		return s.moderation.Kick(ctx, req.RoomId, actorID, req.UserId)
+	})
+}
+
+// BanMember bans a user from a room
+func (s *ChatServer) BanMember(ctx context.Context, req *pb.ModerationRequest) (*pb.ModerationResponse, error) {
+	return s.moderate(ctx, "Failed to ban user", func(actorID string) error {
+		return s.moderation.Ban(ctx, req.RoomId, actorID, req.UserId,
+			time.Duration(req.DurationSeconds)*time.Second, req.Reason)
+	})
+}
+
+// UnbanMember lifts a ban
+func (s *ChatServer) UnbanMember(ctx context.Context, req *pb.ModerationRequest) (*pb.ModerationResponse, error) {
+	return s.moderate(ctx, "Failed to unban user", func(actorID string) error {
+		return s.moderation.Unban(ctx, req.RoomId, actorID, req.UserId)
+	})
+}
+
+// MuteMember stops a user from posting in a room
+func (s *ChatServer) MuteMember(ctx context.Context, req *pb.ModerationRequest) (*pb.ModerationResponse, error) {
+	return s.moderate(ctx, "Failed to mute user", func(actorID string) error {
+		return s.moderation.Mute(ctx, req.RoomId, actorID, req.UserId,
+			time.Duration(req.DurationSeconds)*time.Second)
+	})
+}
+
+// UnmuteMember lifts a mute
+func (s *ChatServer) UnmuteMember(ctx context.Context, req *pb.ModerationRequest) (*pb.ModerationResponse, error) {
+	return s.moderate(ctx, "Failed to unmute user", func(actorID string) error {
+		return s.moderation.Unmute(ctx, req.RoomId, actorID, req.UserId)
+	})
+}
+
+// moderate runs a moderation action as the authenticated caller
+func (s *ChatServer) moderate(ctx context.Context, fallback string, action func(actorID string) error) (*pb.ModerationResponse, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := action(caller.UserID); err != nil {
+		st := moderationStatus(err, fallback)
+		return &pb.ModerationResponse{Success: false, Error: status.Convert(st).Message()}, st
+	}
+
+	return &pb.ModerationResponse{Success: true}, nil
+}
+
+func toPBMember(member models.RoomMember) *pb.Member {
+	return &pb.Member{
+		UserId:   member.UserID,
+		Username: member.Username,
+		Role:     member.Role,
+		JoinedAt: member.JoinedAt.Unix(),
+	}
+}
+
+func moderationStatus(err error, fallback string) error {
+	switch err {
+	case authz.ErrRoomNotFound, moderation.ErrNotMember:
+		return status.Error(codes.NotFound, err.Error())
+	case authz.ErrForbidden, authz.ErrBanned, authz.ErrNotPermitted, authz.ErrArchived, moderation.ErrCannotTarget, moderation.ErrCannotPromote:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case moderation.ErrInvalidRole:
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		log.Printf("%s: %v", fallback, err)
+		return status.Error(codes.Internal, fallback)
+	}
+}
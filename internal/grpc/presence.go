@@ -0,0 +1,48 @@
+package grpc
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"chat-app/internal/models"
+	"chat-app/internal/presence"
+	pb "chat-app/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SetPresence sets the caller away or back online. Streams go idle without
+// activity, so clients that only stream should call it as a heartbeat.
+func (s *ChatServer) SetPresence(ctx context.Context, req *pb.SetPresenceRequest) (*pb.User, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	switch err := s.presence.SetStatus(ctx, caller.UserID, req.Status); err {
+	case nil:
+	case presence.ErrInvalidStatus:
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	default:
+		log.Printf("Error setting presence of %s: %v", caller.UserID, err)
+		return nil, status.Error(codes.Internal, "Failed to set presence")
+	}
+
+	return &pb.User{
+		Id:       caller.UserID,
+		Username: caller.Username,
+		Status:   req.Status,
+		LastSeen: time.Now().Unix(),
+	}, nil
+}
+
+func toPBUser(user models.User) *pb.User {
+	return &pb.User{
+		Id:       user.ID,
+		Username: user.Username,
+		Status:   user.Status,
+		LastSeen: user.LastSeen.Unix(),
+	}
+}
@@ -0,0 +1,134 @@
+package grpc
+
+import (
+	"context"
+	"log"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/models"
+	"chat-app/internal/rooms"
+	pb "chat-app/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GetRoom gets a single room
+func (s *ChatServer) GetRoom(ctx context.Context, req *pb.RoomRequest) (*pb.Room, error) {
+	caller, err := callerIdentity(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.rooms.Get(ctx, req.RoomId, caller.UserID)
+	if err != nil {
+		return nil, roomStatus(err, "Failed to get room")
+	}
+	return toPBRoom(room), nil
+}
+
+// UpdateRoom changes a room's name, description or visibility
+func (s *ChatServer) UpdateRoom(ctx context.Context, req *pb.UpdateRoomRequest) (*pb.Room, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.rooms.Update(ctx, req.RoomId, caller.UserID, rooms.Update{
+		Name:        req.Name,
+		Description: req.Description,
+		IsPrivate:   req.IsPrivate,
+	})
+	if err != nil {
+		return nil, roomStatus(err, "Failed to update room")
+	}
+	return toPBRoom(room), nil
+}
+
+// DeleteRoom deletes a room
+func (s *ChatServer) DeleteRoom(ctx context.Context, req *pb.RoomRequest) (*pb.RoomResponse, error) {
+	caller, err := callerIdentity(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.rooms.Delete(ctx, req.RoomId, caller.UserID); err != nil {
+		st := roomStatus(err, "Failed to delete room")
+		return &pb.RoomResponse{Success: false, Error: status.Convert(st).Message()}, st
+	}
+	return &pb.RoomResponse{Success: true, RoomId: req.RoomId}, nil
+}
+
+// ArchiveRoom makes a room read-only
+func (s *ChatServer) ArchiveRoom(ctx context.Context, req *pb.RoomRequest) (*pb.Room, error) {
+	caller, err := callerIdentity(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.rooms.Archive(ctx, req.RoomId, caller.UserID)
+	if err != nil {
+		return nil, roomStatus(err, "Failed to archive room")
+	}
+	return toPBRoom(room), nil
+}
+
+// UnarchiveRoom makes an archived room writable again
+func (s *ChatServer) UnarchiveRoom(ctx context.Context, req *pb.RoomRequest) (*pb.Room, error) {
+	caller, err := callerIdentity(ctx, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.rooms.Unarchive(ctx, req.RoomId, caller.UserID)
+	if err != nil {
+		return nil, roomStatus(err, "Failed to unarchive room")
+	}
+	return toPBRoom(room), nil
+}
+
+// TransferOwnership hands a room over to another member
+func (s *ChatServer) TransferOwnership(ctx context.Context, req *pb.TransferOwnershipRequest) (*pb.Room, error) {
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := s.rooms.TransferOwnership(ctx, req.RoomId, caller.UserID, req.UserId)
+	if err != nil {
+		return nil, roomStatus(err, "Failed to transfer ownership")
+	}
+	return toPBRoom(room), nil
+}
+
+func toPBRoom(room *models.Room) *pb.Room {
+	pbRoom := &pb.Room{
+		Id:          room.ID,
+		Name:        room.Name,
+		Description: room.Description,
+		IsPrivate:   room.IsPrivate,
+		CreatedBy:   room.CreatedBy,
+		CreatedAt:   room.CreatedAt.Unix(),
+		UpdatedAt:   room.UpdatedAt.Unix(),
+	}
+	if room.ArchivedAt != nil {
+		pbRoom.ArchivedAt = room.ArchivedAt.Unix()
+	}
+	return pbRoom
+}
+
+func roomStatus(err error, fallback string) error {
+	switch err {
+	case authz.ErrRoomNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case authz.ErrForbidden, authz.ErrBanned, authz.ErrNotPermitted, authz.ErrArchived:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case rooms.ErrInvalidName, rooms.ErrNotMember, rooms.ErrAlreadyOwner:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case rooms.ErrNotArchived, rooms.ErrAlreadyArchived:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		log.Printf("%s: %v", fallback, err)
+		return status.Error(codes.Internal, fallback)
+	}
+}
@@ -8,9 +8,16 @@ import (
 	"net"
 	"time"
 
+	"chat-app/internal/auth"
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/chat"
 	"chat-app/internal/database"
-	"chat-app/internal/models"
-	"chat-app/internal/redis"
+	"chat-app/internal/invites"
+	"chat-app/internal/messages"
+	"chat-app/internal/moderation"
+	"chat-app/internal/presence"
+	"chat-app/internal/rooms"
 	pb "chat-app/proto"
 
 	"github.com/google/uuid"
@@ -21,80 +28,92 @@ import (
 
 type ChatServer struct {
 	pb.UnimplementedChatServiceServer
-	db    *database.DB
-	redis *redis.RedisClient
+	db         *database.DB
+	broker     broker.Broker
+	authz      *authz.Authorizer
+	invites    *invites.Service
+	moderation *moderation.Service
+	rooms      *rooms.Service
+	messages   *messages.Service
+	presence   *presence.Service
+	chat       *chat.Service
 }
 
 // NewChatServer creates a new chat server
-func NewChatServer(db *database.DB, redis *redis.RedisClient) *ChatServer {
+func NewChatServer(db *database.DB, broker broker.Broker, authorizer *authz.Authorizer, inviteService *invites.Service, moderationService *moderation.Service, roomService *rooms.Service, messageService *messages.Service, presenceService *presence.Service, chatService *chat.Service) *ChatServer {
 	return &ChatServer{
-		db:    db,
-		redis: redis,
+		db:         db,
+		broker:     broker,
+		authz:      authorizer,
+		invites:    inviteService,
+		moderation: moderationService,
+		rooms:      roomService,
+		messages:   messageService,
+		presence:   presenceService,
+		chat:       chatService,
 	}
 }
 
 // SendMessage handles sending a message
 func (s *ChatServer) SendMessage(ctx context.Context, msg *pb.Message) (*pb.MessageResponse, error) {
-	messageID := uuid.New().String()
-	timestamp := time.Now()
-
-	// Store message in database
-	query := `INSERT INTO messages (id, user_id, username, room_id, content, message_type, timestamp, metadata) 
-			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	
-	_, err := s.db.ExecContext(ctx, query, 
-		messageID, msg.UserId, msg.Username, msg.RoomId, 
-		msg.Content, msg.MessageType, timestamp, msg.Metadata)
-	
+	caller, err := callerIdentity(ctx, msg.UserId)
 	if err != nil {
-		log.Printf("Error storing message: %v", err)
-		return &pb.MessageResponse{
-			Success: false,
-			Error:   "Failed to store message",
-		}, status.Error(codes.Internal, "Failed to store message")
+		return nil, err
 	}
-
-	// Publish message to Redis for real-time delivery
-	messageData := map[string]interface{}{
-		"id":           messageID,
-		"user_id":      msg.UserId,
-		"username":     msg.Username,
-		"room_id":      msg.RoomId,
-		"content":      msg.Content,
-		"message_type": msg.MessageType,
-		"timestamp":    timestamp.Unix(),
-		"metadata":     msg.Metadata,
-	}
-
-	channel := fmt.Sprintf("room:%s", msg.RoomId)
-	if err := s.redis.Publish(ctx, channel, messageData); err != nil {
-		log.Printf("Error publishing message: %v", err)
+	msg.UserId = caller.UserID
+	msg.Username = caller.Username
+	s.presence.TouchUser(ctx, caller.UserID)
+
+	message, duplicate, err := s.chat.Send(ctx, chat.Send{
+		RoomID:      msg.RoomId,
+		UserID:      msg.UserId,
+		Username:    msg.Username,
+		Content:     msg.Content,
+		MessageType: msg.MessageType,
+		Metadata:    msg.Metadata,
+		ParentID:    msg.ParentId,
+		ClientMsgID: msg.ClientMsgId,
+	})
+	if err != nil {
+		st := messageStatus(err, "Failed to store message")
+		return &pb.MessageResponse{Success: false, Error: status.Convert(st).Message()}, st
 	}
 
 	return &pb.MessageResponse{
-		Success:   true,
-		MessageId: messageID,
+		Success:     true,
+		MessageId:   message.ID,
+		Timestamp:   message.Timestamp.Unix(),
+		ClientMsgId: message.ClientMsgID,
+		Duplicate:   duplicate,
+		Seq:         message.Seq,
 	}, nil
 }
 
 // GetMessageHistory retrieves message history for a room
 func (s *ChatServer) GetMessageHistory(ctx context.Context, req *pb.HistoryRequest) (*pb.HistoryResponse, error) {
-	query := `SELECT id, user_id, username, room_id, content, message_type, timestamp, metadata 
+	caller, err := callerIdentity(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorizeRoom(ctx, caller.UserID, req.RoomId, authz.PermRead); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, user_id, username, room_id, content, message_type, timestamp, metadata, edited_at, deleted_at, deleted_by, COALESCE(seq, 0)
 			  FROM messages 
-			  WHERE room_id = $1 
+			  WHERE room_id = $1 AND thread_root_id IS NULL
 			  ORDER BY timestamp DESC 
 			  LIMIT $2`
 
 	if req.BeforeTimestamp > 0 {
-		query = `SELECT id, user_id, username, room_id, content, message_type, timestamp, metadata 
+		query = `SELECT id, user_id, username, room_id, content, message_type, timestamp, metadata, edited_at, deleted_at, deleted_by, COALESCE(seq, 0)
 				 FROM messages 
-				 WHERE room_id = $1 AND timestamp < $2
+				 WHERE room_id = $1 AND thread_root_id IS NULL AND timestamp < $2
 				 ORDER BY timestamp DESC 
 				 LIMIT $3`
 	}
 
 	var rows *sql.Rows
-	var err error
 
 	if req.BeforeTimestamp > 0 {
 		rows, err = s.db.QueryContext(ctx, query, req.RoomId, time.Unix(req.BeforeTimestamp, 0), req.Limit)
@@ -112,10 +131,12 @@ func (s *ChatServer) GetMessageHistory(ctx context.Context, req *pb.HistoryReque
 	for rows.Next() {
 		var msg pb.Message
 		var timestamp time.Time
+		var editedAt, deletedAt sql.NullTime
+		var deletedBy sql.NullString
 		var metadataJSON []byte
 
 		err := rows.Scan(&msg.Id, &msg.UserId, &msg.Username, &msg.RoomId, 
-			&msg.Content, &msg.MessageType, &timestamp, &metadataJSON)
+			&msg.Content, &msg.MessageType, &timestamp, &metadataJSON, &editedAt, &deletedAt, &deletedBy, &msg.Seq)
 		
 		if err != nil {
 			log.Printf("Error scanning message: %v", err)
@@ -123,6 +144,13 @@ func (s *ChatServer) GetMessageHistory(ctx context.Context, req *pb.HistoryReque
 		}
 
 		msg.Timestamp = timestamp.Unix()
+		if editedAt.Valid {
+			msg.EditedAt = editedAt.Time.Unix()
+		}
+		if deletedAt.Valid {
+			msg.DeletedAt = deletedAt.Time.Unix()
+			msg.DeletedBy = deletedBy.String
+		}
 		// Parse metadata if needed
 		if len(metadataJSON) > 0 {
 			// Simple metadata parsing - in production, use proper JSON unmarshaling
@@ -132,6 +160,26 @@ func (s *ChatServer) GetMessageHistory(ctx context.Context, req *pb.HistoryReque
 		messages = append(messages, &msg)
 	}
 
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.Id
+	}
+	counts, err := s.messages.ReactionCounts(ctx, caller.UserID, ids)
+	if err != nil {
+		log.Printf("Error loading reactions for room %s: %v", req.RoomId, err)
+	}
+	summaries, err := s.messages.ThreadSummaries(ctx, ids)
+	if err != nil {
+		log.Printf("Error loading threads for room %s: %v", req.RoomId, err)
+	}
+	for _, msg := range messages {
+		msg.Reactions = toPBReactionCounts(counts[msg.Id])
+		if summary, ok := summaries[msg.Id]; ok {
+			msg.ReplyCount = int32(summary.ReplyCount)
+			msg.LastReplyAt = summary.LastReplyAt.Unix()
+		}
+	}
+
 	hasMore := len(messages) == int(req.Limit)
 
 	return &pb.HistoryResponse{
@@ -142,30 +190,16 @@ func (s *ChatServer) GetMessageHistory(ctx context.Context, req *pb.HistoryReque
 
 // JoinRoom handles joining a room
 func (s *ChatServer) JoinRoom(ctx context.Context, req *pb.RoomRequest) (*pb.RoomResponse, error) {
-	// Add user to room members
-	query := `INSERT INTO room_members (room_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
-	_, err := s.db.ExecContext(ctx, query, req.RoomId, req.UserId)
-	
+	caller, err := callerIdentity(ctx, req.UserId)
 	if err != nil {
-		log.Printf("Error joining room: %v", err)
-		return &pb.RoomResponse{
-			Success: false,
-			Error:   "Failed to join room",
-		}, status.Error(codes.Internal, "Failed to join room")
+		return nil, err
 	}
+	req.UserId = caller.UserID
 
-	// Update user status to online
-	updateQuery := `UPDATE users SET status = 'online', last_seen = NOW() WHERE id = $1`
-	_, err = s.db.ExecContext(ctx, updateQuery, req.UserId)
-	
+	err = s.chat.Join(ctx, chat.Join{RoomID: req.RoomId, UserID: req.UserId, Username: caller.Username})
 	if err != nil {
-		log.Printf("Error updating user status: %v", err)
-	}
-
-	// Add user to Redis set for online users in this room
-	roomKey := fmt.Sprintf("room:%s:users", req.RoomId)
-	if err := s.redis.SAdd(ctx, roomKey, req.UserId); err != nil {
-		log.Printf("Error adding user to Redis: %v", err)
+		st := messageStatus(err, "Failed to join room")
+		return &pb.RoomResponse{Success: false, Error: status.Convert(st).Message()}, st
 	}
 
 	return &pb.RoomResponse{
@@ -175,22 +209,16 @@ func (s *ChatServer) JoinRoom(ctx context.Context, req *pb.RoomRequest) (*pb.Roo
 
 // LeaveRoom handles leaving a room
 func (s *ChatServer) LeaveRoom(ctx context.Context, req *pb.RoomRequest) (*pb.RoomResponse, error) {
-	// Remove user from room members
-	query := `DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`
-	_, err := s.db.ExecContext(ctx, query, req.RoomId, req.UserId)
-	
+	caller, err := callerIdentity(ctx, req.UserId)
 	if err != nil {
-		log.Printf("Error leaving room: %v", err)
-		return &pb.RoomResponse{
-			Success: false,
-			Error:   "Failed to leave room",
-		}, status.Error(codes.Internal, "Failed to leave room")
+		return nil, err
 	}
+	req.UserId = caller.UserID
 
-	// Remove user from Redis set
-	roomKey := fmt.Sprintf("room:%s:users", req.RoomId)
-	if err := s.redis.SRem(ctx, roomKey, req.UserId); err != nil {
-		log.Printf("Error removing user from Redis: %v", err)
+	err = s.chat.Leave(ctx, chat.Leave{RoomID: req.RoomId, UserID: req.UserId, Username: caller.Username})
+	if err != nil {
+		st := messageStatus(err, "Failed to leave room")
+		return &pb.RoomResponse{Success: false, Error: status.Convert(st).Message()}, st
 	}
 
 	return &pb.RoomResponse{
@@ -198,88 +226,55 @@ func (s *ChatServer) LeaveRoom(ctx context.Context, req *pb.RoomRequest) (*pb.Ro
 	}, nil
 }
 
-// GetOnlineUsers retrieves online users in a room
+// GetOnlineUsers retrieves the members of a room who are online, away or
+// idle
 func (s *ChatServer) GetOnlineUsers(ctx context.Context, req *pb.OnlineUsersRequest) (*pb.OnlineUsersResponse, error) {
-	// Get online users from Redis first
-	roomKey := fmt.Sprintf("room:%s:users", req.RoomId)
-	userIDs, err := s.redis.SMembers(ctx, roomKey)
-	
+	caller, err := callerIdentity(ctx, "")
 	if err != nil {
-		log.Printf("Error getting online users from Redis: %v", err)
-		// Fallback to database
-		return s.getOnlineUsersFromDB(ctx, req.RoomId)
+		return nil, err
 	}
-
-	if len(userIDs) == 0 {
-		return &pb.OnlineUsersResponse{Users: []*pb.User{}}, nil
+	if err := s.authorizeRoom(ctx, caller.UserID, req.RoomId, authz.PermRead); err != nil {
+		return nil, err
 	}
 
-	// Get user details from database
-	query := `SELECT id, username, status, last_seen FROM users WHERE id = ANY($1)`
-	rows, err := s.db.QueryContext(ctx, query, userIDs)
-	
+	online, err := s.presence.Online(ctx, req.RoomId, caller.UserID)
 	if err != nil {
-		log.Printf("Error querying users: %v", err)
+		log.Printf("Error getting online users: %v", err)
 		return nil, status.Error(codes.Internal, "Failed to retrieve users")
 	}
-	defer rows.Close()
 
-	var users []*pb.User
-	for rows.Next() {
-		var user pb.User
-		var lastSeen time.Time
-		
-		err := rows.Scan(&user.Id, &user.Username, &user.Status, &lastSeen)
-		if err != nil {
-			log.Printf("Error scanning user: %v", err)
-			continue
-		}
-		
-		user.LastSeen = lastSeen.Unix()
-		users = append(users, &user)
+	users := make([]*pb.User, 0, len(online))
+	for _, user := range online {
+		users = append(users, toPBUser(user))
 	}
-
 	return &pb.OnlineUsersResponse{Users: users}, nil
 }
 
-// getOnlineUsersFromDB fallback method to get online users from database
-func (s *ChatServer) getOnlineUsersFromDB(ctx context.Context, roomID string) (*pb.OnlineUsersResponse, error) {
-	query := `SELECT u.id, u.username, u.status, u.last_seen 
-			  FROM users u 
-			  JOIN room_members rm ON u.id = rm.user_id 
-			  WHERE rm.room_id = $1 AND u.status = 'online'`
-	
-	rows, err := s.db.QueryContext(ctx, query, roomID)
+// StreamMessages streams messages for real-time updates. With since_seq
+// set, messages sent after it are replayed first.
+func (s *ChatServer) StreamMessages(req *pb.StreamRequest, stream pb.ChatService_StreamMessagesServer) error {
+	ctx := stream.Context()
+	caller, err := callerIdentity(ctx, req.UserId)
 	if err != nil {
-		return nil, status.Error(codes.Internal, "Failed to retrieve users")
+		return err
 	}
-	defer rows.Close()
-
-	var users []*pb.User
-	for rows.Next() {
-		var user pb.User
-		var lastSeen time.Time
-		
-		err := rows.Scan(&user.Id, &user.Username, &user.Status, &lastSeen)
-		if err != nil {
-			continue
-		}
-		
-		user.LastSeen = lastSeen.Unix()
-		users = append(users, &user)
+	if err := s.authorizeRoom(ctx, caller.UserID, req.RoomId, authz.PermRead); err != nil {
+		return err
 	}
 
-	return &pb.OnlineUsersResponse{Users: users}, nil
-}
+	// The caller is present while the stream is open
+	presenceID := s.presence.Connect(ctx, caller.UserID)
+	defer s.presence.Disconnect(context.Background(), presenceID)
 
-// StreamMessages streams messages for real-time updates
-func (s *ChatServer) StreamMessages(req *pb.StreamRequest, stream pb.ChatService_StreamMessagesServer) error {
-	ctx := stream.Context()
 	channel := fmt.Sprintf("room:%s", req.RoomId)
 
-	// Subscribe to Redis channel
-	pubsub := s.redis.Subscribe(ctx, channel)
-	defer pubsub.Close()
+	// Subscribe to the room, and wait until the subscription is active so
+	// nothing published during a replay is missed
+	sub := s.broker.Subscribe(ctx, "")
+	defer sub.Close()
+	if err := sub.Add(ctx, channel); err != nil {
+		return status.Error(codes.Unavailable, "Failed to subscribe to room")
+	}
 
 	// Send initial connection message
 	initialMsg := &pb.Message{
@@ -296,29 +291,70 @@ func (s *ChatServer) StreamMessages(req *pb.StreamRequest, stream pb.ChatService
 		return status.Error(codes.Internal, "Failed to send initial message")
 	}
 
+	// Replay what the caller missed; live copies of replayed messages are
+	// skipped below
+	lastSeq := req.SinceSeq
+	if req.SinceSeq > 0 {
+		missed, ok, err := s.messages.Since(ctx, req.RoomId, caller.UserID, req.SinceSeq)
+		if err != nil {
+			log.Printf("Error replaying room %s since %d: %v", req.RoomId, req.SinceSeq, err)
+		}
+		replayed := 0
+		for _, m := range missed {
+			var pbMsg *pb.Message
+			if m.Message != nil {
+				lastSeq = m.Message.Seq
+				if m.Message.DeletedAt != nil {
+					continue
+				}
+				pbMsg = toPBMessage(m.Message)
+			} else {
+				var parseErr error
+				if pbMsg, _, parseErr = toPBEvent(m.Event); parseErr != nil {
+					log.Printf("Error parsing missed event in room %s: %v", req.RoomId, parseErr)
+					continue
+				}
+			}
+			if err := stream.Send(pbMsg); err != nil {
+				return status.Error(codes.Internal, "Failed to send message")
+			}
+			replayed++
+		}
+		if err := stream.Send(resumedMessage(req.RoomId, req.SinceSeq, lastSeq, replayed, ok, err)); err != nil {
+			return status.Error(codes.Internal, "Failed to send message")
+		}
+	}
+
 	// Listen for messages
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		default:
-			msg, err := pubsub.ReceiveMessage(ctx)
+			msg, err := sub.Receive(ctx)
 			if err != nil {
-				log.Printf("Error receiving message: %v", err)
+				if ctx.Err() == nil {
+					log.Printf("Error receiving message: %v", err)
+					time.Sleep(time.Second)
+				}
 				continue
 			}
 
-			// Parse message and send to client
-			// In a real implementation, you'd parse the JSON message
-			// For now, we'll create a simple message
-			streamMsg := &pb.Message{
-				Id:          uuid.New().String(),
-				UserId:      "user",
-				Username:    "User",
-				RoomId:      req.RoomId,
-				Content:     msg.Payload,
-				MessageType: "text",
-				Timestamp:   time.Now().Unix(),
+			streamMsg, event, err := toPBEvent(msg.Payload)
+			if err != nil {
+				log.Printf("Error parsing room event: %v", err)
+				continue
+			}
+			if event.Type == "message" && event.Seq != 0 {
+				if event.Seq <= lastSeq {
+					continue
+				}
+				lastSeq = event.Seq
+			}
+
+			// Bans and kicks from private rooms take effect mid-stream
+			if err := s.authorizeRoom(ctx, caller.UserID, req.RoomId, authz.PermRead); err != nil {
+				return err
 			}
 
 			if err := stream.Send(streamMsg); err != nil {
@@ -329,14 +365,17 @@ func (s *ChatServer) StreamMessages(req *pb.StreamRequest, stream pb.ChatService
 }
 
 // StartGRPCServer starts the gRPC server
-func StartGRPCServer(db *database.DB, redis *redis.RedisClient, port string) error {
+func StartGRPCServer(db *database.DB, broker broker.Broker, authService *auth.Service, authorizer *authz.Authorizer, inviteService *invites.Service, moderationService *moderation.Service, roomService *rooms.Service, messageService *messages.Service, presenceService *presence.Service, chatService *chat.Service, port string) error {
 	lis, err := net.Listen("tcp", ":"+port)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
 
-	server := grpc.NewServer()
-	pb.RegisterChatServiceServer(server, NewChatServer(db, redis))
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryAuthInterceptor(authService)),
+		grpc.StreamInterceptor(StreamAuthInterceptor(authService)),
+	)
+	pb.RegisterChatServiceServer(server, NewChatServer(db, broker, authorizer, inviteService, moderationService, roomService, messageService, presenceService, chatService))
 
 	log.Printf("gRPC server listening on port %s", port)
 	return server.Serve(lis)
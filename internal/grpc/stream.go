@@ -0,0 +1,94 @@
+package grpc
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"chat-app/internal/fanout"
+	"chat-app/internal/messages"
+	"chat-app/internal/models"
+	pb "chat-app/proto"
+
+	"github.com/google/uuid"
+)
+
+// toPBEvent converts a room channel payload, enveloped or not, for
+// streaming. Chat messages keep their message type; other events use the
+// event type instead.
+func toPBEvent(payload []byte) (*pb.Message, *models.Event, error) {
+	data, _ := fanout.Open(payload)
+
+	var event models.Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, nil, err
+	}
+
+	messageType := event.Type
+	if event.Type == "message" {
+		messageType = event.MessageType
+		if messageType == "" {
+			messageType = "text"
+		}
+	}
+
+	id := event.MessageID
+	if id == "" {
+		id = uuid.New().String()
+	}
+
+	fields, _ := event.Metadata.(map[string]interface{})
+	metadata := make(map[string]string, len(fields))
+	for key, value := range fields {
+		switch v := value.(type) {
+		case string:
+			metadata[key] = v
+		default:
+			data, _ := json.Marshal(v)
+			metadata[key] = string(data)
+		}
+	}
+
+	return &pb.Message{
+		Id:           id,
+		UserId:       event.UserID,
+		Username:     event.Username,
+		RoomId:       event.RoomID,
+		Content:      event.Content,
+		MessageType:  messageType,
+		Timestamp:    event.Timestamp,
+		Metadata:     metadata,
+		ParentId:     event.ParentID,
+		ThreadRootId: event.ThreadRootID,
+		ClientMsgId:  event.ClientMsgID,
+		Seq:          event.Seq,
+	}, &event, nil
+}
+
+// resumedMessage tells a stream caller that the replay is over, or unless
+// ok that it should reload the history: it missed too much, or the replay
+// failed with err
+func resumedMessage(roomID string, sinceSeq, lastSeq int64, replayed int, ok bool, err error) *pb.Message {
+	message := &pb.Message{
+		Id:          uuid.New().String(),
+		UserId:      "system",
+		Username:    "System",
+		RoomId:      roomID,
+		MessageType: "resumed",
+		Timestamp:   time.Now().Unix(),
+		Seq:         lastSeq,
+		Metadata: map[string]string{
+			"since_seq": strconv.FormatInt(sinceSeq, 10),
+			"replayed":  strconv.Itoa(replayed),
+		},
+	}
+	if err != nil || !ok {
+		message.Content = "Too many messages or changes were missed; reload the history"
+		if err != nil {
+			message.Content = "Missed messages could not be replayed; reload the history"
+		}
+		message.Metadata["reset"] = "true"
+		message.Metadata["max_replay"] = strconv.Itoa(messages.MaxReplay)
+	}
+	return message
+}
@@ -0,0 +1,433 @@
+package invites
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+	"chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrAlreadyMember      = errors.New("user is already a member of this room")
+	ErrInvitationNotFound = errors.New("invitation not found")
+	ErrLinkNotFound       = errors.New("invite link not found")
+	ErrLinkExpired        = errors.New("invite link expired")
+	ErrLinkExhausted      = errors.New("invite link has no uses left")
+)
+
+// Service manages direct invitations and shareable invite links for rooms.
+// Accepting either adds a row to room_members, which is what grants access
+// to private rooms.
+type Service struct {
+	db     *database.DB
+	broker broker.Broker
+	authz  *authz.Authorizer
+}
+
+// NewService creates a new invitation service
+func NewService(db *database.DB, broker broker.Broker, authorizer *authz.Authorizer) *Service {
+	return &Service{
+		db:     db,
+		broker: broker,
+		authz:  authorizer,
+	}
+}
+
+// InviteUser invites a user to a room. Only room members may invite. The
+// invitee is notified over their WebSocket connections.
+func (s *Service) InviteUser(ctx context.Context, roomID, inviterID, inviteeID string) (*models.Invitation, error) {
+	if err := s.requireMember(ctx, inviterID, roomID); err != nil {
+		return nil, err
+	}
+
+	isMember, err := s.authz.IsMember(ctx, inviteeID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if isMember {
+		return nil, ErrAlreadyMember
+	}
+
+	if err := s.requireNotBanned(ctx, inviteeID, roomID); err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	if err := s.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, inviteeID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	// Re-inviting refreshes the pending invitation instead of duplicating it
+	invitationID := uuid.New().String()
+	query := `INSERT INTO room_invitations (id, room_id, inviter_id, invitee_id, status, created_at)
+			  VALUES ($1, $2, $3, $4, 'pending', NOW())
+			  ON CONFLICT (room_id, invitee_id) WHERE status = 'pending'
+			  DO UPDATE SET inviter_id = EXCLUDED.inviter_id, created_at = NOW()
+			  RETURNING id`
+	if err := s.db.QueryRowContext(ctx, query, invitationID, roomID, inviterID, inviteeID).Scan(&invitationID); err != nil {
+		return nil, fmt.Errorf("error creating invitation: %v", err)
+	}
+
+	invitation, err := s.getInvitation(ctx, invitationID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.notifyInvitee(ctx, invitation)
+	return invitation, nil
+}
+
+// ListInvitations returns the pending invitations addressed to a user
+func (s *Service) ListInvitations(ctx context.Context, userID string) ([]models.Invitation, error) {
+	query := invitationSelect + ` WHERE i.invitee_id = $1 AND i.status = 'pending' ORDER BY i.created_at DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []models.Invitation{}
+	for rows.Next() {
+		invitation, err := scanInvitation(rows)
+		if err != nil {
+			continue
+		}
+		invitations = append(invitations, *invitation)
+	}
+
+	return invitations, rows.Err()
+}
+
+// AcceptInvitation adds the invitee to the room
+func (s *Service) AcceptInvitation(ctx context.Context, invitationID, userID string) (*models.Invitation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	roomID, err := s.respond(ctx, tx, invitationID, userID, "accepted")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.requireNotBanned(ctx, userID, roomID); err != nil {
+		return nil, err
+	}
+
+	if err := addMember(ctx, tx, roomID, userID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.authz.Invalidate(ctx, roomID, userID)
+
+	return s.getInvitation(ctx, invitationID)
+}
+
+// DeclineInvitation marks an invitation as declined
+func (s *Service) DeclineInvitation(ctx context.Context, invitationID, userID string) (*models.Invitation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := s.respond(ctx, tx, invitationID, userID, "declined"); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.getInvitation(ctx, invitationID)
+}
+
+// CreateLink mints a shareable invite code. A zero expiresIn or maxUses
+// means the link never expires or has unlimited uses.
+func (s *Service) CreateLink(ctx context.Context, roomID, userID string, expiresIn time.Duration, maxUses int) (*models.InviteLink, error) {
+	if err := s.requireMember(ctx, userID, roomID); err != nil {
+		return nil, err
+	}
+
+	code, err := generateCode()
+	if err != nil {
+		return nil, err
+	}
+
+	link := &models.InviteLink{
+		Code:      code,
+		RoomID:    roomID,
+		CreatedBy: userID,
+		MaxUses:   maxUses,
+		CreatedAt: time.Now(),
+	}
+	if expiresIn > 0 {
+		expiresAt := link.CreatedAt.Add(expiresIn)
+		link.ExpiresAt = &expiresAt
+	}
+
+	query := `INSERT INTO room_invite_links (code, room_id, created_by, max_uses, uses, expires_at, created_at)
+			  VALUES ($1, $2, $3, $4, 0, $5, $6)`
+	_, err = s.db.ExecContext(ctx, query, link.Code, link.RoomID, link.CreatedBy, link.MaxUses, link.ExpiresAt, link.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("error creating invite link: %v", err)
+	}
+
+	return link, nil
+}
+
+// ListLinks returns the active invite links of a room
+func (s *Service) ListLinks(ctx context.Context, roomID, userID string) ([]models.InviteLink, error) {
+	if err := s.requireMember(ctx, userID, roomID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT code, room_id, created_by, max_uses, uses, expires_at, revoked_at, created_at
+			  FROM room_invite_links
+			  WHERE room_id = $1 AND revoked_at IS NULL
+			  ORDER BY created_at DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []models.InviteLink{}
+	for rows.Next() {
+		var link models.InviteLink
+		err := rows.Scan(&link.Code, &link.RoomID, &link.CreatedBy, &link.MaxUses, &link.Uses,
+			&link.ExpiresAt, &link.RevokedAt, &link.CreatedAt)
+		if err != nil {
+			continue
+		}
+		links = append(links, link)
+	}
+
+	return links, rows.Err()
+}
+
+// RevokeLink disables an invite code. Its creator may revoke it for as long
+// as they may invite, and room admins and the owner may revoke any link.
+func (s *Service) RevokeLink(ctx context.Context, roomID, code, userID string) error {
+	var createdBy string
+	query := `SELECT created_by FROM room_invite_links WHERE code = $1 AND room_id = $2 AND revoked_at IS NULL`
+	err := s.db.QueryRowContext(ctx, query, strings.ToUpper(code), roomID).Scan(&createdBy)
+	if err == sql.ErrNoRows {
+		return ErrLinkNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if createdBy == userID {
+		err = s.requireMember(ctx, userID, roomID)
+	} else {
+		err = s.authz.Authorize(ctx, userID, roomID, authz.PermEditRoom)
+	}
+	if err != nil {
+		return err
+	}
+
+	query = `UPDATE room_invite_links SET revoked_at = NOW() WHERE code = $1 AND revoked_at IS NULL`
+	result, err := s.db.ExecContext(ctx, query, strings.ToUpper(code))
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrLinkNotFound
+	}
+	return nil
+}
+
+// JoinWithCode redeems an invite code and returns the joined room ID
+func (s *Service) JoinWithCode(ctx context.Context, code, userID string) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var link models.InviteLink
+	query := `SELECT code, room_id, max_uses, uses, expires_at, revoked_at
+			  FROM room_invite_links
+			  WHERE code = $1
+			  FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, strings.ToUpper(code)).Scan(
+		&link.Code, &link.RoomID, &link.MaxUses, &link.Uses, &link.ExpiresAt, &link.RevokedAt)
+	if err == sql.ErrNoRows {
+		return "", ErrLinkNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if link.RevokedAt != nil {
+		return "", ErrLinkNotFound
+	}
+	if link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt) {
+		return "", ErrLinkExpired
+	}
+
+	membership, err := s.authz.Membership(ctx, userID, link.RoomID)
+	if err != nil {
+		return "", err
+	}
+	if membership.IsBanned() {
+		return "", authz.ErrBanned
+	}
+	if membership.IsMember {
+		return link.RoomID, nil
+	}
+
+	if link.MaxUses > 0 && link.Uses >= link.MaxUses {
+		return "", ErrLinkExhausted
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE room_invite_links SET uses = uses + 1 WHERE code = $1`, link.Code); err != nil {
+		return "", err
+	}
+
+	if err := addMember(ctx, tx, link.RoomID, userID); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	s.authz.Invalidate(ctx, link.RoomID, userID)
+
+	return link.RoomID, nil
+}
+
+// respond moves a pending invitation addressed to userID to a final status
+func (s *Service) respond(ctx context.Context, tx *sql.Tx, invitationID, userID, status string) (string, error) {
+	var roomID string
+	query := `UPDATE room_invitations SET status = $3, responded_at = NOW()
+			  WHERE id = $1 AND invitee_id = $2 AND status = 'pending'
+			  RETURNING room_id`
+
+	err := tx.QueryRowContext(ctx, query, invitationID, userID, status).Scan(&roomID)
+	if err == sql.ErrNoRows {
+		return "", ErrInvitationNotFound
+	}
+	return roomID, err
+}
+
+func (s *Service) requireMember(ctx context.Context, userID, roomID string) error {
+	if err := s.authz.Authorize(ctx, userID, roomID, authz.PermInvite); err != nil {
+		return err
+	}
+
+	isMember, err := s.authz.IsMember(ctx, userID, roomID)
+	if err != nil {
+		return err
+	}
+	if !isMember {
+		return authz.ErrForbidden
+	}
+	return nil
+}
+
+func (s *Service) requireNotBanned(ctx context.Context, userID, roomID string) error {
+	membership, err := s.authz.Membership(ctx, userID, roomID)
+	if err != nil {
+		return err
+	}
+	if membership.IsBanned() {
+		return authz.ErrBanned
+	}
+	return nil
+}
+
+func (s *Service) getInvitation(ctx context.Context, invitationID string) (*models.Invitation, error) {
+	row := s.db.QueryRowContext(ctx, invitationSelect+` WHERE i.id = $1`, invitationID)
+	invitation, err := scanInvitation(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvitationNotFound
+	}
+	return invitation, err
+}
+
+// notifyInvitee pushes an invitation event to the invitee's sockets on
+// every instance via their user channel
+func (s *Service) notifyInvitee(ctx context.Context, invitation *models.Invitation) {
+	event := map[string]interface{}{
+		"type":       "invitation",
+		"user_id":    invitation.InviterID,
+		"username":   invitation.InviterUsername,
+		"room_id":    invitation.RoomID,
+		"content":    fmt.Sprintf("%s invited you to %s", invitation.InviterUsername, invitation.RoomName),
+		"message_id": invitation.ID,
+		"timestamp":  invitation.CreatedAt.Unix(),
+		"metadata": map[string]interface{}{
+			"invitation_id": invitation.ID,
+			"room_name":     invitation.RoomName,
+		},
+	}
+
+	channel := fmt.Sprintf("user:%s", invitation.InviteeID)
+	if err := s.broker.Publish(ctx, channel, event); err != nil {
+		log.Printf("Error publishing invitation: %v", err)
+	}
+}
+
+const invitationSelect = `SELECT i.id, i.room_id, r.name, i.inviter_id, u.username, i.invitee_id,
+			  i.status, i.created_at, i.responded_at
+			  FROM room_invitations i
+			  JOIN rooms r ON r.id = i.room_id
+			  JOIN users u ON u.id = i.inviter_id`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInvitation(row scanner) (*models.Invitation, error) {
+	var invitation models.Invitation
+	err := row.Scan(&invitation.ID, &invitation.RoomID, &invitation.RoomName, &invitation.InviterID,
+		&invitation.InviterUsername, &invitation.InviteeID, &invitation.Status,
+		&invitation.CreatedAt, &invitation.RespondedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &invitation, nil
+}
+
+func addMember(ctx context.Context, tx *sql.Tx, roomID, userID string) error {
+	query := `INSERT INTO room_members (room_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	if _, err := tx.ExecContext(ctx, query, roomID, userID); err != nil {
+		return fmt.Errorf("error adding room member: %v", err)
+	}
+	return nil
+}
+
+// generateCode returns a short, URL-safe, case-insensitive invite code
+func generateCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf), nil
+}
@@ -0,0 +1,157 @@
+//go:build integration
+
+package invites
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+	"chat-app/internal/testdb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testService(t *testing.T) (*Service, *database.DB) {
+	db := testdb.DB(t)
+	client := testdb.Redis(t)
+	return NewService(db, broker.NewMemory(), authz.NewAuthorizer(db, client)), db
+}
+
+func uses(t *testing.T, db *database.DB, code string) int {
+	var n int
+	require.NoError(t, db.QueryRow(`SELECT uses FROM room_invite_links WHERE code = $1`, code).Scan(&n))
+	return n
+}
+
+func ban(t *testing.T, db *database.DB, roomID, userID, bannedBy string) {
+	_, err := db.Exec(`INSERT INTO room_bans (room_id, user_id, banned_by) VALUES ($1, $2, $3)`, roomID, userID, bannedBy)
+	require.NoError(t, err)
+}
+
+func TestCreateLinkRequiresMember(t *testing.T) {
+	ctx := context.Background()
+	s, db := testService(t)
+	owner, member := testdb.User(t, db), testdb.User(t, db)
+
+	// Non-members may not invite, even to public rooms they can read
+	for _, private := range []bool{true, false} {
+		room := testdb.Room(t, db, owner, private)
+		_, err := s.CreateLink(ctx, room, testdb.User(t, db), 0, 0)
+		assert.Equal(t, authz.ErrForbidden, err)
+	}
+
+	room := testdb.Room(t, db, owner, true)
+	testdb.Join(t, db, room, member, authz.RoleMember)
+	banned := testdb.User(t, db)
+	ban(t, db, room, banned, owner)
+	_, err := s.CreateLink(ctx, room, banned, 0, 0)
+	assert.Equal(t, authz.ErrBanned, err)
+
+	link, err := s.CreateLink(ctx, room, member, time.Hour, 0)
+	require.NoError(t, err)
+	assert.Equal(t, member, link.CreatedBy)
+	assert.NotNil(t, link.ExpiresAt)
+}
+
+func TestJoinWithExpiredLink(t *testing.T) {
+	ctx := context.Background()
+	s, db := testService(t)
+	owner := testdb.User(t, db)
+	room := testdb.Room(t, db, owner, true)
+
+	link, err := s.CreateLink(ctx, room, owner, time.Hour, 0)
+	require.NoError(t, err)
+	_, err = db.Exec(`UPDATE room_invite_links SET expires_at = NOW() - INTERVAL '1 minute' WHERE code = $1`, link.Code)
+	require.NoError(t, err)
+
+	guest := testdb.User(t, db)
+	_, err = s.JoinWithCode(ctx, link.Code, guest)
+	assert.Equal(t, ErrLinkExpired, err)
+	assert.Equal(t, 0, uses(t, db, link.Code))
+
+	isMember, err := s.authz.IsMember(ctx, guest, room)
+	require.NoError(t, err)
+	assert.False(t, isMember)
+}
+
+func TestJoinWithExhaustedLink(t *testing.T) {
+	ctx := context.Background()
+	s, db := testService(t)
+	owner := testdb.User(t, db)
+	room := testdb.Room(t, db, owner, true)
+
+	link, err := s.CreateLink(ctx, room, owner, 0, 1)
+	require.NoError(t, err)
+
+	// Codes are case-insensitive
+	first := testdb.User(t, db)
+	roomID, err := s.JoinWithCode(ctx, strings.ToLower(link.Code), first)
+	require.NoError(t, err)
+	assert.Equal(t, room, roomID)
+	assert.Equal(t, 1, uses(t, db, link.Code))
+
+	_, err = s.JoinWithCode(ctx, link.Code, testdb.User(t, db))
+	assert.Equal(t, ErrLinkExhausted, err)
+
+	// Members redeeming it again are let through without using it up
+	roomID, err = s.JoinWithCode(ctx, link.Code, first)
+	require.NoError(t, err)
+	assert.Equal(t, room, roomID)
+	assert.Equal(t, 1, uses(t, db, link.Code))
+}
+
+func TestJoinWithLinkWhileBanned(t *testing.T) {
+	ctx := context.Background()
+	s, db := testService(t)
+	owner, banned := testdb.User(t, db), testdb.User(t, db)
+	room := testdb.Room(t, db, owner, false)
+	ban(t, db, room, banned, owner)
+
+	link, err := s.CreateLink(ctx, room, owner, 0, 0)
+	require.NoError(t, err)
+
+	_, err = s.JoinWithCode(ctx, link.Code, banned)
+	assert.Equal(t, authz.ErrBanned, err)
+	assert.Equal(t, 0, uses(t, db, link.Code))
+
+	var isMember bool
+	query := `SELECT EXISTS(SELECT 1 FROM room_members WHERE room_id = $1 AND user_id = $2)`
+	require.NoError(t, db.QueryRow(query, room, banned).Scan(&isMember))
+	assert.False(t, isMember)
+}
+
+func TestRevokeLink(t *testing.T) {
+	ctx := context.Background()
+	s, db := testService(t)
+	owner, admin, member, other := testdb.User(t, db), testdb.User(t, db), testdb.User(t, db), testdb.User(t, db)
+	room := testdb.Room(t, db, owner, true)
+	testdb.Join(t, db, room, admin, authz.RoleAdmin)
+	testdb.Join(t, db, room, member, authz.RoleMember)
+	testdb.Join(t, db, room, other, authz.RoleMember)
+
+	// Members may revoke their own links only
+	link, err := s.CreateLink(ctx, room, member, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, authz.ErrNotPermitted, s.RevokeLink(ctx, room, link.Code, other))
+	require.NoError(t, s.RevokeLink(ctx, room, strings.ToLower(link.Code), member))
+	assert.Equal(t, ErrLinkNotFound, s.RevokeLink(ctx, room, link.Code, member))
+
+	// Admins may revoke anyone's, whoever created the room
+	link, err = s.CreateLink(ctx, room, owner, 0, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.RevokeLink(ctx, room, link.Code, admin))
+
+	// The room's creator needs a role that allows it like anyone else
+	link, err = s.CreateLink(ctx, room, admin, 0, 0)
+	require.NoError(t, err)
+	_, err = db.Exec(`UPDATE room_members SET role = 'member' WHERE room_id = $1 AND user_id = $2`, room, owner)
+	require.NoError(t, err)
+	s.authz.Invalidate(ctx, room, owner)
+	assert.Equal(t, authz.ErrNotPermitted, s.RevokeLink(ctx, room, link.Code, owner))
+}
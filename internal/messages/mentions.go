@@ -0,0 +1,258 @@
+package messages
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"chat-app/internal/models"
+
+	"github.com/lib/pq"
+)
+
+// Mention kinds, stored in message_mentions and sent as metadata["kind"]
+const (
+	MentionUser = "user" // @username
+	MentionHere = "here" // @here: members who are online
+	MentionRoom = "room" // @room: every member
+)
+
+// mentionPattern matches @name at the start of the content or after a
+// character that cannot be part of a name, so e-mail addresses don't match
+var mentionPattern = regexp.MustCompile(`(?:^|[^\pL\pN_.@-])@([\pL\pN_.-]+)`)
+
+// Mentions is what a message's content mentions
+type Mentions struct {
+	Usernames []string
+	Here      bool
+	Room      bool
+}
+
+// Empty reports whether nothing is mentioned
+func (m Mentions) Empty() bool {
+	return len(m.Usernames) == 0 && !m.Here && !m.Room
+}
+
+// ParseMentions finds @username, @here and @room in content. Usernames are
+// returned once each, in order of appearance.
+func ParseMentions(content string) Mentions {
+	var mentions Mentions
+	seen := map[string]bool{}
+
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		// A trailing dot ends the sentence rather than the name
+		name := strings.TrimRight(match[1], ".")
+		switch {
+		case name == "":
+		case name == MentionHere:
+			mentions.Here = true
+		case name == MentionRoom:
+			mentions.Room = true
+		case !seen[name]:
+			seen[name] = true
+			mentions.Usernames = append(mentions.Usernames, name)
+		}
+	}
+
+	return mentions
+}
+
+// RecordMentions stores the mentions in a new or edited message and sends
+// each newly mentioned user a mention event on their user channel, so it
+// reaches them whatever room they are in. The author is never mentioned.
+func (s *Service) RecordMentions(ctx context.Context, message *models.Message) {
+	mentions := ParseMentions(message.Content)
+	if mentions.Empty() {
+		return
+	}
+
+	targets, err := s.mentionTargets(ctx, message, mentions)
+	if err != nil {
+		log.Printf("Error resolving mentions in %s: %v", message.ID, err)
+		return
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	userIDs := make([]string, 0, len(targets))
+	kinds := make([]string, 0, len(targets))
+	for userID, kind := range targets {
+		userIDs = append(userIDs, userID)
+		kinds = append(kinds, kind)
+	}
+
+	// Edits may mention users again; only new rows are announced
+	query := `INSERT INTO message_mentions (message_id, user_id, room_id, kind, created_at)
+			  SELECT $1, t.user_id, $2, t.kind, NOW()
+			  FROM unnest($3::varchar[], $4::varchar[]) AS t(user_id, kind)
+			  ON CONFLICT (message_id, user_id) DO NOTHING
+			  RETURNING user_id, kind`
+
+	rows, err := s.db.QueryContext(ctx, query, message.ID, message.RoomID, pq.Array(userIDs), pq.Array(kinds))
+	if err != nil {
+		log.Printf("Error storing mentions in %s: %v", message.ID, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID, kind string
+		if err := rows.Scan(&userID, &kind); err != nil {
+			continue
+		}
+		s.notifyMention(ctx, message, userID, kind)
+	}
+}
+
+// mentionTargets resolves mentions to user IDs with the strongest kind each
+// user was mentioned by. Users who cannot read the room are dropped.
+func (s *Service) mentionTargets(ctx context.Context, message *models.Message, mentions Mentions) (map[string]string, error) {
+	targets := map[string]string{}
+
+	var groupQuery, groupKind string
+	switch {
+	case mentions.Room:
+		groupQuery = `SELECT user_id FROM room_members WHERE room_id = $1`
+		groupKind = MentionRoom
+	case mentions.Here:
+		groupQuery = `SELECT rm.user_id FROM room_members rm
+					  JOIN users u ON u.id = rm.user_id
+					  WHERE rm.room_id = $1 AND u.status = 'online'`
+		groupKind = MentionHere
+	}
+	if groupQuery != "" {
+		if err := s.collect(ctx, targets, groupKind, groupQuery, message.RoomID); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(mentions.Usernames) > 0 {
+		named := map[string]string{}
+		query := `SELECT id FROM users WHERE username = ANY($1)`
+		if err := s.collect(ctx, named, MentionUser, query, pq.Array(mentions.Usernames)); err != nil {
+			return nil, err
+		}
+		for userID := range named {
+			// Group mentions only reach members; named users may be
+			// readers of a public room
+			if err := s.authz.CanAccessRoom(ctx, userID, message.RoomID); err != nil {
+				continue
+			}
+			targets[userID] = MentionUser
+		}
+	}
+
+	delete(targets, message.UserID)
+	return targets, nil
+}
+
+func (s *Service) collect(ctx context.Context, targets map[string]string, kind, query string, args ...interface{}) error {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			continue
+		}
+		targets[userID] = kind
+	}
+	return rows.Err()
+}
+
+func (s *Service) notifyMention(ctx context.Context, message *models.Message, userID, kind string) {
+	event := map[string]interface{}{
+		"type":       "mention",
+		"user_id":    message.UserID,
+		"username":   message.Username,
+		"room_id":    message.RoomID,
+		"content":    message.Content,
+		"message_id": message.ID,
+		"timestamp":  message.Timestamp.Unix(),
+		"metadata": map[string]interface{}{
+			"kind":         kind,
+			"mentioned_id": userID,
+		},
+	}
+	if message.ThreadRootID != nil {
+		event["thread_root_id"] = *message.ThreadRootID
+	}
+
+	channel := fmt.Sprintf("user:%s", userID)
+	if err := s.broker.Publish(ctx, channel, event); err != nil {
+		log.Printf("Error publishing mention: %v", err)
+	}
+}
+
+// ListMentions returns the user's mentions, newest first, in rooms they can
+// still read. before pages backwards; unreadOnly skips read mentions.
+func (s *Service) ListMentions(ctx context.Context, userID string, unreadOnly bool, before time.Time, limit int) ([]models.Mention, error) {
+	if before.IsZero() {
+		before = time.Now()
+	}
+
+	query := `SELECT mm.kind, mm.read_at, mm.created_at, r.name,
+			  m.id, m.user_id, m.username, m.room_id, m.content, m.message_type, m.timestamp, m.edited_at, m.parent_id, m.thread_root_id
+			  FROM message_mentions mm
+			  JOIN messages m ON m.id = mm.message_id
+			  JOIN rooms r ON r.id = mm.room_id
+			  LEFT JOIN room_members rm ON rm.room_id = r.id AND rm.user_id = mm.user_id
+			  WHERE mm.user_id = $1 AND mm.created_at < $2
+			  AND m.deleted_at IS NULL
+			  AND (r.is_private = false OR rm.user_id IS NOT NULL)
+			  AND ($3 = false OR mm.read_at IS NULL)
+			  ORDER BY mm.created_at DESC
+			  LIMIT $4`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, before, unreadOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := []models.Mention{}
+	for rows.Next() {
+		var mention models.Mention
+		m := &mention.Message
+		if err := rows.Scan(&mention.Kind, &mention.ReadAt, &mention.CreatedAt, &mention.RoomName,
+			&m.ID, &m.UserID, &m.Username, &m.RoomID, &m.Content, &m.MessageType, &m.Timestamp, &m.EditedAt,
+			&m.ParentID, &m.ThreadRootID); err != nil {
+			continue
+		}
+		mention.Read = mention.ReadAt != nil
+		mentions = append(mentions, mention)
+	}
+
+	return mentions, rows.Err()
+}
+
+// UnreadMentions counts the user's unread mentions
+func (s *Service) UnreadMentions(ctx context.Context, userID string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM message_mentions mm
+			  JOIN messages m ON m.id = mm.message_id
+			  WHERE mm.user_id = $1 AND mm.read_at IS NULL AND m.deleted_at IS NULL`
+	err := s.db.QueryRowContext(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
+// MarkMentionsRead marks the given mentions read, or all of them if
+// messageIDs is empty, and returns how many changed
+func (s *Service) MarkMentionsRead(ctx context.Context, userID string, messageIDs []string) (int64, error) {
+	query := `UPDATE message_mentions SET read_at = NOW()
+			  WHERE user_id = $1 AND read_at IS NULL
+			  AND (COALESCE(cardinality($2::varchar[]), 0) = 0 OR message_id = ANY($2))`
+
+	result, err := s.db.ExecContext(ctx, query, userID, pq.Array(messageIDs))
+	if err != nil {
+		return 0, fmt.Errorf("error marking mentions read: %v", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,22 @@
+package messages
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMentions(t *testing.T) {
+	m := ParseMentions("@alice can you and @bob.smith look? thanks @alice.")
+	assert.Equal(t, []string{"alice", "bob.smith"}, m.Usernames)
+	assert.False(t, m.Here)
+	assert.False(t, m.Room)
+
+	m = ParseMentions("heads up @here, and (@room)")
+	assert.Empty(t, m.Usernames)
+	assert.True(t, m.Here)
+	assert.True(t, m.Room)
+
+	m = ParseMentions("mail alice@example.com or @ nobody")
+	assert.True(t, m.Empty())
+}
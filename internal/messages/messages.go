@@ -0,0 +1,404 @@
+package messages
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+	"chat-app/internal/models"
+	"chat-app/internal/outbox"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrMessageNotFound   = errors.New("message not found")
+	ErrNotAuthor         = errors.New("only the author can edit this message")
+	ErrEditWindowExpired = errors.New("message can no longer be edited")
+	ErrEmptyContent      = errors.New("message content is required")
+	ErrMessageDeleted    = errors.New("message has been deleted")
+	ErrCannotDelete      = errors.New("only the author or a moderator can delete this message")
+)
+
+// Service changes messages after they have been sent. Every change is
+// announced to the room so connected clients can update in place.
+type Service struct {
+	db     *database.DB
+	broker broker.Broker
+	outbox *outbox.Relay
+	authz  *authz.Authorizer
+
+	editWindow         time.Duration
+	receiptsMaxMembers int
+}
+
+// NewService creates a new message service. MESSAGE_EDIT_WINDOW sets how
+// long authors may edit their messages (default 15m, 0 = forever);
+// READ_RECEIPTS_MAX_MEMBERS is the largest room that gets read receipts
+// (default 100, 0 = never).
+func NewService(db *database.DB, broker broker.Broker, relay *outbox.Relay, authorizer *authz.Authorizer) *Service {
+	return &Service{
+		db:         db,
+		broker:     broker,
+		outbox:     relay,
+		authz:      authorizer,
+		editWindow: getDuration("MESSAGE_EDIT_WINDOW", 15*time.Minute),
+
+		receiptsMaxMembers: getInt("READ_RECEIPTS_MAX_MEMBERS", 100),
+	}
+}
+
+// Edit replaces the content of a message, keeping the previous content as a
+// revision. Only the author may edit, and only within the edit window.
+func (s *Service) Edit(ctx context.Context, roomID, messageID, userID, content string) (*models.Message, error) {
+	if strings.TrimSpace(content) == "" {
+		return nil, ErrEmptyContent
+	}
+	if err := s.authz.Authorize(ctx, userID, roomID, authz.PermPost); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	seq, err := lockRoom(ctx, tx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	var authorID, previous string
+	var sentAt time.Time
+	var deletedAt sql.NullTime
+	query := `SELECT user_id, content, timestamp, deleted_at FROM messages WHERE id = $1 AND room_id = $2 FOR UPDATE`
+	err = tx.QueryRowContext(ctx, query, messageID, roomID).Scan(&authorID, &previous, &sentAt, &deletedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if deletedAt.Valid {
+		return nil, ErrMessageDeleted
+	}
+	if authorID != userID {
+		return nil, ErrNotAuthor
+	}
+	if s.editWindow > 0 && time.Since(sentAt) > s.editWindow {
+		return nil, ErrEditWindowExpired
+	}
+
+	revisionQuery := `INSERT INTO message_revisions (id, message_id, content, edited_by, edited_at)
+					  VALUES ($1, $2, $3, $4, NOW())`
+	if _, err := tx.ExecContext(ctx, revisionQuery, uuid.New().String(), messageID, previous, userID); err != nil {
+		return nil, fmt.Errorf("error storing revision: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE messages SET content = $2, edited_at = NOW() WHERE id = $1`, messageID, content); err != nil {
+		return nil, fmt.Errorf("error editing message: %v", err)
+	}
+
+	message, err := get(ctx, tx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordChange(ctx, tx, roomID, seq, changeEvent("message_edited", message)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.outbox.Notify()
+
+	s.RecordMentions(ctx, message)
+	return message, nil
+}
+
+// Delete turns a message into a tombstone: its content, revisions and
+// reactions are removed but the row stays so history pagination is
+// unaffected. Authors may delete their own messages, moderators anyone's.
+// Messages of archived rooms cannot be deleted.
+func (s *Service) Delete(ctx context.Context, roomID, messageID, userID string) (*models.Message, error) {
+	if err := s.authorizeWritable(ctx, userID, roomID, authz.PermRead); err != nil {
+		return nil, err
+	}
+
+	message, err := s.Get(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.RoomID != roomID {
+		return nil, ErrMessageNotFound
+	}
+	if message.DeletedAt != nil {
+		return message, nil
+	}
+
+	if message.UserID != userID {
+		switch err := s.authz.Authorize(ctx, userID, roomID, authz.PermDeleteMessages); err {
+		case nil:
+		case authz.ErrNotPermitted:
+			return nil, ErrCannotDelete
+		default:
+			return nil, err
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	seq, err := lockRoom(ctx, tx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE messages SET content = '', metadata = NULL, deleted_at = NOW(), deleted_by = $2
+			  WHERE id = $1 AND deleted_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, messageID, userID); err != nil {
+		return nil, fmt.Errorf("error deleting message: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message_revisions WHERE message_id = $1`, messageID); err != nil {
+		return nil, fmt.Errorf("error deleting revisions: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM message_reactions WHERE message_id = $1`, messageID); err != nil {
+		return nil, fmt.Errorf("error deleting reactions: %v", err)
+	}
+
+	message, err = get(ctx, tx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordChange(ctx, tx, roomID, seq, changeEvent("message_deleted", message)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.outbox.Notify()
+
+	if message.ThreadRootID != nil {
+		s.Replied(ctx, roomID, *message.ThreadRootID)
+	}
+	return message, nil
+}
+
+// Purge removes a message and its revisions for good. Only room admins and
+// owners may purge, and not in archived rooms. Replies to a purged thread
+// root are kept, as ordinary messages of the room.
+func (s *Service) Purge(ctx context.Context, roomID, messageID, userID string) error {
+	if err := s.authorizeWritable(ctx, userID, roomID, authz.PermPurgeMessages); err != nil {
+		return err
+	}
+
+	message, err := s.Get(ctx, messageID)
+	if err != nil {
+		return err
+	}
+	if message.RoomID != roomID {
+		return ErrMessageNotFound
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	seq, err := lockRoom(ctx, tx, roomID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE id = $1`, messageID); err != nil {
+		return fmt.Errorf("error purging message: %v", err)
+	}
+
+	now := time.Now()
+	message.Content = ""
+	message.Metadata = nil
+	message.DeletedAt = &now
+	message.DeletedBy = &userID
+	if err := recordChange(ctx, tx, roomID, seq, changeEvent("message_deleted", message, "purged", true)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.outbox.Notify()
+
+	if message.ThreadRootID != nil {
+		s.Replied(ctx, roomID, *message.ThreadRootID)
+	}
+	return nil
+}
+
+// authorizeWritable is Authorize that also refuses changes to archived rooms
+func (s *Service) authorizeWritable(ctx context.Context, userID, roomID string, perm authz.Permission) error {
+	if err := s.authz.Authorize(ctx, userID, roomID, perm); err != nil {
+		return err
+	}
+
+	m, err := s.authz.Membership(ctx, userID, roomID)
+	if err != nil {
+		return err
+	}
+	if m.Archived {
+		return authz.ErrArchived
+	}
+	return nil
+}
+
+// Revisions lists the prior versions of a message, oldest first
+func (s *Service) Revisions(ctx context.Context, roomID, messageID, userID string) ([]models.MessageRevision, error) {
+	if err := s.authz.CanAccessRoom(ctx, userID, roomID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT mr.id, mr.message_id, mr.content, mr.edited_by, mr.edited_at
+			  FROM message_revisions mr
+			  JOIN messages m ON m.id = mr.message_id
+			  WHERE mr.message_id = $1 AND m.room_id = $2
+			  ORDER BY mr.edited_at`
+
+	rows, err := s.db.QueryContext(ctx, query, messageID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []models.MessageRevision{}
+	for rows.Next() {
+		var revision models.MessageRevision
+		if err := rows.Scan(&revision.ID, &revision.MessageID, &revision.Content, &revision.EditedBy, &revision.EditedAt); err != nil {
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, rows.Err()
+}
+
+// Sent runs the follow-ups of a newly stored message: a thread_updated
+// event for replies, mention notifications and the author's read cursor
+func (s *Service) Sent(ctx context.Context, messageID string) {
+	message, err := s.Get(ctx, messageID)
+	if err != nil {
+		log.Printf("Error loading sent message %s: %v", messageID, err)
+		return
+	}
+
+	if message.ThreadRootID != nil {
+		s.Replied(ctx, message.RoomID, *message.ThreadRootID)
+	}
+	s.RecordMentions(ctx, message)
+
+	// Authors have read everything up to their own message
+	if _, err := s.advanceCursor(ctx, message, message.UserID); err != nil {
+		log.Printf("Error advancing read cursor of %s: %v", message.UserID, err)
+	}
+}
+
+// Get loads a single message
+func (s *Service) Get(ctx context.Context, messageID string) (*models.Message, error) {
+	return get(ctx, s.db, messageID)
+}
+
+// queryer is a database or a transaction
+type queryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func get(ctx context.Context, q queryer, messageID string) (*models.Message, error) {
+	var message models.Message
+	var metadataJSON []byte
+	query := `SELECT id, user_id, username, room_id, content, message_type, timestamp, metadata, edited_at, deleted_at, deleted_by,
+			  parent_id, thread_root_id, COALESCE(client_msg_id, ''), COALESCE(seq, 0)
+			  FROM messages WHERE id = $1`
+
+	err := q.QueryRowContext(ctx, query, messageID).Scan(&message.ID, &message.UserID, &message.Username,
+		&message.RoomID, &message.Content, &message.MessageType, &message.Timestamp, &metadataJSON,
+		&message.EditedAt, &message.DeletedAt, &message.DeletedBy, &message.ParentID, &message.ThreadRootID, &message.ClientMsgID, &message.Seq)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(metadataJSON) > 0 {
+		json.Unmarshal(metadataJSON, &message.Metadata)
+	}
+
+	return &message, nil
+}
+
+// changeEvent is the event announcing a change to a message to its room.
+// extra holds additional metadata as key/value pairs.
+func changeEvent(eventType string, message *models.Message, extra ...interface{}) models.Event {
+	metadata := map[string]interface{}{}
+	if message.EditedAt != nil {
+		metadata["edited_at"] = message.EditedAt.Unix()
+	}
+	if message.DeletedAt != nil {
+		metadata["deleted_at"] = message.DeletedAt.Unix()
+	}
+	if message.DeletedBy != nil {
+		metadata["deleted_by"] = *message.DeletedBy
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		if key, ok := extra[i].(string); ok {
+			metadata[key] = extra[i+1]
+		}
+	}
+
+	event := models.Event{
+		Type:      eventType,
+		MessageID: message.ID,
+		UserID:    message.UserID,
+		Username:  message.Username,
+		RoomID:    message.RoomID,
+		Content:   message.Content,
+		Timestamp: message.Timestamp.Unix(),
+		Metadata:  metadata,
+	}
+	if message.ThreadRootID != nil {
+		event.ThreadRootID = *message.ThreadRootID
+	}
+	return event
+}
+
+func getInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+		log.Printf("Invalid integer for %s: %q, using %d", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func getDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("Invalid duration for %s: %q, using %s", key, value, defaultValue)
+	}
+	return defaultValue
+}
@@ -0,0 +1,231 @@
+package messages
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/models"
+
+	"github.com/lib/pq"
+)
+
+// MaxEmojiLength is the longest reaction accepted, in bytes. It leaves room
+// for multi-codepoint emoji such as flags and skin-tone variants.
+const MaxEmojiLength = 32
+
+var ErrInvalidEmoji = errors.New("reaction must be a single emoji or short code")
+
+// Reaction actions, sent as metadata["action"] on reaction events
+const (
+	ReactionAdded   = "add"
+	ReactionRemoved = "remove"
+)
+
+// AddReaction reacts to a message. Reacting twice with the same emoji is a
+// no-op. It returns the number of reactions with that emoji.
+func (s *Service) AddReaction(ctx context.Context, roomID, messageID, userID, emoji string) (int, error) {
+	message, err := s.checkReaction(ctx, roomID, messageID, userID, emoji)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	seq, err := lockRoom(ctx, tx, roomID)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `INSERT INTO message_reactions (message_id, user_id, emoji, created_at)
+			  VALUES ($1, $2, $3, NOW())
+			  ON CONFLICT (message_id, user_id, emoji) DO NOTHING`
+	result, err := tx.ExecContext(ctx, query, messageID, userID, emoji)
+	if err != nil {
+		return 0, fmt.Errorf("error adding reaction: %v", err)
+	}
+
+	return s.reacted(ctx, tx, seq, result, message, userID, emoji, ReactionAdded)
+}
+
+// RemoveReaction removes one of the user's reactions. Removing a reaction
+// that does not exist is a no-op.
+func (s *Service) RemoveReaction(ctx context.Context, roomID, messageID, userID, emoji string) (int, error) {
+	message, err := s.checkReaction(ctx, roomID, messageID, userID, emoji)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	seq, err := lockRoom(ctx, tx, roomID)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3`
+	result, err := tx.ExecContext(ctx, query, messageID, userID, emoji)
+	if err != nil {
+		return 0, fmt.Errorf("error removing reaction: %v", err)
+	}
+
+	return s.reacted(ctx, tx, seq, result, message, userID, emoji, ReactionRemoved)
+}
+
+// ListReactions lists who reacted to a message, oldest first
+func (s *Service) ListReactions(ctx context.Context, roomID, messageID, userID string) ([]models.Reaction, error) {
+	if err := s.authz.CanAccessRoom(ctx, userID, roomID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT mr.message_id, mr.user_id, u.username, mr.emoji, mr.created_at
+			  FROM message_reactions mr
+			  JOIN messages m ON m.id = mr.message_id
+			  JOIN users u ON u.id = mr.user_id
+			  WHERE mr.message_id = $1 AND m.room_id = $2
+			  ORDER BY mr.created_at`
+
+	rows, err := s.db.QueryContext(ctx, query, messageID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := []models.Reaction{}
+	for rows.Next() {
+		var reaction models.Reaction
+		if err := rows.Scan(&reaction.MessageID, &reaction.UserID, &reaction.Username, &reaction.Emoji, &reaction.CreatedAt); err != nil {
+			continue
+		}
+		reactions = append(reactions, reaction)
+	}
+
+	return reactions, rows.Err()
+}
+
+// ReactionCounts aggregates the reactions on a page of messages in one
+// query, keyed by message ID. viewerID marks the viewer's own reactions.
+func (s *Service) ReactionCounts(ctx context.Context, viewerID string, messageIDs []string) (map[string][]models.ReactionCount, error) {
+	counts := map[string][]models.ReactionCount{}
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+
+	query := `SELECT message_id, emoji, COUNT(*), BOOL_OR(user_id = $2), MIN(created_at) AS first_at
+			  FROM message_reactions
+			  WHERE message_id = ANY($1)
+			  GROUP BY message_id, emoji
+			  ORDER BY first_at`
+
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(messageIDs), viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID string
+		var count models.ReactionCount
+		var firstAt time.Time
+		if err := rows.Scan(&messageID, &count.Emoji, &count.Count, &count.Me, &firstAt); err != nil {
+			continue
+		}
+		counts[messageID] = append(counts[messageID], count)
+	}
+
+	return counts, rows.Err()
+}
+
+// checkReaction verifies the user may react to a live message in the room
+// and returns the message
+func (s *Service) checkReaction(ctx context.Context, roomID, messageID, userID, emoji string) (*models.Message, error) {
+	if !ValidEmoji(emoji) {
+		return nil, ErrInvalidEmoji
+	}
+	if err := s.authz.Authorize(ctx, userID, roomID, authz.PermPost); err != nil {
+		return nil, err
+	}
+
+	message, err := s.Get(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.RoomID != roomID {
+		return nil, ErrMessageNotFound
+	}
+	if message.DeletedAt != nil {
+		return nil, ErrMessageDeleted
+	}
+	return message, nil
+}
+
+// reacted counts the emoji after a change in tx and, if anything changed,
+// announces it after the message numbered seq and commits. Only the delta
+// is sent, not the whole message.
+func (s *Service) reacted(ctx context.Context, tx *sql.Tx, seq int64, result sql.Result, message *models.Message, userID, emoji, action string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM message_reactions WHERE message_id = $1 AND emoji = $2`
+	if err := tx.QueryRowContext(ctx, query, message.ID, emoji).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return count, nil
+	}
+
+	var username string
+	tx.QueryRowContext(ctx, `SELECT username FROM users WHERE id = $1`, userID).Scan(&username)
+
+	event := map[string]interface{}{
+		"type":       "reaction",
+		"user_id":    userID,
+		"username":   username,
+		"room_id":    message.RoomID,
+		"content":    emoji,
+		"message_id": message.ID,
+		"timestamp":  time.Now().Unix(),
+		"metadata": map[string]interface{}{
+			"emoji":  emoji,
+			"action": action,
+			"count":  count,
+		},
+	}
+	if message.ThreadRootID != nil {
+		event["thread_root_id"] = *message.ThreadRootID
+	}
+
+	if err := recordChange(ctx, tx, message.RoomID, seq, event); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.outbox.Notify()
+	return count, nil
+}
+
+// ValidEmoji reports whether s is acceptable as a reaction: non-empty, at
+// most MaxEmojiLength bytes of valid UTF-8 and free of whitespace and
+// control characters
+func ValidEmoji(s string) bool {
+	if s == "" || len(s) > MaxEmojiLength || !utf8.ValidString(s) {
+		return false
+	}
+	return strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) < 0
+}
@@ -0,0 +1,21 @@
+package messages
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidEmoji(t *testing.T) {
+	assert.True(t, ValidEmoji("👍"))
+	assert.True(t, ValidEmoji("🇳🇴"))
+	assert.True(t, ValidEmoji("👋🏽"))
+	assert.True(t, ValidEmoji(":party:"))
+
+	assert.False(t, ValidEmoji(""))
+	assert.False(t, ValidEmoji("thumbs up"))
+	assert.False(t, ValidEmoji("👍\n"))
+	assert.False(t, ValidEmoji(strings.Repeat("👍", 10)))
+	assert.False(t, ValidEmoji("\xff"))
+}
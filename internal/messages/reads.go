@@ -0,0 +1,162 @@
+package messages
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"chat-app/internal/models"
+
+	"github.com/lib/pq"
+)
+
+// MaxUnreadCount caps unread counts so they stay cheap in very large rooms;
+// clients should show it as "999+"
+const MaxUnreadCount = 1000
+
+// MarkRead moves the user's read cursor in a room forward to messageID.
+// Cursors never move backwards. Mentions up to the message are marked read
+// too, and rooms small enough for receipts are told who has seen what.
+func (s *Service) MarkRead(ctx context.Context, roomID, messageID, userID string) (*models.ReadCursor, error) {
+	if err := s.authz.CanAccessRoom(ctx, userID, roomID); err != nil {
+		return nil, err
+	}
+
+	message, err := s.Get(ctx, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if message.RoomID != roomID {
+		return nil, ErrMessageNotFound
+	}
+
+	moved, err := s.advanceCursor(ctx, message, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := s.ReadCursor(ctx, roomID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if moved {
+		query := `UPDATE message_mentions mm SET read_at = NOW()
+				  FROM messages m
+				  WHERE m.id = mm.message_id AND mm.user_id = $1 AND mm.room_id = $2
+				  AND mm.read_at IS NULL AND m.timestamp <= $3`
+		if _, err := s.db.ExecContext(ctx, query, userID, roomID, message.Timestamp); err != nil {
+			log.Printf("Error marking mentions read in room %s: %v", roomID, err)
+		}
+
+		s.announceRead(ctx, cursor)
+	}
+
+	return cursor, nil
+}
+
+// ReadCursor returns the user's read cursor in a room, or an empty cursor if
+// they have never read it
+func (s *Service) ReadCursor(ctx context.Context, roomID, userID string) (*models.ReadCursor, error) {
+	cursor := &models.ReadCursor{RoomID: roomID, UserID: userID}
+	query := `SELECT last_read_id, last_read_at, updated_at FROM room_reads WHERE room_id = $1 AND user_id = $2`
+
+	err := s.db.QueryRowContext(ctx, query, roomID, userID).Scan(&cursor.LastReadID, &cursor.LastReadAt, &cursor.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return cursor, nil
+}
+
+// UnreadCounts returns the user's last read message and unread count for
+// each room, in one query. Counts exclude the user's own messages, thread
+// replies and deleted messages, and saturate at MaxUnreadCount. Members who
+// never marked a room read count from when they joined; non-members have
+// nothing unread.
+func (s *Service) UnreadCounts(ctx context.Context, userID string, roomIDs []string) (map[string]models.ReadCursor, error) {
+	cursors := map[string]models.ReadCursor{}
+	if len(roomIDs) == 0 {
+		return cursors, nil
+	}
+
+	query := `SELECT r.id, rr.last_read_id,
+			  (SELECT COUNT(*) FROM (
+				  SELECT 1 FROM messages m
+				  WHERE m.room_id = r.id AND m.timestamp > COALESCE(rr.last_read_at, rm.joined_at)
+				  AND m.thread_root_id IS NULL AND m.deleted_at IS NULL AND m.user_id <> $1
+				  LIMIT $3
+			  ) unread)
+			  FROM unnest($2::varchar[]) AS r(id)
+			  LEFT JOIN room_reads rr ON rr.room_id = r.id AND rr.user_id = $1
+			  LEFT JOIN room_members rm ON rm.room_id = r.id AND rm.user_id = $1`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, pq.Array(roomIDs), MaxUnreadCount)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		cursor := models.ReadCursor{UserID: userID}
+		if err := rows.Scan(&cursor.RoomID, &cursor.LastReadID, &cursor.UnreadCount); err != nil {
+			continue
+		}
+		cursors[cursor.RoomID] = cursor
+	}
+
+	return cursors, rows.Err()
+}
+
+// advanceCursor moves the cursor to message if it is newer than the current
+// one and reports whether it moved
+func (s *Service) advanceCursor(ctx context.Context, message *models.Message, userID string) (bool, error) {
+	query := `INSERT INTO room_reads (room_id, user_id, last_read_id, last_read_at, updated_at)
+			  VALUES ($1, $2, $3, $4, NOW())
+			  ON CONFLICT (room_id, user_id) DO UPDATE
+			  SET last_read_id = EXCLUDED.last_read_id, last_read_at = EXCLUDED.last_read_at, updated_at = NOW()
+			  WHERE room_reads.last_read_at < EXCLUDED.last_read_at`
+
+	result, err := s.db.ExecContext(ctx, query, message.RoomID, userID, message.ID, message.Timestamp)
+	if err != nil {
+		return false, fmt.Errorf("error updating read cursor: %v", err)
+	}
+
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// announceRead sends a read receipt to the room unless it has more members
+// than READ_RECEIPTS_MAX_MEMBERS, where per-user receipts would flood it
+func (s *Service) announceRead(ctx context.Context, cursor *models.ReadCursor) {
+	if s.receiptsMaxMembers <= 0 || cursor.LastReadID == nil || cursor.LastReadAt == nil {
+		return
+	}
+
+	var members int
+	query := `SELECT COUNT(*) FROM (SELECT 1 FROM room_members WHERE room_id = $1 LIMIT $2) m`
+	if err := s.db.QueryRowContext(ctx, query, cursor.RoomID, s.receiptsMaxMembers+1).Scan(&members); err != nil || members > s.receiptsMaxMembers {
+		return
+	}
+
+	var username string
+	s.db.QueryRowContext(ctx, `SELECT username FROM users WHERE id = $1`, cursor.UserID).Scan(&username)
+
+	event := map[string]interface{}{
+		"type":       "read",
+		"user_id":    cursor.UserID,
+		"username":   username,
+		"room_id":    cursor.RoomID,
+		"message_id": *cursor.LastReadID,
+		"timestamp":  time.Now().Unix(),
+		"metadata": map[string]interface{}{
+			"last_read_at": cursor.LastReadAt.Unix(),
+		},
+	}
+
+	channel := fmt.Sprintf("room:%s", cursor.RoomID)
+	if err := s.broker.Publish(ctx, channel, event); err != nil {
+		log.Printf("Error publishing read receipt: %v", err)
+	}
+}
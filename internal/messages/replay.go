@@ -0,0 +1,171 @@
+package messages
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/models"
+	"chat-app/internal/outbox"
+)
+
+// MaxReplay is the most messages, and separately the most changes to
+// messages, replayed to a reconnecting client. Clients that missed more are
+// told to reload the history instead.
+const MaxReplay = 500
+
+// Missed is a new message a reconnecting client missed, or the event of an
+// edit, deletion or reaction it missed
+type Missed struct {
+	Message *models.Message
+	Event   json.RawMessage
+}
+
+// Since returns what happened in the room after the message numbered seq,
+// in the order it was delivered live: new messages, each followed by the
+// events of changes made while it was the room's latest. Replies and
+// tombstones are included; callers decide what to deliver, but should count
+// them as seen. ok is false, and nothing is returned, if more than MaxReplay
+// messages or changes were missed.
+func (s *Service) Since(ctx context.Context, roomID, userID string, seq int64) (missed []Missed, ok bool, err error) {
+	if err := s.authz.CanAccessRoom(ctx, userID, roomID); err != nil {
+		return nil, false, err
+	}
+
+	// Counted by seq rather than by rows, as purged messages leave gaps;
+	// changes older than that are no longer logged
+	var lastSeq int64
+	if err := s.db.QueryRowContext(ctx, `SELECT last_seq FROM rooms WHERE id = $1`, roomID).Scan(&lastSeq); err != nil {
+		return nil, false, err
+	}
+	if lastSeq-seq > MaxReplay {
+		return nil, false, nil
+	}
+
+	query := `SELECT id, user_id, username, room_id, content, message_type, timestamp, metadata, edited_at, deleted_at, deleted_by,
+			  parent_id, thread_root_id, COALESCE(client_msg_id, ''), seq
+			  FROM messages
+			  WHERE room_id = $1 AND seq > $2
+			  ORDER BY seq
+			  LIMIT $3`
+
+	rows, err := s.db.QueryContext(ctx, query, roomID, seq, MaxReplay+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var messages []models.Message
+	for rows.Next() {
+		var message models.Message
+		var metadataJSON []byte
+		if err := rows.Scan(&message.ID, &message.UserID, &message.Username, &message.RoomID, &message.Content,
+			&message.MessageType, &message.Timestamp, &metadataJSON, &message.EditedAt, &message.DeletedAt, &message.DeletedBy,
+			&message.ParentID, &message.ThreadRootID, &message.ClientMsgID, &message.Seq); err != nil {
+			return nil, false, err
+		}
+		if len(metadataJSON) > 0 {
+			json.Unmarshal(metadataJSON, &message.Metadata)
+		}
+		messages = append(messages, message)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	if len(messages) > MaxReplay {
+		return nil, false, nil
+	}
+
+	changes, err := s.changesSince(ctx, roomID, seq)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(changes) > MaxReplay {
+		return nil, false, nil
+	}
+
+	missed = make([]Missed, 0, len(messages)+len(changes))
+	for i := range messages {
+		for len(changes) > 0 && changes[0].afterSeq < messages[i].Seq {
+			missed = append(missed, Missed{Event: changes[0].event})
+			changes = changes[1:]
+		}
+		missed = append(missed, Missed{Message: &messages[i]})
+	}
+	for _, c := range changes {
+		missed = append(missed, Missed{Event: c.event})
+	}
+	return missed, true, nil
+}
+
+type loggedChange struct {
+	afterSeq int64
+	event    json.RawMessage
+}
+
+// changesSince returns up to MaxReplay+1 logged changes made after the
+// message numbered seq, in order. A change logged after seq itself may have
+// been delivered before or after the client was sent that message, so it
+// counts as missed too; replaying it again is harmless.
+func (s *Service) changesSince(ctx context.Context, roomID string, seq int64) ([]loggedChange, error) {
+	query := `SELECT after_seq, event FROM message_changes
+			  WHERE room_id = $1 AND after_seq >= $2
+			  ORDER BY id
+			  LIMIT $3`
+
+	rows, err := s.db.QueryContext(ctx, query, roomID, seq, MaxReplay+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []loggedChange
+	for rows.Next() {
+		var c loggedChange
+		if err := rows.Scan(&c.afterSeq, &c.event); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// lockRoom takes the room row lock that Store numbers messages under and
+// returns the room's last seq. Changes take it before anything else, so
+// they are logged and delivered in order with the room's messages.
+func lockRoom(ctx context.Context, tx *sql.Tx, roomID string) (int64, error) {
+	var seq int64
+	err := tx.QueryRowContext(ctx, `SELECT last_seq FROM rooms WHERE id = $1 FOR UPDATE`, roomID).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, authz.ErrRoomNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error locking room: %v", err)
+	}
+	return seq, nil
+}
+
+// recordChange logs the event of an edit, deletion or reaction after the
+// message numbered seq, for Since, and writes it to the outbox, as part of
+// tx. Changes logged before the oldest message Since could replay are
+// pruned on the way.
+func recordChange(ctx context.Context, tx *sql.Tx, roomID string, seq int64, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO message_changes (room_id, after_seq, event) VALUES ($1, $2, $3)`
+	if _, err := tx.ExecContext(ctx, query, roomID, seq, payload); err != nil {
+		return fmt.Errorf("error recording change: %v", err)
+	}
+	query = `DELETE FROM message_changes WHERE room_id = $1 AND after_seq < $2`
+	if _, err := tx.ExecContext(ctx, query, roomID, seq-MaxReplay); err != nil {
+		return fmt.Errorf("error pruning changes: %v", err)
+	}
+
+	return outbox.Write(ctx, tx, fmt.Sprintf("room:%s", roomID), json.RawMessage(payload))
+}
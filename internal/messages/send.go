@@ -0,0 +1,172 @@
+package messages
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/models"
+	"chat-app/internal/outbox"
+
+	"github.com/google/uuid"
+)
+
+// MaxClientMsgIDLength bounds client-supplied message IDs
+const MaxClientMsgIDLength = 64
+
+var ErrInvalidClientMsgID = fmt.Errorf("client_msg_id must be at most %d characters", MaxClientMsgIDLength)
+
+// Draft is a new message as submitted by a client. The caller has already
+// checked that the user may post to the room.
+type Draft struct {
+	RoomID      string
+	UserID      string
+	Username    string
+	Content     string
+	MessageType string
+	Metadata    interface{} // stored as JSON
+	ParentID    string      // reply in the thread of this message
+	ClientMsgID string      // makes retries idempotent per user
+}
+
+// Store saves a draft and returns the stored message. The message event is
+// written to the outbox with it, to be published to the room however long
+// the broker is unavailable. If the user already sent a message with the
+// same client_msg_id, that message is returned instead with duplicate set,
+// and nothing is stored.
+func (s *Service) Store(ctx context.Context, draft Draft) (message *models.Message, duplicate bool, err error) {
+	if strings.TrimSpace(draft.Content) == "" {
+		return nil, false, ErrEmptyContent
+	}
+	if len(draft.ClientMsgID) > MaxClientMsgIDLength {
+		return nil, false, ErrInvalidClientMsgID
+	}
+
+	if draft.ClientMsgID != "" {
+		if existing, err := s.byClientMsgID(ctx, draft.UserID, draft.ClientMsgID); err != ErrMessageNotFound {
+			return existing, err == nil, err
+		}
+	}
+
+	rootID, err := s.ThreadRoot(ctx, draft.RoomID, draft.ParentID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if draft.MessageType == "" {
+		draft.MessageType = "text"
+	}
+	var metadataJSON []byte
+	if draft.Metadata != nil {
+		if metadataJSON, err = json.Marshal(draft.Metadata); err != nil {
+			return nil, false, err
+		}
+	}
+
+	message = &models.Message{
+		ID:          uuid.New().String(),
+		UserID:      draft.UserID,
+		Username:    draft.Username,
+		RoomID:      draft.RoomID,
+		Content:     draft.Content,
+		MessageType: draft.MessageType,
+		Timestamp:   time.Now(),
+		ClientMsgID: draft.ClientMsgID,
+	}
+	if draft.ParentID != "" {
+		message.ParentID = &draft.ParentID
+		message.ThreadRootID = &rootID
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// Taking the room's next sequence number locks the room row until
+	// commit, so messages become visible in sequence order
+	query := `UPDATE rooms SET last_seq = last_seq + 1 WHERE id = $1 RETURNING last_seq`
+	err = tx.QueryRowContext(ctx, query, draft.RoomID).Scan(&message.Seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, authz.ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error numbering message: %v", err)
+	}
+
+	// Concurrent retries race on the unique index; the loser rolls back its
+	// sequence number and returns the winner's message
+	query = `INSERT INTO messages (id, user_id, username, room_id, content, message_type, timestamp, metadata,
+			  parent_id, thread_root_id, client_msg_id, seq)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), NULLIF($10, ''), NULLIF($11, ''), $12)
+			  ON CONFLICT (user_id, client_msg_id) WHERE client_msg_id IS NOT NULL DO NOTHING`
+
+	result, err := tx.ExecContext(ctx, query, message.ID, message.UserID, message.Username, message.RoomID,
+		message.Content, message.MessageType, message.Timestamp, metadataJSON, draft.ParentID, rootID, draft.ClientMsgID, message.Seq)
+	if err != nil {
+		return nil, false, fmt.Errorf("error storing message: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		tx.Rollback()
+		existing, err := s.byClientMsgID(ctx, draft.UserID, draft.ClientMsgID)
+		return existing, err == nil, err
+	}
+
+	if err := outbox.Write(ctx, tx, fmt.Sprintf("room:%s", message.RoomID), messageEvent(message, metadataJSON)); err != nil {
+		return nil, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	s.outbox.Notify()
+
+	if len(metadataJSON) > 0 {
+		json.Unmarshal(metadataJSON, &message.Metadata)
+	}
+	return message, false, nil
+}
+
+// messageEvent is the event announcing a new message to its room. Clients
+// may receive it more than once and de-duplicate by message_id.
+func messageEvent(message *models.Message, metadataJSON []byte) models.Event {
+	event := models.Event{
+		Type:        "message",
+		MessageID:   message.ID,
+		UserID:      message.UserID,
+		Username:    message.Username,
+		RoomID:      message.RoomID,
+		Content:     message.Content,
+		MessageType: message.MessageType,
+		Timestamp:   message.Timestamp.Unix(),
+		ClientMsgID: message.ClientMsgID,
+		Seq:         message.Seq,
+	}
+	if len(metadataJSON) > 0 {
+		event.Metadata = json.RawMessage(metadataJSON)
+	}
+	if message.ParentID != nil {
+		event.ParentID = *message.ParentID
+		event.ThreadRootID = *message.ThreadRootID
+	}
+	return event
+}
+
+func (s *Service) byClientMsgID(ctx context.Context, userID, clientMsgID string) (*models.Message, error) {
+	var messageID string
+	query := `SELECT id FROM messages WHERE user_id = $1 AND client_msg_id = $2`
+
+	err := s.db.QueryRowContext(ctx, query, userID, clientMsgID).Scan(&messageID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, messageID)
+}
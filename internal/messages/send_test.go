@@ -0,0 +1,72 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"chat-app/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageEvent(t *testing.T) {
+	parentID, rootID := "m1", "m0"
+	message := &models.Message{
+		ID:           "m2",
+		UserID:       "u1",
+		Username:     "alice",
+		RoomID:       "r1",
+		Content:      "hi",
+		MessageType:  "text",
+		Timestamp:    time.Unix(1700000000, 0),
+		ParentID:     &parentID,
+		ThreadRootID: &rootID,
+		ClientMsgID:  "c1",
+		Seq:          7,
+	}
+
+	data, err := json.Marshal(messageEvent(message, []byte(`{"size":3}`)))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"type": "message",
+		"message_id": "m2",
+		"user_id": "u1",
+		"username": "alice",
+		"room_id": "r1",
+		"content": "hi",
+		"message_type": "text",
+		"timestamp": 1700000000,
+		"metadata": {"size": 3},
+		"parent_id": "m1",
+		"thread_root_id": "m0",
+		"client_msg_id": "c1",
+		"seq": 7
+	}`, string(data))
+
+	message.ParentID, message.ThreadRootID = nil, nil
+	data, err = json.Marshal(messageEvent(message, nil))
+	require.NoError(t, err)
+	var event map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &event))
+	assert.NotContains(t, event, "metadata")
+	assert.NotContains(t, event, "thread_root_id")
+}
+
+func TestStoreRejects(t *testing.T) {
+	s := &Service{}
+	ctx := context.Background()
+
+	_, _, err := s.Store(ctx, Draft{RoomID: "r1", UserID: "u1", Content: "  "})
+	assert.Equal(t, ErrEmptyContent, err)
+
+	// Oversized IDs are refused before anything is looked up or stored
+	draft := Draft{RoomID: "r1", UserID: "u1", Content: "hi", ClientMsgID: strings.Repeat("c", MaxClientMsgIDLength+1)}
+	message, duplicate, err := s.Store(ctx, draft)
+	assert.Equal(t, ErrInvalidClientMsgID, err)
+	assert.Nil(t, message)
+	assert.False(t, duplicate)
+}
@@ -0,0 +1,156 @@
+//go:build integration
+
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/models"
+	"chat-app/internal/outbox"
+	"chat-app/internal/testdb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testStore returns a service that can store messages, and a user and a
+// room to store them as and in
+func testStore(t *testing.T) (s *Service, userID, roomID string) {
+	db := testdb.DB(t)
+	userID = testdb.User(t, db)
+	roomID = testdb.Room(t, db, userID, false)
+	b := broker.NewMemory()
+	s = &Service{db: db, broker: b, outbox: outbox.NewRelay(db, b), authz: authz.NewAuthorizer(db, testdb.Redis(t))}
+	return s, userID, roomID
+}
+
+func TestStoreRetry(t *testing.T) {
+	ctx := context.Background()
+	s, userID, roomID := testStore(t)
+	draft := Draft{RoomID: roomID, UserID: userID, Username: "alice", Content: "hi", ClientMsgID: "c1"}
+
+	first, duplicate, err := s.Store(ctx, draft)
+	require.NoError(t, err)
+	assert.False(t, duplicate)
+
+	// A retry, even with other content, returns the original message
+	draft.Content = "hi again"
+	retry, duplicate, err := s.Store(ctx, draft)
+	require.NoError(t, err)
+	assert.True(t, duplicate)
+	assert.Equal(t, first.ID, retry.ID)
+	assert.Equal(t, first.Seq, retry.Seq)
+	assert.Equal(t, "hi", retry.Content)
+
+	// The ID is per user and at most MaxClientMsgIDLength long
+	draft.ClientMsgID = strings.Repeat("c", MaxClientMsgIDLength)
+	_, duplicate, err = s.Store(ctx, draft)
+	require.NoError(t, err)
+	assert.False(t, duplicate)
+	draft.ClientMsgID += "c"
+	_, _, err = s.Store(ctx, draft)
+	assert.Equal(t, ErrInvalidClientMsgID, err)
+}
+
+func TestStoreConcurrentRetries(t *testing.T) {
+	ctx := context.Background()
+	s, userID, roomID := testStore(t)
+	draft := Draft{RoomID: roomID, UserID: userID, Username: "alice", Content: "hi", ClientMsgID: "c1"}
+
+	// Retries racing past the lookup conflict on insert; the losers
+	// return the winner's message and give back their sequence numbers
+	const retries = 8
+	var wg sync.WaitGroup
+	ids := make([]string, retries)
+	duplicates := make([]bool, retries)
+	errs := make([]error, retries)
+	for i := 0; i < retries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			message, duplicate, err := s.Store(ctx, draft)
+			if err == nil {
+				ids[i] = message.ID
+			}
+			duplicates[i], errs[i] = duplicate, err
+		}(i)
+	}
+	wg.Wait()
+
+	stored := 0
+	for i := 0; i < retries; i++ {
+		require.NoError(t, errs[i], "retry %d", i)
+		assert.Equal(t, ids[0], ids[i])
+		if !duplicates[i] {
+			stored++
+		}
+	}
+	assert.Equal(t, 1, stored)
+
+	var count int
+	var lastSeq int64
+	require.NoError(t, s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE room_id = $1`, roomID).Scan(&count))
+	require.NoError(t, s.db.QueryRow(`SELECT last_seq FROM rooms WHERE id = $1`, roomID).Scan(&lastSeq))
+	assert.Equal(t, 1, count)
+	assert.Equal(t, int64(1), lastSeq)
+}
+
+func TestSinceReplaysChanges(t *testing.T) {
+	ctx := context.Background()
+	s, userID, roomID := testStore(t)
+	send := func(content string) *models.Message {
+		message, _, err := s.Store(ctx, Draft{RoomID: roomID, UserID: userID, Username: "alice", Content: content})
+		require.NoError(t, err)
+		return message
+	}
+
+	// The client saw the first message only
+	first := send("one")
+	second := send("two")
+	_, err := s.Edit(ctx, roomID, first.ID, userID, "one, edited")
+	require.NoError(t, err)
+	third := send("three")
+	_, err = s.AddReaction(ctx, roomID, second.ID, userID, "👍")
+	require.NoError(t, err)
+
+	// Changes come after the message that was latest when they were made
+	missed, ok, err := s.Since(ctx, roomID, userID, first.Seq)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []string{
+		"message " + second.ID,
+		"message_edited " + first.ID,
+		"message " + third.ID,
+		"reaction " + second.ID,
+	}, describe(t, missed))
+
+	// A client that saw the latest message still gets the changes made
+	// since, or while it was the latest
+	_, err = s.Delete(ctx, roomID, first.ID, userID)
+	require.NoError(t, err)
+	missed, ok, err = s.Since(ctx, roomID, userID, third.Seq)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []string{"reaction " + second.ID, "message_deleted " + first.ID}, describe(t, missed))
+}
+
+// describe lists missed messages and events as "<type> <message ID>"
+func describe(t *testing.T, missed []Missed) []string {
+	var described []string
+	for _, m := range missed {
+		if m.Message != nil {
+			described = append(described, "message "+m.Message.ID)
+			continue
+		}
+		var event models.Event
+		require.NoError(t, json.Unmarshal(m.Event, &event))
+		described = append(described, event.Type+" "+event.MessageID)
+	}
+	return described
+}
@@ -0,0 +1,192 @@
+package messages
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"chat-app/internal/models"
+
+	"github.com/lib/pq"
+)
+
+// ThreadSummary is the reply count and last reply time of a thread root
+type ThreadSummary struct {
+	ReplyCount  int
+	LastReplyAt time.Time
+}
+
+// ThreadRoot validates parentID as the message being replied to and returns
+// the root of its thread. Replies to replies join the same thread, so the
+// result is the parent itself unless the parent is a reply. An empty
+// parentID returns an empty root.
+func (s *Service) ThreadRoot(ctx context.Context, roomID, parentID string) (string, error) {
+	if parentID == "" {
+		return "", nil
+	}
+
+	parent, err := s.Get(ctx, parentID)
+	if err != nil {
+		return "", err
+	}
+	if parent.RoomID != roomID {
+		return "", ErrMessageNotFound
+	}
+	if parent.DeletedAt != nil {
+		return "", ErrMessageDeleted
+	}
+
+	if parent.ThreadRootID != nil {
+		return *parent.ThreadRootID, nil
+	}
+	return parent.ID, nil
+}
+
+// Thread returns the root of the thread messageID belongs to and its
+// replies, oldest first
+func (s *Service) Thread(ctx context.Context, roomID, messageID, userID string) (*models.Message, []models.Message, error) {
+	if err := s.authz.CanAccessRoom(ctx, userID, roomID); err != nil {
+		return nil, nil, err
+	}
+
+	root, err := s.Get(ctx, messageID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if root.ThreadRootID != nil {
+		if root, err = s.Get(ctx, *root.ThreadRootID); err != nil {
+			return nil, nil, err
+		}
+	}
+	if root.RoomID != roomID {
+		return nil, nil, ErrMessageNotFound
+	}
+
+	query := `SELECT id, user_id, username, room_id, content, message_type, timestamp, metadata, edited_at, deleted_at, deleted_by, parent_id, thread_root_id, COALESCE(seq, 0)
+			  FROM messages
+			  WHERE thread_root_id = $1
+			  ORDER BY timestamp`
+
+	rows, err := s.db.QueryContext(ctx, query, root.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	replies := []models.Message{}
+	for rows.Next() {
+		var reply models.Message
+		var metadataJSON []byte
+		if err := rows.Scan(&reply.ID, &reply.UserID, &reply.Username, &reply.RoomID, &reply.Content, &reply.MessageType,
+			&reply.Timestamp, &metadataJSON, &reply.EditedAt, &reply.DeletedAt, &reply.DeletedBy, &reply.ParentID, &reply.ThreadRootID, &reply.Seq); err != nil {
+			continue
+		}
+		if len(metadataJSON) > 0 {
+			json.Unmarshal(metadataJSON, &reply.Metadata)
+		}
+		replies = append(replies, reply)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	page := append([]models.Message{*root}, replies...)
+	if err := s.Annotate(ctx, userID, page); err != nil {
+		log.Printf("Error annotating thread %s: %v", root.ID, err)
+	}
+
+	return &page[0], page[1:], nil
+}
+
+// ThreadSummaries returns the reply count and last reply time of every
+// thread root in rootIDs that has replies, in one query. Deleted replies
+// are not counted.
+func (s *Service) ThreadSummaries(ctx context.Context, rootIDs []string) (map[string]ThreadSummary, error) {
+	summaries := map[string]ThreadSummary{}
+	if len(rootIDs) == 0 {
+		return summaries, nil
+	}
+
+	query := `SELECT thread_root_id, COUNT(*), MAX(timestamp)
+			  FROM messages
+			  WHERE thread_root_id = ANY($1) AND deleted_at IS NULL
+			  GROUP BY thread_root_id`
+
+	rows, err := s.db.QueryContext(ctx, query, pq.Array(rootIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var rootID string
+		var summary ThreadSummary
+		if err := rows.Scan(&rootID, &summary.ReplyCount, &summary.LastReplyAt); err != nil {
+			continue
+		}
+		summaries[rootID] = summary
+	}
+
+	return summaries, rows.Err()
+}
+
+// Replied announces a thread's new reply count to the room, so clients that
+// do not follow the thread can update its root without receiving replies.
+// It is called when a reply is sent, deleted or purged.
+func (s *Service) Replied(ctx context.Context, roomID, rootID string) {
+	summaries, err := s.ThreadSummaries(ctx, []string{rootID})
+	if err != nil {
+		log.Printf("Error summarising thread %s: %v", rootID, err)
+		return
+	}
+	summary := summaries[rootID]
+	metadata := map[string]interface{}{"reply_count": summary.ReplyCount}
+	if summary.ReplyCount > 0 {
+		metadata["last_reply_at"] = summary.LastReplyAt.Unix()
+	}
+
+	event := map[string]interface{}{
+		"type":       "thread_updated",
+		"user_id":    "system",
+		"username":   "System",
+		"room_id":    roomID,
+		"message_id": rootID,
+		"timestamp":  time.Now().Unix(),
+		"metadata":   metadata,
+	}
+
+	channel := fmt.Sprintf("room:%s", roomID)
+	if err := s.broker.Publish(ctx, channel, event); err != nil {
+		log.Printf("Error publishing thread update: %v", err)
+	}
+}
+
+// Annotate fills in the aggregated reactions and thread summaries of a
+// page of messages. viewerID marks the viewer's own reactions.
+func (s *Service) Annotate(ctx context.Context, viewerID string, page []models.Message) error {
+	ids := make([]string, len(page))
+	for i := range page {
+		ids[i] = page[i].ID
+	}
+
+	counts, err := s.ReactionCounts(ctx, viewerID, ids)
+	if err != nil {
+		return err
+	}
+	summaries, err := s.ThreadSummaries(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for i := range page {
+		page[i].Reactions = counts[page[i].ID]
+		if summary, ok := summaries[page[i].ID]; ok {
+			lastReplyAt := summary.LastReplyAt
+			page[i].ReplyCount = summary.ReplyCount
+			page[i].LastReplyAt = &lastReplyAt
+		}
+	}
+	return nil
+}
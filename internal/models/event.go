@@ -0,0 +1,21 @@
+package models
+
+// Event is published on a room channel when a message is sent, edited or
+// deleted, or a user joins or leaves the room. Every transport publishes
+// the same event for the same change; fields that do not apply are left
+// out.
+type Event struct {
+	Type         string      `json:"type"`
+	MessageID    string      `json:"message_id,omitempty"`
+	UserID       string      `json:"user_id"`
+	Username     string      `json:"username"`
+	RoomID       string      `json:"room_id"`
+	Content      string      `json:"content"`
+	MessageType  string      `json:"message_type,omitempty"`
+	Timestamp    int64       `json:"timestamp"`
+	Metadata     interface{} `json:"metadata,omitempty"`
+	ParentID     string      `json:"parent_id,omitempty"`
+	ThreadRootID string      `json:"thread_root_id,omitempty"`
+	ClientMsgID  string      `json:"client_msg_id,omitempty"`
+	Seq          int64       `json:"seq,omitempty"`
+}
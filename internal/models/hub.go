@@ -0,0 +1,455 @@
+package models
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// Hub defaults, used for zero HubConfig fields
+const (
+	DefaultHubShards    = 64
+	DefaultSendBuffer   = 256
+	DefaultBacklogBytes = 1 << 20
+	DefaultShardInbox   = 4096
+)
+
+// ErrTooManySubscriptions is returned when a connection is at its limit
+var ErrTooManySubscriptions = errors.New("too many room subscriptions")
+
+// errConnectionClosed is returned when subscribing a closed connection
+var errConnectionClosed = errors.New("connection is closed")
+
+// Connection represents a WebSocket connection. Send is drained by the
+// connection's writer and closed exactly once, by Hub.Unregister; everyone
+// else writes to it through Offer or Enqueue, never directly.
+type Connection struct {
+	ID       string      `json:"id"`
+	UserID   string      `json:"user_id"`
+	Username string      `json:"username"`
+	RoomID   string      `json:"room_id"` // room given when connecting, the default for frames
+	Session  string      `json:"-"`       // auth session the connection was opened with
+	Conn     interface{} `json:"-"`       // WebSocket connection
+	Send     chan []byte `json:"-"`
+	Hub      *Hub        `json:"-"`
+
+	mu         sync.RWMutex
+	closed     bool
+	rooms      map[string]bool
+	overflowed atomic.Bool
+
+	config       HubConfig
+	backlog      []*pending          // what did not fit in Send, oldest first
+	coalescing   map[string]*pending // backlogged coalesced messages by key
+	backlogBytes atomic.Int64
+}
+
+// NewConnection creates a new connection buffering as the hub is configured
+func NewConnection(userID, username, roomID string, conn interface{}, hub *Hub) *Connection {
+	config := HubConfig{}.withDefaults()
+	if hub != nil {
+		config = hub.config
+	}
+
+	return &Connection{
+		ID:       uuid.New().String(),
+		UserID:   userID,
+		Username: username,
+		RoomID:   roomID,
+		Conn:     conn,
+		Send:     make(chan []byte, config.SendBuffer),
+		Hub:      hub,
+		rooms:    make(map[string]bool),
+		config:   config,
+	}
+}
+
+// HubConfig sizes a hub and sets its slow-consumer policy. Zero fields
+// take the defaults.
+type HubConfig struct {
+	Shards     int // rooms and users are spread over this many shards
+	ShardInbox int // commands queued per shard
+
+	SendBuffer     int // messages queued per connection for its writer
+	EphemeralLimit int // queued messages past which ephemeral ones are dropped, SendBuffer/2 by default
+	BacklogBytes   int // bytes per connection held back once its queue is full
+
+	// Overflow is called once for a connection whose backlog would go over
+	// BacklogBytes; the message is dropped. It must not block.
+	Overflow func(*Connection)
+
+	// RoomActive and UserActive are called when a room or user gains its
+	// first connection (true) or loses its last one (false), in that order
+	// for each room or user. They run on a shard and must not block.
+	RoomActive func(roomID string, active bool)
+	UserActive func(userID string, active bool)
+}
+
+func (c HubConfig) withDefaults() HubConfig {
+	if c.Shards <= 0 {
+		c.Shards = DefaultHubShards
+	}
+	if c.ShardInbox <= 0 {
+		c.ShardInbox = DefaultShardInbox
+	}
+	if c.SendBuffer <= 0 {
+		c.SendBuffer = DefaultSendBuffer
+	}
+	if c.EphemeralLimit <= 0 || c.EphemeralLimit > c.SendBuffer {
+		c.EphemeralLimit = (c.SendBuffer + 1) / 2
+	}
+	if c.BacklogBytes <= 0 {
+		c.BacklogBytes = DefaultBacklogBytes
+	}
+	return c
+}
+
+// Hub routes messages to connections by room and by user. Rooms and users
+// are spread over shards by hash; each shard's index is owned by a single
+// goroutine and only changed by the commands it runs, so fan-out needs no
+// locks and costs O(room size). Commands for one room run in the order
+// they were sent.
+type Hub struct {
+	config HubConfig
+	shards []*shard
+
+	connections atomic.Int64
+}
+
+// shard owns the rooms and users that hash to it
+type shard struct {
+	inbox chan func()
+	rooms map[string]map[*Connection]struct{}
+	users map[string]map[*Connection]struct{}
+
+	delivered  atomic.Uint64
+	coalesced  atomic.Uint64
+	dropped    atomic.Uint64
+	overflowed atomic.Uint64
+}
+
+// NewHub creates a hub and starts its shards
+func NewHub(config HubConfig) *Hub {
+	config = config.withDefaults()
+	h := &Hub{config: config, shards: make([]*shard, config.Shards)}
+	for i := range h.shards {
+		s := &shard{
+			inbox: make(chan func(), config.ShardInbox),
+			rooms: make(map[string]map[*Connection]struct{}),
+			users: make(map[string]map[*Connection]struct{}),
+		}
+		h.shards[i] = s
+		go s.run()
+	}
+	return h
+}
+
+func (s *shard) run() {
+	for fn := range s.inbox {
+		fn()
+	}
+}
+
+// call runs fn on the shard's goroutine and waits for it
+func (s *shard) call(fn func()) {
+	done := make(chan struct{})
+	s.inbox <- func() {
+		fn()
+		close(done)
+	}
+	<-done
+}
+
+func (h *Hub) shard(key string) *shard {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return h.shards[hash.Sum32()%uint32(len(h.shards))]
+}
+
+// Register makes a connection reachable by user
+func (h *Hub) Register(conn *Connection) {
+	h.connections.Add(1)
+	s := h.shard(conn.UserID)
+	s.call(func() {
+		if !conn.isClosed() && add(s.users, conn.UserID, conn) {
+			h.active(h.config.UserActive, conn.UserID, true)
+		}
+	})
+}
+
+// Unregister removes a connection from every room and closes its Send.
+// It is safe to call more than once.
+func (h *Hub) Unregister(conn *Connection) {
+	conn.mu.Lock()
+	if conn.closed {
+		conn.mu.Unlock()
+		return
+	}
+	conn.closed = true
+	close(conn.Send)
+	rooms := conn.rooms
+	conn.rooms = make(map[string]bool)
+	conn.clearBacklog()
+	conn.mu.Unlock()
+
+	h.connections.Add(-1)
+	for roomID := range rooms {
+		s := h.shard(roomID)
+		s.inbox <- func() {
+			if remove(s.rooms, roomID, conn) {
+				h.active(h.config.RoomActive, roomID, false)
+			}
+		}
+	}
+	s := h.shard(conn.UserID)
+	s.inbox <- func() {
+		if remove(s.users, conn.UserID, conn) {
+			h.active(h.config.UserActive, conn.UserID, false)
+		}
+	}
+}
+
+// Subscribe adds a room to a connection's subscriptions. limit caps how
+// many rooms one connection may subscribe to (0 = no limit); subscribing
+// again to a room is a no-op. Broadcasts sent after it returns reach the
+// connection.
+func (h *Hub) Subscribe(conn *Connection, roomID string, limit int) error {
+	conn.mu.Lock()
+	switch {
+	case conn.closed:
+		conn.mu.Unlock()
+		return errConnectionClosed
+	case conn.rooms[roomID]:
+		conn.mu.Unlock()
+		return nil
+	case limit > 0 && len(conn.rooms) >= limit:
+		conn.mu.Unlock()
+		return ErrTooManySubscriptions
+	}
+	conn.rooms[roomID] = true
+	conn.mu.Unlock()
+
+	// Unsubscribe or Unregister may have run since, and their removal may
+	// already be done, so only add the connection if it still has the room
+	s := h.shard(roomID)
+	s.call(func() {
+		if h.Subscribed(conn, roomID) && add(s.rooms, roomID, conn) {
+			h.active(h.config.RoomActive, roomID, true)
+		}
+	})
+	return nil
+}
+
+// Unsubscribe removes a room from a connection's subscriptions and reports
+// whether it was subscribed. Broadcasts sent after it returns no longer
+// reach the connection.
+func (h *Hub) Unsubscribe(conn *Connection, roomID string) bool {
+	conn.mu.Lock()
+	subscribed := conn.rooms[roomID]
+	delete(conn.rooms, roomID)
+	conn.mu.Unlock()
+
+	if !subscribed {
+		return false
+	}
+	s := h.shard(roomID)
+	s.call(func() {
+		if remove(s.rooms, roomID, conn) {
+			h.active(h.config.RoomActive, roomID, false)
+		}
+	})
+	return true
+}
+
+// Subscribed reports whether a connection is subscribed to a room
+func (h *Hub) Subscribed(conn *Connection, roomID string) bool {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+	return conn.rooms[roomID]
+}
+
+// Subscriptions returns the rooms a connection is subscribed to
+func (h *Hub) Subscriptions(conn *Connection) []string {
+	conn.mu.RLock()
+	defer conn.mu.RUnlock()
+
+	rooms := make([]string, 0, len(conn.rooms))
+	for roomID := range conn.rooms {
+		rooms = append(rooms, roomID)
+	}
+	return rooms
+}
+
+// Broadcast offers msg to every connection subscribed to a room for which
+// accept, if set, returns true. It returns once the room's shard has the
+// message; accept runs on the shard's goroutine and must not block.
+func (h *Hub) Broadcast(roomID string, msg Outbound, accept func(*Connection) bool) {
+	s := h.shard(roomID)
+	s.inbox <- func() {
+		for conn := range s.rooms[roomID] {
+			if accept != nil && !accept(conn) {
+				continue
+			}
+			s.count(conn.offer(msg))
+		}
+	}
+}
+
+// SendToUser offers msg to every connection of a user
+func (h *Hub) SendToUser(userID string, msg Outbound) {
+	s := h.shard(userID)
+	s.inbox <- func() {
+		for conn := range s.users[userID] {
+			s.count(conn.offer(msg))
+		}
+	}
+}
+
+func (s *shard) count(result offerResult) {
+	switch result {
+	case queued, backlogged:
+		s.delivered.Add(1)
+	case replaced:
+		s.coalesced.Add(1)
+	case overflowed:
+		s.overflowed.Add(1)
+		s.dropped.Add(1)
+	case dropped:
+		s.dropped.Add(1)
+	}
+}
+
+// UserConnections returns the connections of a user
+func (h *Hub) UserConnections(userID string) []*Connection {
+	var conns []*Connection
+	s := h.shard(userID)
+	s.call(func() {
+		for conn := range s.users[userID] {
+			conns = append(conns, conn)
+		}
+	})
+	return conns
+}
+
+// RoomConnections returns the connections subscribed to a room
+func (h *Hub) RoomConnections(roomID string) []*Connection {
+	var conns []*Connection
+	s := h.shard(roomID)
+	s.call(func() {
+		for conn := range s.rooms[roomID] {
+			conns = append(conns, conn)
+		}
+	})
+	return conns
+}
+
+// Flush waits until every command sent to the hub so far has run
+func (h *Hub) Flush() {
+	for _, s := range h.shards {
+		s.call(func() {})
+	}
+}
+
+// Stop stops the shards. The hub must not be used afterwards.
+func (h *Hub) Stop() {
+	for _, s := range h.shards {
+		close(s.inbox)
+	}
+}
+
+// HubStats is a snapshot of a hub's load
+type HubStats struct {
+	Shards          int    `json:"shards"`
+	Connections     int64  `json:"connections"`
+	Rooms           int    `json:"rooms"`
+	Subscriptions   int    `json:"subscriptions"`
+	InboxDepth      int    `json:"inbox_depth"`       // commands queued over all shards
+	MaxInboxDepth   int    `json:"max_inbox_depth"`   // commands queued on the busiest shard
+	SendDepth       int    `json:"send_depth"`        // messages queued over all connections
+	MaxSendDepth    int    `json:"max_send_depth"`    // messages queued for the slowest connection
+	BacklogBytes    int64  `json:"backlog_bytes"`     // bytes held back over all connections
+	MaxBacklogBytes int64  `json:"max_backlog_bytes"` // bytes held back for the slowest connection
+	Delivered       uint64 `json:"delivered"`
+	Coalesced       uint64 `json:"coalesced"`  // messages that replaced a backlogged one
+	Dropped         uint64 `json:"dropped"`    // ephemeral messages and messages over a backlog budget
+	Overflowed      uint64 `json:"overflowed"` // connections that went over their backlog budget
+}
+
+// Stats returns a snapshot of the hub's load. Each shard is visited in
+// turn, so it is not atomic across shards.
+func (h *Hub) Stats() HubStats {
+	stats := HubStats{Shards: len(h.shards), Connections: h.connections.Load()}
+
+	for _, s := range h.shards {
+		depth := len(s.inbox)
+		stats.InboxDepth += depth
+		if depth > stats.MaxInboxDepth {
+			stats.MaxInboxDepth = depth
+		}
+		stats.Delivered += s.delivered.Load()
+		stats.Coalesced += s.coalesced.Load()
+		stats.Dropped += s.dropped.Load()
+		stats.Overflowed += s.overflowed.Load()
+
+		s.call(func() {
+			stats.Rooms += len(s.rooms)
+			for _, conns := range s.rooms {
+				stats.Subscriptions += len(conns)
+			}
+			for _, conns := range s.users {
+				for conn := range conns {
+					queued := len(conn.Send)
+					stats.SendDepth += queued
+					if queued > stats.MaxSendDepth {
+						stats.MaxSendDepth = queued
+					}
+					held := conn.backlogBytes.Load()
+					stats.BacklogBytes += held
+					if held > stats.MaxBacklogBytes {
+						stats.MaxBacklogBytes = held
+					}
+				}
+			}
+		})
+	}
+	return stats
+}
+
+func (h *Hub) active(fn func(string, bool), key string, active bool) {
+	if fn != nil {
+		fn(key, active)
+	}
+}
+
+// add indexes a connection under key and reports whether it is the first
+func add(index map[string]map[*Connection]struct{}, key string, conn *Connection) bool {
+	first := index[key] == nil
+	if first {
+		index[key] = make(map[*Connection]struct{})
+	}
+	index[key][conn] = struct{}{}
+	return first
+}
+
+// remove drops a connection from key and reports whether it was the last
+func remove(index map[string]map[*Connection]struct{}, key string, conn *Connection) bool {
+	conns, ok := index[key]
+	if !ok {
+		return false
+	}
+	delete(conns, conn)
+	if len(conns) > 0 {
+		return false
+	}
+	delete(index, key)
+	return true
+}
+
+func (c *Connection) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// benchHub connects conns connections spread evenly over rooms rooms
+func benchHub(b *testing.B, conns, rooms int) (*Hub, []*Connection) {
+	hub := NewHub(HubConfig{SendBuffer: 64})
+	connections := make([]*Connection, conns)
+	for i := range connections {
+		conn := NewConnection(fmt.Sprintf("user-%d", i), "", "", nil, hub)
+		hub.Register(conn)
+		if err := hub.Subscribe(conn, fmt.Sprintf("room-%d", i%rooms), 0); err != nil {
+			b.Fatal(err)
+		}
+		connections[i] = conn
+	}
+	return hub, connections
+}
+
+// drain empties every connection's buffer
+func drain(connections []*Connection) {
+	for _, conn := range connections {
+		for len(conn.Send) > 0 {
+			<-conn.Send
+		}
+	}
+}
+
+// BenchmarkHubBroadcast fans messages out to 100k connections in 10k rooms
+func BenchmarkHubBroadcast(b *testing.B) {
+	if testing.Short() {
+		b.Skip("skipping 100k connection benchmark in short mode")
+	}
+	const conns, rooms = 100000, 10000
+
+	hub, connections := benchHub(b, conns, rooms)
+	defer hub.Stop()
+	msg := Outbound{Data: []byte(`{"type":"message","content":"hello"}`)}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hub.Broadcast(fmt.Sprintf("room-%d", i%rooms), msg, nil)
+
+		// Keep the buffers from overflowing without timing the readers
+		if i%(rooms*32) == rooms*32-1 {
+			hub.Flush()
+			b.StopTimer()
+			drain(connections)
+			b.StartTimer()
+		}
+	}
+	hub.Flush()
+	b.StopTimer()
+
+	stats := hub.Stats()
+	if stats.Dropped > 0 {
+		b.Fatalf("dropped %d messages", stats.Dropped)
+	}
+	b.ReportMetric(float64(stats.Delivered)/b.Elapsed().Seconds(), "deliveries/s")
+}
+
+// BenchmarkHubBroadcastParallel broadcasts from many goroutines at once, as
+// the Redis listener and the read pumps do, with every connection's buffer
+// drained by its own goroutine, as the write pumps do
+func BenchmarkHubBroadcastParallel(b *testing.B) {
+	if testing.Short() {
+		b.Skip("skipping 100k connection benchmark in short mode")
+	}
+	const conns, rooms = 100000, 10000
+
+	hub, connections := benchHub(b, conns, rooms)
+	defer hub.Stop()
+	var readers sync.WaitGroup
+	for _, conn := range connections {
+		readers.Add(1)
+		go func(conn *Connection) {
+			defer readers.Done()
+			for range conn.Send {
+				conn.Refill()
+			}
+		}(conn)
+	}
+	msg := Outbound{Data: []byte(`{"type":"message","content":"hello"}`)}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			hub.Broadcast(fmt.Sprintf("room-%d", i%rooms), msg, nil)
+			i++
+		}
+	})
+	hub.Flush()
+	b.StopTimer()
+
+	stats := hub.Stats()
+	b.ReportMetric(float64(stats.Delivered)/b.Elapsed().Seconds(), "deliveries/s")
+	b.ReportMetric(float64(stats.Dropped), "dropped")
+
+	for _, conn := range connections {
+		hub.Unregister(conn)
+	}
+	readers.Wait()
+}
+
+// BenchmarkHubSubscribe measures subscription churn with 100k connections
+// already subscribed
+func BenchmarkHubSubscribe(b *testing.B) {
+	if testing.Short() {
+		b.Skip("skipping 100k connection benchmark in short mode")
+	}
+	const conns, rooms = 100000, 10000
+
+	hub, connections := benchHub(b, conns, rooms)
+	defer hub.Stop()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			conn := connections[i%conns]
+			room := fmt.Sprintf("room-extra-%d", i%rooms)
+			if err := hub.Subscribe(conn, room, 0); err != nil {
+				b.Error(err)
+				return
+			}
+			hub.Unsubscribe(conn, room)
+			i++
+		}
+	})
+}
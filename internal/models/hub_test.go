@@ -0,0 +1,122 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHubSubscriptions(t *testing.T) {
+	hub := NewHub(HubConfig{})
+	defer hub.Stop()
+	a := NewConnection("user-1", "alice", "", nil, hub)
+	b := NewConnection("user-2", "bob", "", nil, hub)
+
+	assert.NoError(t, hub.Subscribe(a, "room-1", 2))
+	assert.NoError(t, hub.Subscribe(a, "room-1", 2)) // no-op
+	assert.NoError(t, hub.Subscribe(a, "room-2", 2))
+	assert.Equal(t, ErrTooManySubscriptions, hub.Subscribe(a, "room-3", 2))
+	assert.NoError(t, hub.Subscribe(b, "room-1", 0))
+
+	assert.ElementsMatch(t, []*Connection{a, b}, hub.RoomConnections("room-1"))
+	assert.ElementsMatch(t, []*Connection{a}, hub.RoomConnections("room-2"))
+	assert.Empty(t, hub.RoomConnections("room-3"))
+	assert.ElementsMatch(t, []string{"room-1", "room-2"}, hub.Subscriptions(a))
+
+	assert.True(t, hub.Unsubscribe(a, "room-1"))
+	assert.False(t, hub.Unsubscribe(a, "room-1"))
+	assert.False(t, hub.Subscribed(a, "room-1"))
+	assert.ElementsMatch(t, []*Connection{b}, hub.RoomConnections("room-1"))
+	assert.NoError(t, hub.Subscribe(a, "room-3", 2))
+}
+
+func TestHubBroadcast(t *testing.T) {
+	hub := NewHub(HubConfig{Shards: 4})
+	defer hub.Stop()
+
+	a := NewConnection("user-1", "alice", "", nil, hub)
+	b := NewConnection("user-2", "bob", "", nil, hub)
+	hub.Register(a)
+	hub.Register(b)
+	assert.NoError(t, hub.Subscribe(a, "room-1", 0))
+	assert.NoError(t, hub.Subscribe(b, "room-1", 0))
+
+	for i := 0; i < 10; i++ {
+		i := i
+		hub.Broadcast("room-1", Outbound{Data: []byte{byte(i)}}, func(conn *Connection) bool {
+			return conn != b || i%2 == 0
+		})
+	}
+	hub.Flush()
+
+	// Messages arrive in the order they were broadcast
+	assert.Len(t, a.Send, 10)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []byte{byte(i)}, <-a.Send)
+	}
+	assert.Len(t, b.Send, 5)
+	for i := 0; i < 10; i += 2 {
+		assert.Equal(t, []byte{byte(i)}, <-b.Send)
+	}
+
+	hub.SendToUser("user-2", Outbound{Data: []byte("direct")})
+	hub.Flush()
+	assert.Equal(t, []byte("direct"), <-b.Send)
+	assert.Empty(t, a.Send)
+
+	stats := hub.Stats()
+	assert.Equal(t, int64(2), stats.Connections)
+	assert.Equal(t, 1, stats.Rooms)
+	assert.Equal(t, 2, stats.Subscriptions)
+	assert.Equal(t, uint64(16), stats.Delivered)
+}
+
+func TestHubOverflow(t *testing.T) {
+	var overflowed []*Connection
+	hub := NewHub(HubConfig{SendBuffer: 2, BacklogBytes: 10, Overflow: func(conn *Connection) {
+		overflowed = append(overflowed, conn)
+	}})
+	defer hub.Stop()
+
+	conn := NewConnection("user-1", "alice", "", nil, hub)
+	hub.Register(conn)
+	assert.NoError(t, hub.Subscribe(conn, "room-1", 0))
+	for i := 0; i < 6; i++ {
+		hub.Broadcast("room-1", Outbound{Data: []byte("hello")}, nil)
+	}
+	hub.Flush()
+
+	// Two messages fit in Send and two in the backlog; overflow is reported
+	// once however many messages are dropped after that
+	assert.Equal(t, []*Connection{conn}, overflowed)
+	assert.Len(t, conn.Send, 2)
+	stats := hub.Stats()
+	assert.Equal(t, uint64(4), stats.Delivered)
+	assert.Equal(t, uint64(2), stats.Dropped)
+	assert.Equal(t, uint64(1), stats.Overflowed)
+	assert.Equal(t, 2, stats.MaxSendDepth)
+	assert.Equal(t, int64(0), stats.BacklogBytes)
+}
+
+func TestHubUnregister(t *testing.T) {
+	hub := NewHub(HubConfig{})
+	defer hub.Stop()
+
+	conn := NewConnection("user-1", "alice", "", nil, hub)
+	hub.Register(conn)
+	assert.NoError(t, hub.Subscribe(conn, "room-1", 0))
+
+	hub.Unregister(conn)
+	hub.Unregister(conn) // closes Send only once
+	_, open := <-conn.Send
+	assert.False(t, open)
+
+	assert.False(t, conn.Enqueue([]byte("hello")))
+	assert.Equal(t, errConnectionClosed, hub.Subscribe(conn, "room-2", 0))
+	hub.Broadcast("room-1", Outbound{Data: []byte("hello")}, nil)
+	hub.Flush()
+
+	assert.Empty(t, hub.RoomConnections("room-1"))
+	assert.Empty(t, hub.UserConnections("user-1"))
+	assert.Equal(t, int64(0), hub.Stats().Connections)
+}
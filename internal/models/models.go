@@ -2,7 +2,6 @@ package models
 
 import (
 	"time"
-	"github.com/google/uuid"
 )
 
 // User represents a chat user
@@ -19,90 +18,138 @@ type User struct {
 
 // Message represents a chat message
 type Message struct {
-	ID          string            `json:"id" db:"id"`
-	UserID      string            `json:"user_id" db:"user_id"`
-	Username    string            `json:"username" db:"username"`
-	RoomID      string            `json:"room_id" db:"room_id"`
-	Content     string            `json:"content" db:"content"`
-	MessageType string            `json:"message_type" db:"message_type"` // text, image, file
-	Timestamp   time.Time         `json:"timestamp" db:"timestamp"`
-	Metadata    map[string]string `json:"metadata" db:"metadata"`
-	CreatedAt   time.Time         `json:"created_at" db:"created_at"`
+	ID           string            `json:"id" db:"id"`
+	UserID       string            `json:"user_id" db:"user_id"`
+	Username     string            `json:"username" db:"username"`
+	RoomID       string            `json:"room_id" db:"room_id"`
+	Content      string            `json:"content" db:"content"`
+	MessageType  string            `json:"message_type" db:"message_type"` // text, image, file
+	Timestamp    time.Time         `json:"timestamp" db:"timestamp"`
+	Metadata     map[string]string `json:"metadata" db:"metadata"`
+	CreatedAt    time.Time         `json:"created_at" db:"created_at"`
+	EditedAt     *time.Time        `json:"edited_at,omitempty" db:"edited_at"`
+	DeletedAt    *time.Time        `json:"deleted_at,omitempty" db:"deleted_at"` // tombstone: content is cleared
+	DeletedBy    *string           `json:"deleted_by,omitempty" db:"deleted_by"`
+	ParentID     *string           `json:"parent_id,omitempty" db:"parent_id"`
+	ThreadRootID *string           `json:"thread_root_id,omitempty" db:"thread_root_id"` // set on replies
+	ReplyCount   int               `json:"reply_count,omitempty" db:"-"`                 // set on thread roots
+	LastReplyAt  *time.Time        `json:"last_reply_at,omitempty" db:"-"`
+	Reactions    []ReactionCount   `json:"reactions,omitempty" db:"-"`
+	ClientMsgID  string            `json:"client_msg_id,omitempty" db:"client_msg_id"` // sender's idempotency key
+	Seq          int64             `json:"seq" db:"seq"`                               // position in the room, from 1
+}
+
+// MessageRevision is a prior version of an edited message
+type MessageRevision struct {
+	ID        string    `json:"id" db:"id"`
+	MessageID string    `json:"message_id" db:"message_id"`
+	Content   string    `json:"content" db:"content"`
+	EditedBy  string    `json:"edited_by" db:"edited_by"`
+	EditedAt  time.Time `json:"edited_at" db:"edited_at"`
+}
+
+// Reaction is one user's emoji reaction to a message
+type Reaction struct {
+	MessageID string    `json:"message_id" db:"message_id"`
+	UserID    string    `json:"user_id" db:"user_id"`
+	Username  string    `json:"username" db:"-"`
+	Emoji     string    `json:"emoji" db:"emoji"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// ReadCursor is how far a user has read in a room
+type ReadCursor struct {
+	RoomID      string     `json:"room_id" db:"room_id"`
+	UserID      string     `json:"user_id" db:"user_id"`
+	LastReadID  *string    `json:"last_read_id" db:"last_read_id"`
+	LastReadAt  *time.Time `json:"last_read_at" db:"last_read_at"` // timestamp of the last read message
+	UpdatedAt   *time.Time `json:"updated_at,omitempty" db:"updated_at"`
+	UnreadCount int        `json:"unread_count" db:"-"`
+}
+
+// Mention is a message that mentioned a user, as listed in their inbox
+type Mention struct {
+	Message   Message    `json:"message"`
+	RoomName  string     `json:"room_name"`
+	Kind      string     `json:"kind"` // user, here, room
+	Read      bool       `json:"read"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ReactionCount aggregates the reactions with one emoji on a message
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Me    bool   `json:"me"` // the viewer is among the reactors
 }
 
 // Room represents a chat room
 type Room struct {
-	ID          string    `json:"id" db:"id"`
-	Name        string    `json:"name" db:"name"`
-	Description string    `json:"description" db:"description"`
-	IsPrivate   bool      `json:"is_private" db:"is_private"`
-	CreatedBy   string    `json:"created_by" db:"created_by"`
-	CreatedAt   time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+	ID          string     `json:"id" db:"id"`
+	Name        string     `json:"name" db:"name"`
+	Description string     `json:"description" db:"description"`
+	IsPrivate   bool       `json:"is_private" db:"is_private"`
+	CreatedBy   string     `json:"created_by" db:"created_by"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
+	ArchivedAt  *time.Time `json:"archived_at,omitempty" db:"archived_at"`
+	LastReadID  *string    `json:"last_read_id,omitempty" db:"-"`
+	UnreadCount int        `json:"unread_count" db:"-"` // see messages.MaxUnreadCount
 }
 
-// Connection represents a WebSocket connection
-type Connection struct {
-	ID       string          `json:"id"`
-	UserID   string          `json:"user_id"`
-	Username string          `json:"username"`
-	RoomID   string          `json:"room_id"`
-	Conn     interface{}     `json:"-"` // WebSocket connection
-	Send     chan []byte     `json:"-"`
-	Hub      *Hub            `json:"-"`
+// DirectMessage is a 1:1 or small-group conversation. It is stored as a
+// private room of kind 'dm', unique per set of participants.
+type DirectMessage struct {
+	ID             string       `json:"id"`
+	Participants   []RoomMember `json:"participants"`
+	CreatedAt      time.Time    `json:"created_at"`
+	LastActivityAt time.Time    `json:"last_activity_at"`
 }
 
-// Hub manages all WebSocket connections
-type Hub struct {
-	Connections map[string]*Connection
-	Broadcast   chan []byte
-	Register    chan *Connection
-	Unregister  chan *Connection
+// RoomMember represents a user's membership and role in a room
+type RoomMember struct {
+	RoomID   string    `json:"room_id" db:"room_id"`
+	UserID   string    `json:"user_id" db:"user_id"`
+	Username string    `json:"username" db:"username"`
+	Role     string    `json:"role" db:"role"` // owner, admin, moderator, member
+	JoinedAt time.Time `json:"joined_at" db:"joined_at"`
 }
 
-// NewConnection creates a new connection
-func NewConnection(userID, username, roomID string, conn interface{}, hub *Hub) *Connection {
-	return &Connection{
-		ID:       uuid.New().String(),
-		UserID:   userID,
-		Username: username,
-		RoomID:   roomID,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
-		Hub:      hub,
-	}
+// Invitation represents a pending or answered invitation to a room
+type Invitation struct {
+	ID              string     `json:"id" db:"id"`
+	RoomID          string     `json:"room_id" db:"room_id"`
+	RoomName        string     `json:"room_name" db:"-"`
+	InviterID       string     `json:"inviter_id" db:"inviter_id"`
+	InviterUsername string     `json:"inviter_username" db:"-"`
+	InviteeID       string     `json:"invitee_id" db:"invitee_id"`
+	Status          string     `json:"status" db:"status"` // pending, accepted, declined
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+	RespondedAt     *time.Time `json:"responded_at,omitempty" db:"responded_at"`
 }
 
-// NewHub creates a new hub
-func NewHub() *Hub {
-	return &Hub{
-		Connections: make(map[string]*Connection),
-		Broadcast:   make(chan []byte),
-		Register:    make(chan *Connection),
-		Unregister:  make(chan *Connection),
-	}
+// InviteLink represents a shareable room invite code
+type InviteLink struct {
+	Code      string     `json:"code" db:"code"`
+	RoomID    string     `json:"room_id" db:"room_id"`
+	CreatedBy string     `json:"created_by" db:"created_by"`
+	MaxUses   int        `json:"max_uses" db:"max_uses"` // 0 means unlimited
+	Uses      int        `json:"uses" db:"uses"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
 }
 
-// Run starts the hub
-func (h *Hub) Run() {
-	for {
-		select {
-		case conn := <-h.Register:
-			h.Connections[conn.ID] = conn
-		case conn := <-h.Unregister:
-			if _, ok := h.Connections[conn.ID]; ok {
-				delete(h.Connections, conn.ID)
-				close(conn.Send)
-			}
-		case message := <-h.Broadcast:
-			for _, conn := range h.Connections {
-				select {
-				case conn.Send <- message:
-				default:
-					close(conn.Send)
-					delete(h.Connections, conn.ID)
-				}
-			}
-		}
-	}
+// Session represents a signed-in device, i.e. one refresh-token family
+type Session struct {
+	ID         string     `json:"id" db:"id"`
+	UserID     string     `json:"user_id" db:"user_id"`
+	UserAgent  string     `json:"user_agent" db:"user_agent"`
+	IPAddress  string     `json:"ip_address" db:"ip_address"`
+	Current    bool       `json:"current" db:"-"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at" db:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at" db:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" db:"revoked_at"`
 }
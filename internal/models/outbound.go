@@ -0,0 +1,149 @@
+package models
+
+// Class says what happens to a message for a connection that has fallen
+// behind, that is whose Send is full or past its ephemeral limit
+type Class int
+
+const (
+	// ClassReliable messages are held back up to the backlog budget; a
+	// connection that goes over it is dropped and must resume
+	ClassReliable Class = iota
+	// ClassCoalesce messages are held back like reliable ones, but replace
+	// a held back message with the same key instead of queueing behind it
+	ClassCoalesce
+	// ClassEphemeral messages are dropped
+	ClassEphemeral
+)
+
+// Outbound is a message for a connection's writer
+type Outbound struct {
+	Data  []byte
+	Class Class
+	Key   string // what a ClassCoalesce message replaces
+}
+
+// offerResult is what became of an offered message
+type offerResult int
+
+const (
+	queued     offerResult = iota // in Send
+	backlogged                    // held back until Send has room
+	replaced                      // took the place of a held back message
+	dropped
+	overflowed // dropped, and the connection went over its backlog budget
+)
+
+// pending is a held back message
+type pending struct {
+	data []byte
+	key  string
+}
+
+// Offer hands msg to the connection's writer according to its class. It
+// returns false if the message was dropped.
+func (c *Connection) Offer(msg Outbound) bool {
+	switch c.offer(msg) {
+	case queued, backlogged, replaced:
+		return true
+	default:
+		return false
+	}
+}
+
+// Enqueue offers data as a reliable message
+func (c *Connection) Enqueue(data []byte) bool {
+	return c.Offer(Outbound{Data: data})
+}
+
+func (c *Connection) offer(msg Outbound) offerResult {
+	result := c.place(msg)
+	if result == overflowed && c.config.Overflow != nil {
+		c.config.Overflow(c)
+	}
+	return result
+}
+
+// place queues msg, or holds it back behind what is already held back so
+// messages keep their order
+func (c *Connection) place(msg Outbound) offerResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.overflowed.Load() {
+		return dropped
+	}
+
+	if len(c.backlog) == 0 {
+		if msg.Class == ClassEphemeral && len(c.Send) >= c.config.EphemeralLimit {
+			return dropped
+		}
+		select {
+		case c.Send <- msg.Data:
+			return queued
+		default:
+		}
+	}
+
+	if msg.Class == ClassEphemeral {
+		return dropped
+	}
+	if msg.Class == ClassCoalesce {
+		if held := c.coalescing[msg.Key]; held != nil {
+			c.backlogBytes.Add(int64(len(msg.Data) - len(held.data)))
+			held.data = msg.Data
+			return replaced
+		}
+	}
+
+	if c.backlogBytes.Load()+int64(len(msg.Data)) > int64(c.config.BacklogBytes) {
+		c.overflowed.Store(true)
+		c.clearBacklog()
+		return overflowed
+	}
+
+	held := &pending{data: msg.Data}
+	if msg.Class == ClassCoalesce {
+		held.key = msg.Key
+		if c.coalescing == nil {
+			c.coalescing = make(map[string]*pending)
+		}
+		c.coalescing[msg.Key] = held
+	}
+	c.backlog = append(c.backlog, held)
+	c.backlogBytes.Add(int64(len(msg.Data)))
+	return backlogged
+}
+
+// Refill moves held back messages into Send as far as it has room. The
+// writer calls it after each message it takes from Send.
+func (c *Connection) Refill() {
+	if c.backlogBytes.Load() == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.backlog) > 0 && !c.closed {
+		held := c.backlog[0]
+		select {
+		case c.Send <- held.data:
+		default:
+			return
+		}
+
+		c.backlog[0] = nil
+		c.backlog = c.backlog[1:]
+		c.backlogBytes.Add(-int64(len(held.data)))
+		if held.key != "" {
+			delete(c.coalescing, held.key)
+		}
+	}
+}
+
+// clearBacklog drops what is held back. The caller holds c.mu.
+func (c *Connection) clearBacklog() {
+	c.backlog = nil
+	c.coalescing = nil
+	c.backlogBytes.Store(0)
+}
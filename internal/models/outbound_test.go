@@ -0,0 +1,58 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionOffer(t *testing.T) {
+	conn := NewConnection("user-1", "alice", "", nil, nil)
+	conn.config = HubConfig{SendBuffer: 4, EphemeralLimit: 2, BacklogBytes: 100}.withDefaults()
+	conn.Send = make(chan []byte, 4)
+
+	reliable := func(data string) Outbound { return Outbound{Data: []byte(data)} }
+	typing := Outbound{Data: []byte("typing"), Class: ClassEphemeral}
+	read := func(data string) Outbound {
+		return Outbound{Data: []byte(data), Class: ClassCoalesce, Key: "read:user-2"}
+	}
+
+	// Ephemeral messages are dropped once the queue reaches its limit
+	assert.True(t, conn.Offer(typing))
+	assert.True(t, conn.Enqueue([]byte("m1")))
+	assert.False(t, conn.Offer(typing))
+
+	// Once Send is full, the rest is held back, coalesced by key
+	assert.True(t, conn.Offer(reliable("m2")))
+	assert.True(t, conn.Offer(reliable("m3")))
+	assert.True(t, conn.Offer(read("r1")))
+	assert.True(t, conn.Offer(reliable("m4")))
+	assert.True(t, conn.Offer(read("r2")))
+	assert.False(t, conn.Offer(typing))
+	assert.Equal(t, int64(4), conn.backlogBytes.Load())
+
+	var got []string
+	for len(got) < 6 {
+		got = append(got, string(<-conn.Send))
+		conn.Refill()
+	}
+	assert.Equal(t, []string{"typing", "m1", "m2", "m3", "r2", "m4"}, got)
+	assert.Equal(t, int64(0), conn.backlogBytes.Load())
+}
+
+func TestConnectionOfferOverflow(t *testing.T) {
+	var overflowed int
+	conn := NewConnection("user-1", "alice", "", nil, nil)
+	conn.config = HubConfig{SendBuffer: 1, BacklogBytes: 4, Overflow: func(*Connection) {
+		overflowed++
+	}}.withDefaults()
+	conn.Send = make(chan []byte, 1)
+
+	assert.True(t, conn.Enqueue([]byte("m1")))
+	assert.True(t, conn.Enqueue([]byte("m2")))
+	assert.True(t, conn.Enqueue([]byte("m3")))
+	assert.False(t, conn.Enqueue([]byte("m4")))
+	assert.False(t, conn.Enqueue([]byte("m5")))
+	assert.Equal(t, 1, overflowed)
+	assert.Equal(t, int64(0), conn.backlogBytes.Load())
+}
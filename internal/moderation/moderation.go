@@ -0,0 +1,334 @@
+package moderation
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+	"chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidRole   = errors.New("invalid role")
+	ErrNotMember     = errors.New("user is not a member of this room")
+	ErrCannotTarget  = errors.New("cannot moderate a member with an equal or higher role")
+	ErrCannotPromote = errors.New("cannot grant a role equal to or higher than your own")
+)
+
+// Moderation actions, sent as metadata["action"] on system events
+const (
+	ActionRoleChanged = "role_changed"
+	ActionKick        = "kick"
+	ActionBan         = "ban"
+	ActionUnban       = "unban"
+	ActionMute        = "mute"
+	ActionUnmute      = "unmute"
+)
+
+// Service applies role changes, kicks, bans and mutes. Every action is
+// checked against the actor's role through the authorizer and announced to
+// the room as a system event.
+type Service struct {
+	db     *database.DB
+	broker broker.Broker
+	authz  *authz.Authorizer
+}
+
+// NewService creates a new moderation service
+func NewService(db *database.DB, broker broker.Broker, authorizer *authz.Authorizer) *Service {
+	return &Service{
+		db:     db,
+		broker: broker,
+		authz:  authorizer,
+	}
+}
+
+// ListMembers returns the members of a room with their roles
+func (s *Service) ListMembers(ctx context.Context, roomID, userID string) ([]models.RoomMember, error) {
+	if err := s.authz.CanAccessRoom(ctx, userID, roomID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT rm.room_id, rm.user_id, u.username, COALESCE(rm.role, 'member'), rm.joined_at
+			  FROM room_members rm
+			  JOIN users u ON u.id = rm.user_id
+			  WHERE rm.room_id = $1
+			  ORDER BY rm.joined_at`
+
+	rows, err := s.db.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []models.RoomMember{}
+	for rows.Next() {
+		var member models.RoomMember
+		if err := rows.Scan(&member.RoomID, &member.UserID, &member.Username, &member.Role, &member.JoinedAt); err != nil {
+			continue
+		}
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// SetRole changes a member's role. The actor must outrank both the target's
+// current role and the new one; ownership cannot be granted this way.
+func (s *Service) SetRole(ctx context.Context, roomID, actorID, targetID, role string) error {
+	if !authz.ValidRole(role) || role == authz.RoleOwner {
+		return ErrInvalidRole
+	}
+
+	actor, target, err := s.checkTarget(ctx, roomID, actorID, targetID, authz.PermManageRoles)
+	if err != nil {
+		return err
+	}
+	if !target.IsMember {
+		return ErrNotMember
+	}
+	if !authz.Outranks(actor.EffectiveRole(), role) {
+		return ErrCannotPromote
+	}
+
+	query := `UPDATE room_members SET role = $3 WHERE room_id = $1 AND user_id = $2`
+	if _, err := s.db.ExecContext(ctx, query, roomID, targetID, role); err != nil {
+		return fmt.Errorf("error updating role: %v", err)
+	}
+	s.authz.Invalidate(ctx, roomID, targetID)
+
+	s.announce(ctx, roomID, actorID, targetID, ActionRoleChanged, map[string]interface{}{"role": role})
+	return nil
+}
+
+// Kick removes a member from the room. They may rejoin public rooms or
+// private rooms they are invited to again.
+func (s *Service) Kick(ctx context.Context, roomID, actorID, targetID string) error {
+	_, target, err := s.checkTarget(ctx, roomID, actorID, targetID, authz.PermKick)
+	if err != nil {
+		return err
+	}
+	if !target.IsMember {
+		return ErrNotMember
+	}
+
+	if err := s.removeMember(ctx, s.db, roomID, targetID); err != nil {
+		return err
+	}
+	s.authz.Invalidate(ctx, roomID, targetID)
+
+	s.announce(ctx, roomID, actorID, targetID, ActionKick, nil)
+	return nil
+}
+
+// Ban removes a user from the room and keeps them out until the ban expires.
+// A zero duration bans permanently.
+func (s *Service) Ban(ctx context.Context, roomID, actorID, targetID string, duration time.Duration, reason string) error {
+	if _, _, err := s.checkTarget(ctx, roomID, actorID, targetID, authz.PermBan); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	expiresAt := expiry(duration)
+	query := `INSERT INTO room_bans (room_id, user_id, banned_by, reason, expires_at, created_at)
+			  VALUES ($1, $2, $3, $4, $5, NOW())
+			  ON CONFLICT (room_id, user_id)
+			  DO UPDATE SET banned_by = EXCLUDED.banned_by, reason = EXCLUDED.reason,
+			  expires_at = EXCLUDED.expires_at, created_at = NOW()`
+	if _, err := tx.ExecContext(ctx, query, roomID, targetID, actorID, reason, expiresAt); err != nil {
+		return fmt.Errorf("error banning user: %v", err)
+	}
+
+	if err := s.removeMember(ctx, tx, roomID, targetID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.authz.Invalidate(ctx, roomID, targetID)
+
+	s.announce(ctx, roomID, actorID, targetID, ActionBan, map[string]interface{}{
+		"reason":     reason,
+		"expires_at": unixOrZero(expiresAt),
+	})
+	return nil
+}
+
+// Unban lifts a ban
+func (s *Service) Unban(ctx context.Context, roomID, actorID, targetID string) error {
+	if _, _, err := s.checkTarget(ctx, roomID, actorID, targetID, authz.PermBan); err != nil {
+		return err
+	}
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM room_bans WHERE room_id = $1 AND user_id = $2`, roomID, targetID); err != nil {
+		return fmt.Errorf("error unbanning user: %v", err)
+	}
+	s.authz.Invalidate(ctx, roomID, targetID)
+
+	s.announce(ctx, roomID, actorID, targetID, ActionUnban, nil)
+	return nil
+}
+
+// Mute stops a user from posting until the mute expires. A zero duration
+// mutes permanently.
+func (s *Service) Mute(ctx context.Context, roomID, actorID, targetID string, duration time.Duration) error {
+	if _, _, err := s.checkTarget(ctx, roomID, actorID, targetID, authz.PermMute); err != nil {
+		return err
+	}
+
+	expiresAt := expiry(duration)
+	query := `INSERT INTO room_mutes (room_id, user_id, muted_by, expires_at, created_at)
+			  VALUES ($1, $2, $3, $4, NOW())
+			  ON CONFLICT (room_id, user_id)
+			  DO UPDATE SET muted_by = EXCLUDED.muted_by, expires_at = EXCLUDED.expires_at, created_at = NOW()`
+	if _, err := s.db.ExecContext(ctx, query, roomID, targetID, actorID, expiresAt); err != nil {
+		return fmt.Errorf("error muting user: %v", err)
+	}
+	s.authz.Invalidate(ctx, roomID, targetID)
+
+	s.announce(ctx, roomID, actorID, targetID, ActionMute, map[string]interface{}{
+		"expires_at": unixOrZero(expiresAt),
+	})
+	return nil
+}
+
+// Unmute lifts a mute
+func (s *Service) Unmute(ctx context.Context, roomID, actorID, targetID string) error {
+	if _, _, err := s.checkTarget(ctx, roomID, actorID, targetID, authz.PermMute); err != nil {
+		return err
+	}
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM room_mutes WHERE room_id = $1 AND user_id = $2`, roomID, targetID); err != nil {
+		return fmt.Errorf("error unmuting user: %v", err)
+	}
+	s.authz.Invalidate(ctx, roomID, targetID)
+
+	s.announce(ctx, roomID, actorID, targetID, ActionUnmute, nil)
+	return nil
+}
+
+// checkTarget verifies the actor holds perm and strictly outranks the target
+func (s *Service) checkTarget(ctx context.Context, roomID, actorID, targetID string, perm authz.Permission) (*authz.Membership, *authz.Membership, error) {
+	if err := s.authz.Authorize(ctx, actorID, roomID, perm); err != nil {
+		return nil, nil, err
+	}
+
+	actor, err := s.authz.Membership(ctx, actorID, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	target, err := s.authz.Membership(ctx, targetID, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if actorID == targetID || !authz.Outranks(actor.EffectiveRole(), target.EffectiveRole()) {
+		return nil, nil, ErrCannotTarget
+	}
+
+	return actor, target, nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *Service) removeMember(ctx context.Context, db execer, roomID, userID string) error {
+	if _, err := db.ExecContext(ctx, `DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`, roomID, userID); err != nil {
+		return fmt.Errorf("error removing room member: %v", err)
+	}
+	return nil
+}
+
+// announce publishes a moderation system event to the room. Targets who are
+// out of the room after a kick, ban or unban hear about it on their own
+// channel instead; connections still subscribed get only that copy.
+func (s *Service) announce(ctx context.Context, roomID, actorID, targetID, action string, extra map[string]interface{}) {
+	var actorName, targetName string
+	s.db.QueryRowContext(ctx, `SELECT username FROM users WHERE id = $1`, actorID).Scan(&actorName)
+	s.db.QueryRowContext(ctx, `SELECT username FROM users WHERE id = $1`, targetID).Scan(&targetName)
+
+	metadata := map[string]interface{}{
+		"action":    action,
+		"actor_id":  actorID,
+		"target_id": targetID,
+	}
+	for k, v := range extra {
+		metadata[k] = v
+	}
+
+	event := map[string]interface{}{
+		"type":       "system",
+		"user_id":    "system",
+		"username":   "System",
+		"room_id":    roomID,
+		"content":    describe(action, actorName, targetName, extra),
+		"message_id": uuid.New().String(),
+		"timestamp":  time.Now().Unix(),
+		"metadata":   metadata,
+	}
+
+	channels := []string{fmt.Sprintf("room:%s", roomID)}
+	if RemovesTarget(action) || action == ActionUnban {
+		channels = append(channels, fmt.Sprintf("user:%s", targetID))
+	}
+	for _, channel := range channels {
+		if err := s.broker.Publish(ctx, channel, event); err != nil {
+			log.Printf("Error publishing moderation event: %v", err)
+		}
+	}
+}
+
+// RemovesTarget reports whether a moderation action takes its target out
+// of the room
+func RemovesTarget(action string) bool {
+	return action == ActionKick || action == ActionBan
+}
+
+func describe(action, actor, target string, extra map[string]interface{}) string {
+	switch action {
+	case ActionRoleChanged:
+		return fmt.Sprintf("%s made %s %s", actor, target, extra["role"])
+	case ActionKick:
+		return fmt.Sprintf("%s removed %s from the room", actor, target)
+	case ActionBan:
+		return fmt.Sprintf("%s banned %s", actor, target)
+	case ActionUnban:
+		return fmt.Sprintf("%s unbanned %s", actor, target)
+	case ActionMute:
+		return fmt.Sprintf("%s muted %s", actor, target)
+	case ActionUnmute:
+		return fmt.Sprintf("%s unmuted %s", actor, target)
+	default:
+		return fmt.Sprintf("%s moderated %s", actor, target)
+	}
+}
+
+func expiry(duration time.Duration) *time.Time {
+	if duration <= 0 {
+		return nil
+	}
+	t := time.Now().Add(duration)
+	return &t
+}
+
+func unixOrZero(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,109 @@
+//go:build integration
+
+package moderation
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+	"chat-app/internal/testdb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fixture struct {
+	s    *Service
+	db   *database.DB
+	room string
+
+	owner, admin, moderator, member string
+}
+
+// setup creates a public room with a member of every role
+func setup(t *testing.T) *fixture {
+	db := testdb.DB(t)
+	client := testdb.Redis(t)
+
+	f := &fixture{s: NewService(db, broker.NewMemory(), authz.NewAuthorizer(db, client)), db: db}
+	f.owner, f.admin, f.moderator, f.member = testdb.User(t, db), testdb.User(t, db), testdb.User(t, db), testdb.User(t, db)
+	f.room = testdb.Room(t, db, f.owner, false)
+	testdb.Join(t, db, f.room, f.admin, authz.RoleAdmin)
+	testdb.Join(t, db, f.room, f.moderator, authz.RoleModerator)
+	testdb.Join(t, db, f.room, f.member, authz.RoleMember)
+	return f
+}
+
+func TestModeratorsCannotTargetHigherRoles(t *testing.T) {
+	ctx := context.Background()
+	f := setup(t)
+
+	for _, target := range []string{f.admin, f.owner} {
+		assert.Equal(t, ErrCannotTarget, f.s.Kick(ctx, f.room, f.moderator, target))
+		assert.Equal(t, ErrCannotTarget, f.s.Mute(ctx, f.room, f.moderator, target, time.Hour))
+	}
+	assert.Equal(t, ErrCannotTarget, f.s.Kick(ctx, f.room, f.moderator, f.moderator))
+	assert.Equal(t, authz.ErrNotPermitted, f.s.Ban(ctx, f.room, f.moderator, f.member, 0, ""))
+
+	// Admins outrank moderators but not owners, and cannot make peers
+	assert.Equal(t, ErrCannotTarget, f.s.Ban(ctx, f.room, f.admin, f.owner, 0, ""))
+	assert.Equal(t, ErrCannotPromote, f.s.SetRole(ctx, f.room, f.admin, f.member, authz.RoleAdmin))
+	assert.NoError(t, f.s.Kick(ctx, f.room, f.admin, f.moderator))
+}
+
+func TestLiftingNeedsRank(t *testing.T) {
+	ctx := context.Background()
+	f := setup(t)
+
+	// Only someone who could have imposed a mute may lift it
+	require.NoError(t, f.s.Mute(ctx, f.room, f.owner, f.admin, 0))
+	assert.Equal(t, ErrCannotTarget, f.s.Unmute(ctx, f.room, f.moderator, f.admin))
+	assert.Equal(t, authz.ErrMuted, f.s.authz.Authorize(ctx, f.admin, f.room, authz.PermPost))
+	require.NoError(t, f.s.Unmute(ctx, f.room, f.owner, f.admin))
+
+	require.NoError(t, f.s.Ban(ctx, f.room, f.admin, f.member, 0, ""))
+	assert.Equal(t, ErrCannotTarget, f.s.Unban(ctx, f.room, f.admin, f.admin))
+	assert.Equal(t, authz.ErrNotPermitted, f.s.Unban(ctx, f.room, f.moderator, f.member))
+	require.NoError(t, f.s.Unban(ctx, f.room, f.admin, f.member))
+}
+
+func TestMuteExpires(t *testing.T) {
+	ctx := context.Background()
+	f := setup(t)
+
+	require.NoError(t, f.s.Mute(ctx, f.room, f.moderator, f.member, time.Second))
+	assert.Equal(t, authz.ErrMuted, f.s.authz.Authorize(ctx, f.member, f.room, authz.PermPost))
+
+	// The cached membership holds the expiry, so the mute lapses without
+	// anyone lifting it
+	time.Sleep(2 * time.Second)
+	assert.NoError(t, f.s.authz.Authorize(ctx, f.member, f.room, authz.PermPost))
+
+	require.NoError(t, f.s.Mute(ctx, f.room, f.moderator, f.member, 0))
+	assert.Equal(t, authz.ErrMuted, f.s.authz.Authorize(ctx, f.member, f.room, authz.PermPost))
+	require.NoError(t, f.s.Unmute(ctx, f.room, f.moderator, f.member))
+	assert.NoError(t, f.s.authz.Authorize(ctx, f.member, f.room, authz.PermPost))
+}
+
+func TestBanRemovesMember(t *testing.T) {
+	ctx := context.Background()
+	f := setup(t)
+
+	// Cache the member's access before the ban
+	require.NoError(t, f.s.authz.Authorize(ctx, f.member, f.room, authz.PermPost))
+
+	require.NoError(t, f.s.Ban(ctx, f.room, f.admin, f.member, 0, "spam"))
+	assert.Equal(t, authz.ErrBanned, f.s.authz.Authorize(ctx, f.member, f.room, authz.PermRead))
+
+	var isMember bool
+	query := `SELECT EXISTS(SELECT 1 FROM room_members WHERE room_id = $1 AND user_id = $2)`
+	require.NoError(t, f.db.QueryRow(query, f.room, f.member).Scan(&isMember))
+	assert.False(t, isMember)
+
+	require.NoError(t, f.s.Unban(ctx, f.room, f.admin, f.member))
+	assert.NoError(t, f.s.authz.Authorize(ctx, f.member, f.room, authz.PermRead))
+}
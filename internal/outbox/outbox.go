@@ -0,0 +1,235 @@
+// Package outbox publishes events that must not be lost. Events are
+// written to the outbox table in the transaction that stores what they
+// announce, and a relay publishes them to the broker afterwards, retrying
+// until it succeeds. Delivery is at least once: subscribers may see an
+// event twice and must de-duplicate.
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+
+	"github.com/lib/pq"
+)
+
+// relayLock is the advisory lock held while relaying, so that one relay at
+// a time publishes and events go out in the order they were written
+const relayLock = 0x6f7574626f78 // "outbox"
+
+// Retry bounds after a failed batch, and how long to wait for another
+// instance's relay to finish
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+	busyDelay  = 50 * time.Millisecond
+)
+
+var errBusy = errors.New("another relay is running")
+
+// Write adds an event for channel to the outbox as part of tx
+func Write(ctx context.Context, tx *sql.Tx, channel string, event interface{}) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO outbox (channel, payload) VALUES ($1, $2)`
+	if _, err := tx.ExecContext(ctx, query, channel, payload); err != nil {
+		return fmt.Errorf("error writing outbox: %v", err)
+	}
+	return nil
+}
+
+// Relay publishes outbox events to the broker and marks them delivered
+type Relay struct {
+	db     *database.DB
+	broker broker.Broker
+
+	batch     int
+	interval  time.Duration
+	retention time.Duration
+
+	wake chan struct{}
+}
+
+// NewRelay creates a relay. OUTBOX_BATCH_SIZE caps the events published
+// per transaction (default 100), OUTBOX_POLL_INTERVAL is how often the
+// table is checked for events nobody announced (default 1s) and
+// OUTBOX_RETENTION how long delivered events are kept (default 24h).
+func NewRelay(db *database.DB, broker broker.Broker) *Relay {
+	return &Relay{
+		db:        db,
+		broker:    broker,
+		batch:     getInt("OUTBOX_BATCH_SIZE", 100),
+		interval:  getDuration("OUTBOX_POLL_INTERVAL", time.Second),
+		retention: getDuration("OUTBOX_RETENTION", 24*time.Hour),
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+// Notify tells the relay that events were written, so they are published
+// without waiting for the next poll. It does not block.
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run relays events until ctx is done
+func (r *Relay) Run(ctx context.Context) {
+	poll := time.NewTicker(r.interval)
+	defer poll.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	backoff := minBackoff
+	for {
+		n, err := r.relay(ctx)
+
+		var wait <-chan time.Time
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err == errBusy:
+			wait = time.After(busyDelay)
+		case err != nil:
+			log.Printf("Error relaying outbox, retrying in %s: %v", backoff, err)
+			wait = time.After(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		case n == r.batch:
+			backoff = minBackoff
+			continue
+		default:
+			backoff = minBackoff
+		}
+
+		select {
+		case <-wait:
+		case <-r.wake:
+		case <-poll.C:
+		case <-cleanup.C:
+			r.cleanup(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// relay publishes one batch of undelivered events in order and returns
+// how many it published. A failed publish rolls the batch back, to be
+// retried as a whole; events published before it go out again.
+func (r *Relay) relay(ctx context.Context) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx, `SELECT pg_try_advisory_xact_lock($1)`, relayLock).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked {
+		return 0, errBusy
+	}
+
+	query := `SELECT id, channel, payload FROM outbox
+			  WHERE delivered_at IS NULL
+			  ORDER BY id LIMIT $1`
+	rows, err := tx.QueryContext(ctx, query, r.batch)
+	if err != nil {
+		return 0, err
+	}
+
+	type event struct {
+		id      int64
+		channel string
+		payload json.RawMessage
+	}
+	var events []event
+	for rows.Next() {
+		var e event
+		if err := rows.Scan(&e.id, &e.channel, &e.payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]int64, 0, len(events))
+	for _, e := range events {
+		if err := r.broker.Publish(ctx, e.channel, e.payload); err != nil {
+			r.failed(e.id, err)
+			return 0, err
+		}
+		ids = append(ids, e.id)
+	}
+
+	query = `UPDATE outbox SET delivered_at = NOW(), attempts = attempts + 1 WHERE id = ANY($1)`
+	if _, err := tx.ExecContext(ctx, query, pq.Array(ids)); err != nil {
+		return 0, err
+	}
+	return len(ids), tx.Commit()
+}
+
+// failed records a failed attempt on an event, outside the batch's
+// transaction which is about to roll back
+func (r *Relay) failed(id int64, cause error) {
+	query := `UPDATE outbox SET attempts = attempts + 1, last_error = $2 WHERE id = $1`
+	if _, err := r.db.Exec(query, id, cause.Error()); err != nil {
+		log.Printf("Error recording failed outbox event %d: %v", id, err)
+	}
+}
+
+// cleanup deletes events delivered longer ago than the retention
+func (r *Relay) cleanup(ctx context.Context) {
+	query := `DELETE FROM outbox WHERE delivered_at < $1`
+	result, err := r.db.ExecContext(ctx, query, time.Now().Add(-r.retention))
+	if err != nil {
+		log.Printf("Error cleaning up outbox: %v", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Deleted %d delivered outbox events", n)
+	}
+}
+
+func getInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Invalid integer for %s: %q, using %d", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
+func getDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid duration for %s: %q, using %s", key, value, defaultValue)
+	}
+	return defaultValue
+}
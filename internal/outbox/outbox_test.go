@@ -0,0 +1,175 @@
+//go:build integration
+
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+	"chat-app/internal/testdb"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyBroker fails to publish the events for which fail returns true
+type flakyBroker struct {
+	broker.Broker
+
+	mu   sync.Mutex
+	fail func(channel string, n int) bool
+}
+
+func (b *flakyBroker) Publish(ctx context.Context, channel string, event interface{}) error {
+	var n int
+	json.Unmarshal(event.(json.RawMessage), &n)
+
+	b.mu.Lock()
+	fail := b.fail != nil && b.fail(channel, n)
+	b.mu.Unlock()
+	if fail {
+		return errors.New("broker unavailable")
+	}
+	return b.Broker.Publish(ctx, channel, event)
+}
+
+func (b *flakyBroker) setFail(fail func(channel string, n int) bool) {
+	b.mu.Lock()
+	b.fail = fail
+	b.mu.Unlock()
+}
+
+// write adds the events 1 to n to the outbox on a channel of their own
+func write(t *testing.T, db *database.DB, n int) string {
+	channel := "test:" + uuid.New().String()
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	for i := 1; i <= n; i++ {
+		require.NoError(t, Write(context.Background(), tx, channel, i))
+	}
+	require.NoError(t, tx.Commit())
+
+	t.Cleanup(func() { db.Exec(`DELETE FROM outbox WHERE channel = $1`, channel) })
+	return channel
+}
+
+func undelivered(t *testing.T, db *database.DB, channel string) int {
+	var n int
+	query := `SELECT COUNT(*) FROM outbox WHERE channel = $1 AND delivered_at IS NULL`
+	require.NoError(t, db.QueryRow(query, channel).Scan(&n))
+	return n
+}
+
+func receive(t *testing.T, sub broker.Subscription, n int) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var payloads []string
+	for len(payloads) < n {
+		msg, err := sub.Receive(ctx)
+		require.NoError(t, err)
+		payloads = append(payloads, string(msg.Payload))
+	}
+	return payloads
+}
+
+func TestRelayRetriesInOrder(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.DB(t)
+	memory := broker.NewMemory()
+	b := &flakyBroker{Broker: memory}
+	relay := NewRelay(db, b)
+	relay.batch = 1000
+
+	channel := write(t, db, 3)
+	sub := memory.Subscribe(ctx, "")
+	defer sub.Close()
+	require.NoError(t, sub.Add(ctx, channel))
+
+	// The second event fails: the batch rolls back, so nothing is marked
+	// delivered even though the first went out
+	b.setFail(func(c string, n int) bool { return c == channel && n == 2 })
+	_, err := relay.relay(ctx)
+	require.Error(t, err)
+	assert.Equal(t, 3, undelivered(t, db, channel))
+
+	var attempts int
+	var lastError string
+	query := `SELECT attempts, last_error FROM outbox WHERE channel = $1 AND payload = '2'`
+	require.NoError(t, db.QueryRow(query, channel).Scan(&attempts, &lastError))
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, "broker unavailable", lastError)
+
+	// Once the broker is back all three go out in order
+	b.setFail(nil)
+	n, err := relay.relay(ctx)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, n, 3)
+	assert.Equal(t, 0, undelivered(t, db, channel))
+	assert.Equal(t, []string{"1", "1", "2", "3"}, receive(t, sub, 4))
+}
+
+func TestRelayBusy(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.DB(t)
+	relay := NewRelay(db, broker.NewMemory())
+
+	// Another relay holds the lock until its transaction ends
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	defer tx.Rollback()
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock($1)`, relayLock)
+	require.NoError(t, err)
+
+	channel := write(t, db, 1)
+	_, err = relay.relay(ctx)
+	assert.Equal(t, errBusy, err)
+	assert.Equal(t, 1, undelivered(t, db, channel))
+
+	require.NoError(t, tx.Rollback())
+	_, err = relay.relay(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, undelivered(t, db, channel))
+}
+
+func TestRunDeliversOnlyPublished(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := testdb.DB(t)
+	memory := broker.NewMemory()
+	b := &flakyBroker{Broker: memory}
+	relay := NewRelay(db, b)
+	relay.batch = 1000
+
+	channel := write(t, db, 2)
+	sub := memory.Subscribe(ctx, "")
+	defer sub.Close()
+	require.NoError(t, sub.Add(ctx, channel))
+
+	// While publishing fails, Run keeps retrying and nothing is delivered
+	b.setFail(func(c string, n int) bool { return c == channel })
+	go relay.Run(ctx)
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 2, undelivered(t, db, channel))
+
+	var attempts int
+	query := `SELECT attempts FROM outbox WHERE channel = $1 AND payload = '1'`
+	require.NoError(t, db.QueryRow(query, channel).Scan(&attempts))
+	assert.Greater(t, attempts, 1)
+
+	b.setFail(nil)
+	relay.Notify()
+	assert.Equal(t, []string{"1", "2"}, receive(t, sub, 2))
+	assert.Eventually(t, func() bool {
+		return undelivered(t, db, channel) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
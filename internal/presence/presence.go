@@ -0,0 +1,589 @@
+package presence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+	"chat-app/internal/models"
+	"chat-app/internal/redis"
+
+	"github.com/google/uuid"
+)
+
+// Statuses, from least to most present. Sessions are online or idle; away
+// is set by the user and applies while they have a session.
+const (
+	StatusOffline = "offline"
+	StatusIdle    = "idle"
+	StatusAway    = "away"
+	StatusOnline  = "online"
+)
+
+var ErrInvalidStatus = errors.New("status must be online or away")
+
+// Redis keys. Each instance publishes its users under its own hash, which
+// expires unless the instance keeps refreshing it, and registers itself in
+// instancesKey with the time its entries stop counting.
+const (
+	instancesKey = "presence:instances"
+	awayKey      = "presence:away"
+)
+
+// PRESENCE_TTL bounds. Expiry times are kept in whole seconds, and the
+// heartbeat runs three times per TTL.
+const (
+	defaultTTL = 30 * time.Second
+	minTTL     = time.Second
+)
+
+func instanceKey(instance string) string { return "presence:instance:" + instance }
+func statusKey(userID string) string     { return "presence:status:" + userID }
+
+// Service tracks who is connected through WebSockets and gRPC streams.
+// Sessions live in the memory of the instance that holds them; the instance
+// publishes a summary per user to Redis, refreshed on every heartbeat, so
+// the users of an instance that crashes age out. A user's status is the
+// most present one over all instances, and changes to it are announced to
+// the user's rooms as presence events and kept in users.status.
+type Service struct {
+	db     *database.DB
+	redis  *redis.RedisClient
+	broker broker.Broker
+	authz  *authz.Authorizer
+
+	instance  string
+	ttl       time.Duration
+	idleAfter time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	users    map[string]map[string]*session // sessions by user
+	written  map[string]string              // status last published per local user
+
+	// flushMu orders writes to this instance's hash
+	flushMu sync.Mutex
+}
+
+type session struct {
+	userID   string
+	activeAt time.Time
+}
+
+// entry is what an instance publishes for one of its users
+type entry struct {
+	Status   string `json:"status"`
+	ActiveAt int64  `json:"active_at"`
+}
+
+// state is a user's presence over all instances
+type state struct {
+	status   string
+	activeAt time.Time // zero if offline
+}
+
+// NewService creates a new presence service and starts its heartbeat.
+// INSTANCE_ID names this instance (default random); PRESENCE_TTL is how
+// long an instance's sessions outlive its last heartbeat (default 30s), and
+// PRESENCE_IDLE_AFTER how long a session may go without activity before it
+// is idle (default 5m).
+func NewService(db *database.DB, redis *redis.RedisClient, broker broker.Broker, authorizer *authz.Authorizer) *Service {
+	s := &Service{
+		db:        db,
+		redis:     redis,
+		broker:    broker,
+		authz:     authorizer,
+		instance:  getEnv("INSTANCE_ID", uuid.New().String()),
+		ttl:       getDuration("PRESENCE_TTL", defaultTTL),
+		idleAfter: getDuration("PRESENCE_IDLE_AFTER", 5*time.Minute),
+		sessions:  make(map[string]*session),
+		users:     make(map[string]map[string]*session),
+		written:   make(map[string]string),
+	}
+	if s.ttl < minTTL {
+		log.Printf("PRESENCE_TTL %s is below %s, using %s", s.ttl, minTTL, defaultTTL)
+		s.ttl = defaultTTL
+	}
+
+	go s.heartbeat()
+	return s
+}
+
+// Connect starts a session for a user and returns its ID
+func (s *Service) Connect(ctx context.Context, userID string) string {
+	id := uuid.New().String()
+	sess := &session{userID: userID, activeAt: time.Now()}
+
+	s.mu.Lock()
+	s.sessions[id] = sess
+	if s.users[userID] == nil {
+		s.users[userID] = make(map[string]*session)
+	}
+	s.users[userID][id] = sess
+	s.mu.Unlock()
+
+	s.sync(ctx, userID)
+	return id
+}
+
+// Disconnect ends a session
+func (s *Service) Disconnect(ctx context.Context, sessionID string) {
+	s.mu.Lock()
+	sess := s.sessions[sessionID]
+	if sess == nil {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sessions, sessionID)
+	delete(s.users[sess.userID], sessionID)
+	if len(s.users[sess.userID]) == 0 {
+		delete(s.users, sess.userID)
+	}
+	s.mu.Unlock()
+
+	s.sync(ctx, sess.userID)
+}
+
+// Touch records activity on a session, bringing it back from idle
+func (s *Service) Touch(ctx context.Context, sessionID string) {
+	s.mu.Lock()
+	sess := s.sessions[sessionID]
+	if sess == nil {
+		s.mu.Unlock()
+		return
+	}
+	sess.activeAt = time.Now()
+	idle := s.written[sess.userID] == StatusIdle
+	s.mu.Unlock()
+
+	if idle {
+		s.sync(ctx, sess.userID)
+	}
+}
+
+// TouchUser records activity on every session of a user on this instance
+func (s *Service) TouchUser(ctx context.Context, userID string) {
+	s.mu.Lock()
+	now := time.Now()
+	for _, sess := range s.users[userID] {
+		sess.activeAt = now
+	}
+	idle := s.written[userID] == StatusIdle
+	s.mu.Unlock()
+
+	if idle {
+		s.sync(ctx, userID)
+	}
+}
+
+// SetStatus sets a user away or back online. Away lasts until it is set
+// back, across sessions; online also counts as activity.
+func (s *Service) SetStatus(ctx context.Context, userID, status string) error {
+	var err error
+	switch status {
+	case StatusAway:
+		err = s.redis.HSet(ctx, awayKey, userID, "1")
+	case StatusOnline:
+		err = s.redis.HDel(ctx, awayKey, userID)
+	default:
+		return ErrInvalidStatus
+	}
+	if err != nil {
+		return err
+	}
+
+	if status == StatusOnline {
+		s.mu.Lock()
+		now := time.Now()
+		for _, sess := range s.users[userID] {
+			sess.activeAt = now
+		}
+		s.mu.Unlock()
+		s.sync(ctx, userID)
+		return nil
+	}
+	s.announce(ctx, userID)
+	return nil
+}
+
+// Online returns the members of a room who are not offline, with their
+// status and when they were last active
+func (s *Service) Online(ctx context.Context, roomID, userID string) ([]models.User, error) {
+	if err := s.authz.CanAccessRoom(ctx, userID, roomID); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT u.id, u.username, u.status, u.last_seen
+			  FROM room_members rm
+			  JOIN users u ON u.id = rm.user_id
+			  WHERE rm.room_id = $1`
+
+	rows, err := s.db.QueryContext(ctx, query, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []models.User
+	var ids []string
+	for rows.Next() {
+		var member models.User
+		if err := rows.Scan(&member.ID, &member.Username, &member.Status, &member.LastSeen); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+		ids = append(ids, member.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Without Redis, users.status is the last status announced
+	states, err := s.resolve(ctx, ids)
+	if err != nil {
+		log.Printf("Error resolving presence in room %s, using stored status: %v", roomID, err)
+		states = nil
+	}
+
+	users := []models.User{}
+	for _, member := range members {
+		if states != nil {
+			st := states[member.ID]
+			member.Status = st.status
+			if !st.activeAt.IsZero() {
+				member.LastSeen = st.activeAt
+			}
+		}
+		if member.Status != "" && member.Status != StatusOffline {
+			users = append(users, member)
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// Shutdown ends this instance's sessions, announcing their users as gone
+// without waiting for the TTL
+func (s *Service) Shutdown(ctx context.Context) {
+	s.mu.Lock()
+	userIDs := make([]string, 0, len(s.users))
+	for userID := range s.users {
+		userIDs = append(userIDs, userID)
+	}
+	s.sessions = make(map[string]*session)
+	s.users = make(map[string]map[string]*session)
+	s.written = make(map[string]string)
+	s.mu.Unlock()
+
+	s.flushMu.Lock()
+	s.redis.ZRem(ctx, instancesKey, s.instance)
+	s.redis.Del(ctx, instanceKey(s.instance))
+	s.flushMu.Unlock()
+
+	for _, userID := range userIDs {
+		s.announce(ctx, userID)
+	}
+}
+
+// resolve returns the presence of users over all live instances
+func (s *Service) resolve(ctx context.Context, userIDs []string) (map[string]state, error) {
+	result := make(map[string]state, len(userIDs))
+	for _, userID := range userIDs {
+		result[userID] = state{status: StatusOffline}
+	}
+	if len(userIDs) == 0 {
+		return result, nil
+	}
+
+	instances, err := s.redis.ZRangeByScore(ctx, instancesKey, strconv.FormatInt(time.Now().Unix(), 10), "+inf")
+	if err != nil {
+		return nil, err
+	}
+	if !contains(instances, s.instance) {
+		instances = append(instances, s.instance)
+	}
+
+	for _, instance := range instances {
+		values, err := s.redis.HMGet(ctx, instanceKey(instance), userIDs...)
+		if err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			if value == "" {
+				continue
+			}
+			var e entry
+			if err := json.Unmarshal([]byte(value), &e); err != nil {
+				continue
+			}
+			result[userIDs[i]] = merge(result[userIDs[i]], e)
+		}
+	}
+
+	away, err := s.redis.HMGet(ctx, awayKey, userIDs...)
+	if err != nil {
+		return nil, err
+	}
+	for i, userID := range userIDs {
+		if away[i] != "" {
+			st := result[userID]
+			st.status = applyAway(st.status)
+			result[userID] = st
+		}
+	}
+	return result, nil
+}
+
+// sync publishes this instance's entry for a user, then announces the
+// user's status if that changed it
+func (s *Service) sync(ctx context.Context, userID string) {
+	s.flushMu.Lock()
+	s.mu.Lock()
+	e, ok := localEntry(s.users[userID], time.Now(), s.idleAfter)
+	if ok {
+		s.written[userID] = e.Status
+	} else {
+		delete(s.written, userID)
+	}
+	s.mu.Unlock()
+
+	var err error
+	if ok {
+		data, _ := json.Marshal(e)
+		err = s.redis.HSet(ctx, instanceKey(s.instance), userID, string(data))
+	} else {
+		err = s.redis.HDel(ctx, instanceKey(s.instance), userID)
+	}
+	s.flushMu.Unlock()
+
+	if err != nil {
+		log.Printf("Error publishing presence of %s: %v", userID, err)
+		return
+	}
+	s.announce(ctx, userID)
+}
+
+// announce tells a user's rooms about their status if it changed since it
+// was last announced, by any instance
+func (s *Service) announce(ctx context.Context, userID string) {
+	states, err := s.resolve(ctx, []string{userID})
+	if err != nil {
+		log.Printf("Error resolving presence of %s: %v", userID, err)
+		return
+	}
+	st := states[userID]
+
+	previous, err := s.redis.Swap(ctx, statusKey(userID), st.status)
+	if err != nil {
+		log.Printf("Error recording presence of %s: %v", userID, err)
+		return
+	}
+	if previous == st.status || (previous == "" && st.status == StatusOffline) {
+		return
+	}
+
+	var username string
+	query := `UPDATE users SET status = $2, last_seen = NOW() WHERE id = $1 RETURNING username`
+	if err := s.db.QueryRowContext(ctx, query, userID, st.status).Scan(&username); err != nil {
+		log.Printf("Error updating status of %s: %v", userID, err)
+		return
+	}
+
+	rows, err := s.db.QueryContext(ctx, `SELECT room_id FROM room_members WHERE user_id = $1`, userID)
+	if err != nil {
+		log.Printf("Error listing rooms of %s: %v", userID, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
+			continue
+		}
+
+		event := map[string]interface{}{
+			"type":      "presence",
+			"user_id":   userID,
+			"username":  username,
+			"room_id":   roomID,
+			"content":   st.status,
+			"timestamp": time.Now().Unix(),
+		}
+		if !st.activeAt.IsZero() {
+			event["metadata"] = map[string]interface{}{
+				"active_at": st.activeAt.Unix(),
+			}
+		}
+		if err := s.broker.Publish(ctx, fmt.Sprintf("room:%s", roomID), event); err != nil {
+			log.Printf("Error publishing presence event: %v", err)
+		}
+	}
+}
+
+// heartbeat keeps this instance's entries alive, turns sessions idle and
+// ages out instances that stopped beating
+func (s *Service) heartbeat() {
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		s.beat(context.Background())
+		<-ticker.C
+	}
+}
+
+func (s *Service) beat(ctx context.Context) {
+	now := time.Now()
+
+	s.flushMu.Lock()
+	s.mu.Lock()
+	entries := make(map[string]string, len(s.users))
+	var changed []string
+	for userID, sessions := range s.users {
+		e, _ := localEntry(sessions, now, s.idleAfter)
+		data, _ := json.Marshal(e)
+		entries[userID] = string(data)
+		if s.written[userID] != e.Status {
+			s.written[userID] = e.Status
+			changed = append(changed, userID)
+		}
+	}
+	s.mu.Unlock()
+
+	err := s.redis.ZAdd(ctx, instancesKey, float64(now.Add(s.ttl).Unix()), s.instance)
+	if err == nil {
+		// The hash outlives the registration so a sweeper can still read it
+		err = s.redis.ReplaceHash(ctx, instanceKey(s.instance), entries, 2*s.ttl)
+	}
+	s.flushMu.Unlock()
+	if err != nil {
+		log.Printf("Error refreshing presence of instance %s: %v", s.instance, err)
+		return
+	}
+
+	for _, userID := range changed {
+		s.announce(ctx, userID)
+	}
+	s.sweep(ctx, now)
+}
+
+// sweep removes instances whose registration ran out and announces their
+// users. Only the instance that removes one announces for it.
+func (s *Service) sweep(ctx context.Context, now time.Time) {
+	dead, err := s.redis.ZRangeByScore(ctx, instancesKey, "-inf", "("+strconv.FormatInt(now.Unix(), 10))
+	if err != nil {
+		log.Printf("Error listing presence instances: %v", err)
+		return
+	}
+
+	for _, instance := range dead {
+		if instance == s.instance {
+			continue
+		}
+		if removed, err := s.redis.ZRem(ctx, instancesKey, instance); err != nil || removed == 0 {
+			continue
+		}
+
+		log.Printf("Presence instance %s stopped beating, aging out its users", instance)
+		userIDs, err := s.redis.HKeys(ctx, instanceKey(instance))
+		if err != nil {
+			log.Printf("Error listing users of instance %s: %v", instance, err)
+		}
+		s.redis.Del(ctx, instanceKey(instance))
+		for _, userID := range userIDs {
+			s.announce(ctx, userID)
+		}
+	}
+}
+
+// localEntry summarises a user's sessions on one instance. ok is false if
+// there are none.
+func localEntry(sessions map[string]*session, now time.Time, idleAfter time.Duration) (e entry, ok bool) {
+	var activeAt time.Time
+	for _, sess := range sessions {
+		if sess.activeAt.After(activeAt) {
+			activeAt = sess.activeAt
+		}
+	}
+	if len(sessions) == 0 {
+		return entry{}, false
+	}
+
+	e.Status = StatusOnline
+	if now.Sub(activeAt) >= idleAfter {
+		e.Status = StatusIdle
+	}
+	e.ActiveAt = activeAt.Unix()
+	return e, true
+}
+
+// merge adds one instance's entry to a user's state: the most present
+// status and the latest activity win
+func merge(st state, e entry) state {
+	if rank(e.Status) > rank(st.status) {
+		st.status = e.Status
+	}
+	if activeAt := time.Unix(e.ActiveAt, 0); activeAt.After(st.activeAt) {
+		st.activeAt = activeAt
+	}
+	return st
+}
+
+// applyAway is the status of a user who set themselves away
+func applyAway(status string) string {
+	if status == StatusOffline {
+		return status
+	}
+	return StatusAway
+}
+
+func rank(status string) int {
+	switch status {
+	case StatusIdle:
+		return 1
+	case StatusAway:
+		return 2
+	case StatusOnline:
+		return 3
+	default:
+		return 0
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid duration for %s: %q, using %s", key, value, defaultValue)
+	}
+	return defaultValue
+}
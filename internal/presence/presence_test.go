@@ -0,0 +1,47 @@
+package presence
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalEntry(t *testing.T) {
+	now := time.Now()
+	sessions := map[string]*session{
+		"a": {userID: "user-1", activeAt: now.Add(-10 * time.Minute)},
+		"b": {userID: "user-1", activeAt: now.Add(-time.Minute)},
+	}
+
+	e, ok := localEntry(sessions, now, 5*time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, StatusOnline, e.Status)
+	assert.Equal(t, now.Add(-time.Minute).Unix(), e.ActiveAt)
+
+	// The most recently active session counts
+	e, ok = localEntry(sessions, now, 30*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, StatusIdle, e.Status)
+
+	_, ok = localEntry(nil, now, 5*time.Minute)
+	assert.False(t, ok)
+}
+
+func TestMerge(t *testing.T) {
+	earlier := time.Now().Add(-time.Hour).Truncate(time.Second)
+	later := earlier.Add(30 * time.Minute)
+
+	st := state{status: StatusOffline}
+	st = merge(st, entry{Status: StatusIdle, ActiveAt: earlier.Unix()})
+	assert.Equal(t, state{status: StatusIdle, activeAt: earlier}, st)
+
+	// Online on any instance wins, as does the latest activity
+	st = merge(st, entry{Status: StatusOnline, ActiveAt: later.Unix()})
+	st = merge(st, entry{Status: StatusIdle, ActiveAt: earlier.Unix()})
+	assert.Equal(t, state{status: StatusOnline, activeAt: later}, st)
+
+	assert.Equal(t, StatusAway, applyAway(StatusOnline))
+	assert.Equal(t, StatusAway, applyAway(StatusIdle))
+	assert.Equal(t, StatusOffline, applyAway(StatusOffline))
+}
@@ -49,9 +49,15 @@ func (r *RedisClient) Publish(ctx context.Context, channel string, message inter
 	return r.client.Publish(ctx, channel, data).Err()
 }
 
-// Subscribe subscribes to a channel
-func (r *RedisClient) Subscribe(ctx context.Context, channel string) *redis.PubSub {
-	return r.client.Subscribe(ctx, channel)
+// Subscribe subscribes to channels; with none, the connection idles until
+// channels are added
+func (r *RedisClient) Subscribe(ctx context.Context, channels ...string) *redis.PubSub {
+	return r.client.Subscribe(ctx, channels...)
+}
+
+// PSubscribe subscribes to channels matching the given patterns
+func (r *RedisClient) PSubscribe(ctx context.Context, patterns ...string) *redis.PubSub {
+	return r.client.PSubscribe(ctx, patterns...)
 }
 
 // Set sets a key-value pair with expiration
@@ -104,6 +110,16 @@ func (r *RedisClient) HGetAll(ctx context.Context, key string) (map[string]strin
 	return r.client.HGetAll(ctx, key).Result()
 }
 
+// HDel deletes hash fields
+func (r *RedisClient) HDel(ctx context.Context, key string, fields ...string) error {
+	return r.client.HDel(ctx, key, fields...).Err()
+}
+
+// Expire sets a timeout on a key
+func (r *RedisClient) Expire(ctx context.Context, key string, expiration time.Duration) error {
+	return r.client.Expire(ctx, key, expiration).Err()
+}
+
 // SAdd adds members to a set
 func (r *RedisClient) SAdd(ctx context.Context, key string, members ...interface{}) error {
 	return r.client.SAdd(ctx, key, members...).Err()
@@ -119,6 +135,119 @@ func (r *RedisClient) SRem(ctx context.Context, key string, members ...interface
 	return r.client.SRem(ctx, key, members...).Err()
 }
 
+// HMGet gets hash fields; missing fields are empty
+func (r *RedisClient) HMGet(ctx context.Context, key string, fields ...string) ([]string, error) {
+	values, err := r.client.HMGet(ctx, key, fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, len(values))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			result[i] = s
+		}
+	}
+	return result, nil
+}
+
+// HKeys gets all hash field names
+func (r *RedisClient) HKeys(ctx context.Context, key string) ([]string, error) {
+	return r.client.HKeys(ctx, key).Result()
+}
+
+// ReplaceHash atomically replaces a hash with values and sets its expiration
+func (r *RedisClient) ReplaceHash(ctx context.Context, key string, values map[string]string, expiration time.Duration) error {
+	pipe := r.client.TxPipeline()
+	pipe.Del(ctx, key)
+	if len(values) > 0 {
+		pipe.HSet(ctx, key, values)
+		pipe.Expire(ctx, key, expiration)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Swap sets a string value and returns the previous one, empty if unset
+func (r *RedisClient) Swap(ctx context.Context, key, value string) (string, error) {
+	previous, err := r.client.SetArgs(ctx, key, value, redis.SetArgs{Get: true}).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return previous, err
+}
+
+// ZAdd adds a member to a sorted set, or updates its score
+func (r *RedisClient) ZAdd(ctx context.Context, key string, score float64, member string) error {
+	return r.client.ZAdd(ctx, key, redis.Z{Score: score, Member: member}).Err()
+}
+
+// ZRangeByScore gets the members of a sorted set with scores in [min, max]
+func (r *RedisClient) ZRangeByScore(ctx context.Context, key, min, max string) ([]string, error) {
+	return r.client.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: min, Max: max}).Result()
+}
+
+// ZRem removes members from a sorted set and returns how many were there
+func (r *RedisClient) ZRem(ctx context.Context, key string, members ...interface{}) (int64, error) {
+	return r.client.ZRem(ctx, key, members...).Result()
+}
+
+// XAdd appends an entry to a stream and trims it to about maxLen entries
+func (r *RedisClient) XAdd(ctx context.Context, stream string, maxLen int64, values map[string]interface{}) error {
+	return r.client.XAdd(ctx, &redis.XAddArgs{Stream: stream, MaxLen: maxLen, Approx: true, Values: values}).Err()
+}
+
+// XGroupCreate creates a consumer group reading a stream from start,
+// creating the stream if needed
+func (r *RedisClient) XGroupCreate(ctx context.Context, stream, group, start string) error {
+	return r.client.XGroupCreateMkStream(ctx, stream, group, start).Err()
+}
+
+// XGroupDestroy removes a consumer group from a stream
+func (r *RedisClient) XGroupDestroy(ctx context.Context, stream, group string) error {
+	return r.client.XGroupDestroy(ctx, stream, group).Err()
+}
+
+// XReadGroup reads up to count entries from streams for a consumer of
+// group, after start in each: ">" for new entries, waiting up to block for
+// some, or "0" for those the consumer read before and did not acknowledge.
+// It returns nothing if none came.
+func (r *RedisClient) XReadGroup(ctx context.Context, group, consumer string, streams []string, start string, count int64, block time.Duration) ([]redis.XStream, error) {
+	args := make([]string, 0, 2*len(streams))
+	args = append(args, streams...)
+	for range streams {
+		args = append(args, start)
+	}
+
+	result, err := r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  args,
+		Count:    count,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return result, err
+}
+
+// XAck acknowledges entries read by a consumer group
+func (r *RedisClient) XAck(ctx context.Context, stream, group string, ids ...string) error {
+	return r.client.XAck(ctx, stream, group, ids...).Err()
+}
+
+// XInfoGroups lists the consumer groups of a stream
+func (r *RedisClient) XInfoGroups(ctx context.Context, stream string) ([]redis.XInfoGroup, error) {
+	return r.client.XInfoGroups(ctx, stream).Result()
+}
+
+// XInfoConsumers lists the consumers of a group, with how long each has
+// been idle
+func (r *RedisClient) XInfoConsumers(ctx context.Context, stream, group string) ([]redis.XInfoConsumer, error) {
+	return r.client.XInfoConsumers(ctx, stream, group).Result()
+}
+
 // Close closes the Redis connection
 func (r *RedisClient) Close() error {
 	return r.client.Close()
@@ -0,0 +1,187 @@
+package rooms
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"chat-app/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// MaxDMParticipants caps group DMs, including the creator
+const MaxDMParticipants = 10
+
+var (
+	ErrTooFewParticipants  = errors.New("a DM needs at least one other participant")
+	ErrTooManyParticipants = fmt.Errorf("a DM can have at most %d participants", MaxDMParticipants)
+	ErrUserNotFound        = errors.New("user not found")
+)
+
+// FindOrCreateDM returns the conversation between the caller and userIDs,
+// creating it on first use. The same set of participants always maps to the
+// same conversation, whatever order the IDs are given in.
+func (s *Service) FindOrCreateDM(ctx context.Context, userID string, userIDs []string) (*models.DirectMessage, bool, error) {
+	participants := canonicalParticipants(userID, userIDs)
+	if len(participants) < 2 {
+		return nil, false, ErrTooFewParticipants
+	}
+	if len(participants) > MaxDMParticipants {
+		return nil, false, ErrTooManyParticipants
+	}
+
+	var found int
+	if err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE id = ANY($1)`, pq.Array(participants)).Scan(&found); err != nil {
+		return nil, false, err
+	}
+	if found != len(participants) {
+		return nil, false, ErrUserNotFound
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// The unique index on dm_key serialises concurrent creators; the loser
+	// finds the winner's row once it commits
+	key := dmKey(participants)
+	roomID := uuid.New().String()
+	query := `INSERT INTO rooms (id, name, description, is_private, created_by, kind, dm_key, created_at, updated_at)
+			  VALUES ($1, 'Direct message', '', true, $2, 'dm', $3, NOW(), NOW())
+			  ON CONFLICT (dm_key) WHERE dm_key IS NOT NULL DO NOTHING`
+	result, err := tx.ExecContext(ctx, query, roomID, userID, key)
+	if err != nil {
+		return nil, false, fmt.Errorf("error creating DM: %v", err)
+	}
+
+	created := false
+	if n, _ := result.RowsAffected(); n == 1 {
+		created = true
+		for _, participant := range participants {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, 'member')`, roomID, participant); err != nil {
+				return nil, false, fmt.Errorf("error adding DM participant: %v", err)
+			}
+		}
+	} else {
+		if err := tx.QueryRowContext(ctx, `SELECT id FROM rooms WHERE dm_key = $1`, key).Scan(&roomID); err != nil {
+			return nil, false, err
+		}
+		// A caller who left the conversation gets back in: it is the only
+		// one they can ever have with these participants
+		query := `INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, 'member')
+				  ON CONFLICT (room_id, user_id) DO NOTHING`
+		if _, err := tx.ExecContext(ctx, query, roomID, userID); err != nil {
+			return nil, false, fmt.Errorf("error rejoining DM: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
+	}
+	if created {
+		for _, participant := range participants {
+			s.authz.Invalidate(ctx, roomID, participant)
+		}
+	} else {
+		s.authz.Invalidate(ctx, roomID, userID)
+	}
+
+	dms, err := s.listDMs(ctx, userID, roomID)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(dms) == 0 {
+		// The caller left again before the conversation was read back
+		return nil, false, ErrNotMember
+	}
+	return &dms[0], created, nil
+}
+
+// ListDMs returns the caller's conversations, most recently active first
+func (s *Service) ListDMs(ctx context.Context, userID string) ([]models.DirectMessage, error) {
+	return s.listDMs(ctx, userID, "")
+}
+
+func (s *Service) listDMs(ctx context.Context, userID, roomID string) ([]models.DirectMessage, error) {
+	query := `SELECT r.id, r.created_at,
+			  COALESCE((SELECT MAX(m.timestamp) FROM messages m WHERE m.room_id = r.id), r.created_at) AS last_activity
+			  FROM rooms r
+			  JOIN room_members me ON me.room_id = r.id AND me.user_id = $1
+			  WHERE r.kind = 'dm' AND ($2 = '' OR r.id = $2)
+			  ORDER BY last_activity DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, userID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	dms := []models.DirectMessage{}
+	index := map[string]int{}
+	var ids []string
+	for rows.Next() {
+		var dm models.DirectMessage
+		if err := rows.Scan(&dm.ID, &dm.CreatedAt, &dm.LastActivityAt); err != nil {
+			continue
+		}
+		dm.Participants = []models.RoomMember{}
+		index[dm.ID] = len(dms)
+		ids = append(ids, dm.ID)
+		dms = append(dms, dm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return dms, nil
+	}
+
+	memberRows, err := s.db.QueryContext(ctx, `SELECT rm.room_id, rm.user_id, u.username, COALESCE(rm.role, 'member'), rm.joined_at
+			  FROM room_members rm
+			  JOIN users u ON u.id = rm.user_id
+			  WHERE rm.room_id = ANY($1)
+			  ORDER BY u.username`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer memberRows.Close()
+
+	for memberRows.Next() {
+		var member models.RoomMember
+		if err := memberRows.Scan(&member.RoomID, &member.UserID, &member.Username, &member.Role, &member.JoinedAt); err != nil {
+			continue
+		}
+		i := index[member.RoomID]
+		dms[i].Participants = append(dms[i].Participants, member)
+	}
+
+	return dms, memberRows.Err()
+}
+
+// canonicalParticipants returns the sorted, de-duplicated participant set
+// including the caller
+func canonicalParticipants(userID string, userIDs []string) []string {
+	seen := map[string]bool{userID: true}
+	participants := []string{userID}
+	for _, id := range userIDs {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			participants = append(participants, id)
+		}
+	}
+	sort.Strings(participants)
+	return participants
+}
+
+func dmKey(participants []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(participants, ",")))
+	return hex.EncodeToString(sum[:])
+}
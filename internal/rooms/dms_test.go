@@ -0,0 +1,17 @@
+package rooms
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalParticipants(t *testing.T) {
+	a := canonicalParticipants("u2", []string{"u3", "u1", "u3", "u2", ""})
+	b := canonicalParticipants("u1", []string{"u2", "u3"})
+
+	assert.Equal(t, []string{"u1", "u2", "u3"}, a)
+	assert.Equal(t, a, b)
+	assert.Equal(t, dmKey(a), dmKey(b))
+	assert.NotEqual(t, dmKey(a), dmKey([]string{"u1", "u2"}))
+}
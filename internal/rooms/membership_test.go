@@ -0,0 +1,51 @@
+//go:build integration
+
+package rooms
+
+import (
+	"context"
+	"testing"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/testdb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindOrCreateDMAfterLeave(t *testing.T) {
+	ctx := context.Background()
+	db := testdb.DB(t)
+	authorizer := authz.NewAuthorizer(db, testdb.Redis(t))
+	s := NewService(db, broker.NewMemory(), authorizer)
+	alice, bob := testdb.User(t, db), testdb.User(t, db)
+
+	dm, created, err := s.FindOrCreateDM(ctx, alice, []string{bob})
+	require.NoError(t, err)
+	require.True(t, created)
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM room_members WHERE room_id = $1`, dm.ID)
+		db.Exec(`DELETE FROM rooms WHERE id = $1`, dm.ID)
+	})
+
+	// Alice leaves, as chat.Leave does
+	_, err = db.Exec(`DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`, dm.ID, alice)
+	require.NoError(t, err)
+	authorizer.Invalidate(ctx, dm.ID, alice)
+	assert.Error(t, authorizer.CanAccessRoom(ctx, alice, dm.ID))
+
+	// Asking for the conversation again puts her back in the same one
+	again, created, err := s.FindOrCreateDM(ctx, alice, []string{bob})
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, dm.ID, again.ID)
+	assert.Len(t, again.Participants, 2)
+	assert.NoError(t, authorizer.CanAccessRoom(ctx, alice, dm.ID))
+
+	// Bob, who never left, is unaffected
+	fromBob, created, err := s.FindOrCreateDM(ctx, bob, []string{alice})
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, dm.ID, fromBob.ID)
+}
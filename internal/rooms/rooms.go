@@ -0,0 +1,281 @@
+package rooms
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/database"
+	"chat-app/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidName     = errors.New("room name must be 1-100 characters")
+	ErrNotMember       = errors.New("new owner must be a member of this room")
+	ErrAlreadyOwner    = errors.New("user already owns this room")
+	ErrNotArchived     = errors.New("room is not archived")
+	ErrAlreadyArchived = errors.New("room is already archived")
+)
+
+// Update holds the fields of a partial room update; nil fields are left
+// unchanged
+type Update struct {
+	Name        *string
+	Description *string
+	IsPrivate   *bool
+}
+
+// Service reads and manages rooms: settings, archiving, deletion and
+// ownership. Changes are announced to the room as room_updated events.
+type Service struct {
+	db     *database.DB
+	broker broker.Broker
+	authz  *authz.Authorizer
+}
+
+// NewService creates a new room service
+func NewService(db *database.DB, broker broker.Broker, authorizer *authz.Authorizer) *Service {
+	return &Service{
+		db:     db,
+		broker: broker,
+		authz:  authorizer,
+	}
+}
+
+// Get returns a room the user may read
+func (s *Service) Get(ctx context.Context, roomID, userID string) (*models.Room, error) {
+	if err := s.authz.CanAccessRoom(ctx, userID, roomID); err != nil {
+		return nil, err
+	}
+	return s.load(ctx, roomID)
+}
+
+// Update changes a room's name, description or visibility
+func (s *Service) Update(ctx context.Context, roomID, userID string, update Update) (*models.Room, error) {
+	if err := s.authorizeWritable(ctx, userID, roomID, authz.PermEditRoom); err != nil {
+		return nil, err
+	}
+
+	if update.Name != nil && (len(*update.Name) == 0 || len(*update.Name) > 100) {
+		return nil, ErrInvalidName
+	}
+
+	query := `UPDATE rooms SET
+			  name = COALESCE($2, name),
+			  description = COALESCE($3, description),
+			  is_private = COALESCE($4, is_private),
+			  updated_at = NOW()
+			  WHERE id = $1`
+	if _, err := s.db.ExecContext(ctx, query, roomID, update.Name, update.Description, update.IsPrivate); err != nil {
+		return nil, fmt.Errorf("error updating room: %v", err)
+	}
+
+	if update.IsPrivate != nil {
+		s.authz.InvalidateRoom(ctx, roomID)
+	}
+
+	return s.changed(ctx, roomID, userID, "updated")
+}
+
+// Archive makes a room read-only
+func (s *Service) Archive(ctx context.Context, roomID, userID string) (*models.Room, error) {
+	return s.setArchived(ctx, roomID, userID, true)
+}
+
+// Unarchive makes an archived room writable again
+func (s *Service) Unarchive(ctx context.Context, roomID, userID string) (*models.Room, error) {
+	return s.setArchived(ctx, roomID, userID, false)
+}
+
+// Delete removes a room with its members and messages. Only the owner may
+// delete a room.
+func (s *Service) Delete(ctx context.Context, roomID, userID string) error {
+	if err := s.authz.Authorize(ctx, userID, roomID, authz.PermDeleteRoom); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Invitations, invite links, bans and mutes cascade from rooms
+	for _, query := range []string{
+		`DELETE FROM messages WHERE room_id = $1`,
+		`DELETE FROM room_members WHERE room_id = $1`,
+		`DELETE FROM rooms WHERE id = $1`,
+	} {
+		if _, err := tx.ExecContext(ctx, query, roomID); err != nil {
+			return fmt.Errorf("error deleting room: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.authz.InvalidateRoom(ctx, roomID)
+
+	s.publish(ctx, roomID, "room_deleted", userID, "This room was deleted", map[string]interface{}{
+		"room_id": roomID,
+	})
+	return nil
+}
+
+// TransferOwnership makes another member the owner. The previous owner
+// stays in the room as an admin.
+func (s *Service) TransferOwnership(ctx context.Context, roomID, userID, newOwnerID string) (*models.Room, error) {
+	if err := s.authz.Authorize(ctx, userID, roomID, authz.PermTransferOwner); err != nil {
+		return nil, err
+	}
+	if newOwnerID == userID {
+		return nil, ErrAlreadyOwner
+	}
+
+	target, err := s.authz.Membership(ctx, newOwnerID, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !target.IsMember || target.IsBanned() {
+		return nil, ErrNotMember
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE room_members SET role = $3 WHERE room_id = $1 AND user_id = $2`
+	if _, err := tx.ExecContext(ctx, query, roomID, newOwnerID, authz.RoleOwner); err != nil {
+		return nil, fmt.Errorf("error transferring ownership: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, query, roomID, userID, authz.RoleAdmin); err != nil {
+		return nil, fmt.Errorf("error transferring ownership: %v", err)
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE rooms SET updated_at = NOW() WHERE id = $1`, roomID); err != nil {
+		return nil, fmt.Errorf("error transferring ownership: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	s.authz.Invalidate(ctx, roomID, userID)
+	s.authz.Invalidate(ctx, roomID, newOwnerID)
+
+	return s.changed(ctx, roomID, userID, "ownership_transferred", "owner_id", newOwnerID)
+}
+
+func (s *Service) setArchived(ctx context.Context, roomID, userID string, archived bool) (*models.Room, error) {
+	if err := s.authz.Authorize(ctx, userID, roomID, authz.PermEditRoom); err != nil {
+		return nil, err
+	}
+
+	query := `UPDATE rooms SET archived_at = NOW(), updated_at = NOW() WHERE id = $1 AND archived_at IS NULL`
+	action, notChanged := "archived", ErrAlreadyArchived
+	if !archived {
+		query = `UPDATE rooms SET archived_at = NULL, updated_at = NOW() WHERE id = $1 AND archived_at IS NOT NULL`
+		action, notChanged = "unarchived", ErrNotArchived
+	}
+
+	result, err := s.db.ExecContext(ctx, query, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("error archiving room: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, notChanged
+	}
+	s.authz.InvalidateRoom(ctx, roomID)
+
+	return s.changed(ctx, roomID, userID, action)
+}
+
+// authorizeWritable is Authorize that also refuses changes to archived rooms
+func (s *Service) authorizeWritable(ctx context.Context, userID, roomID string, perm authz.Permission) error {
+	if err := s.authz.Authorize(ctx, userID, roomID, perm); err != nil {
+		return err
+	}
+
+	m, err := s.authz.Membership(ctx, userID, roomID)
+	if err != nil {
+		return err
+	}
+	if m.Archived {
+		return authz.ErrArchived
+	}
+	return nil
+}
+
+// changed reloads a room and announces it as room_updated
+func (s *Service) changed(ctx context.Context, roomID, userID, action string, extra ...string) (*models.Room, error) {
+	room, err := s.load(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{
+		"action":      action,
+		"name":        room.Name,
+		"description": room.Description,
+		"is_private":  room.IsPrivate,
+		"archived":    room.ArchivedAt != nil,
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		metadata[extra[i]] = extra[i+1]
+	}
+
+	s.publish(ctx, roomID, "room_updated", userID, updateMessages[action], metadata)
+	return room, nil
+}
+
+var updateMessages = map[string]string{
+	"updated":               "Room settings were updated",
+	"archived":              "This room was archived and is now read-only",
+	"unarchived":            "This room was unarchived",
+	"ownership_transferred": "Room ownership was transferred",
+}
+
+func (s *Service) load(ctx context.Context, roomID string) (*models.Room, error) {
+	var room models.Room
+	var description sql.NullString
+	query := `SELECT id, name, description, is_private, created_by, created_at, updated_at, archived_at
+			  FROM rooms WHERE id = $1`
+
+	err := s.db.QueryRowContext(ctx, query, roomID).Scan(&room.ID, &room.Name, &description, &room.IsPrivate,
+		&room.CreatedBy, &room.CreatedAt, &room.UpdatedAt, &room.ArchivedAt)
+	if err == sql.ErrNoRows {
+		return nil, authz.ErrRoomNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	room.Description = description.String
+
+	return &room, nil
+}
+
+// publish sends a room event to every instance via the room channel
+func (s *Service) publish(ctx context.Context, roomID, eventType, userID, content string, metadata map[string]interface{}) {
+	event := map[string]interface{}{
+		"type":       eventType,
+		"user_id":    userID,
+		"username":   "System",
+		"room_id":    roomID,
+		"content":    content,
+		"message_id": uuid.New().String(),
+		"timestamp":  time.Now().Unix(),
+		"metadata":   metadata,
+	}
+
+	channel := fmt.Sprintf("room:%s", roomID)
+	if err := s.broker.Publish(ctx, channel, event); err != nil {
+		log.Printf("Error publishing room event: %v", err)
+	}
+}
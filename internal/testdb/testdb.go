@@ -0,0 +1,91 @@
+// Package testdb sets up integration tests against the Postgres and Redis
+// configured through the DB_* and REDIS_* variables, as for the server.
+// Those tests are behind the integration build tag:
+//
+//	go test -tags integration ./...
+package testdb
+
+import (
+	"sync"
+	"testing"
+
+	"chat-app/internal/database"
+	"chat-app/internal/redis"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// users holds the users created on each connection, deleted once the
+// rooms they may be members of are gone
+var (
+	mu    sync.Mutex
+	users = map[*database.DB][]string{}
+)
+
+// DB connects to Postgres and creates the tables. The users created on it
+// are deleted when the test ends.
+func DB(t *testing.T) *database.DB {
+	db, err := database.NewConnection()
+	require.NoError(t, err)
+	require.NoError(t, db.InitTables())
+
+	t.Cleanup(func() {
+		mu.Lock()
+		ids := users[db]
+		delete(users, db)
+		mu.Unlock()
+
+		for _, id := range ids {
+			db.Exec(`DELETE FROM users WHERE id = $1`, id)
+		}
+		db.Close()
+	})
+	return db
+}
+
+// Redis connects to Redis
+func Redis(t *testing.T) *redis.RedisClient {
+	client, err := redis.NewRedisClient()
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// User creates a user with a unique name
+func User(t *testing.T, db *database.DB) string {
+	id := uuid.New().String()
+	name := "test-" + id[:8]
+	query := `INSERT INTO users (id, username, email, password) VALUES ($1, $2, $3, '')`
+	_, err := db.Exec(query, id, name, name+"@example.com")
+	require.NoError(t, err)
+
+	mu.Lock()
+	users[db] = append(users[db], id)
+	mu.Unlock()
+	return id
+}
+
+// Room creates a room with its owner as the only member. It is deleted
+// with its members, messages and their outbox events when the test ends.
+func Room(t *testing.T, db *database.DB, ownerID string, private bool) string {
+	id := uuid.New().String()
+	_, err := db.Exec(`INSERT INTO rooms (id, name, is_private, created_by) VALUES ($1, $2, $3, $4)`, id, "test-"+id[:8], private, ownerID)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM messages WHERE room_id = $1`, id)
+		db.Exec(`DELETE FROM outbox WHERE channel = $1`, "room:"+id)
+		db.Exec(`DELETE FROM room_members WHERE room_id = $1`, id)
+		db.Exec(`DELETE FROM rooms WHERE id = $1`, id)
+	})
+
+	Join(t, db, id, ownerID, "owner")
+	return id
+}
+
+// Join makes a user a member of a room with a role
+func Join(t *testing.T, db *database.DB, roomID, userID, role string) {
+	_, err := db.Exec(`INSERT INTO room_members (room_id, user_id, role) VALUES ($1, $2, $3)`, roomID, userID, role)
+	require.NoError(t, err)
+}
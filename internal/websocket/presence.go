@@ -0,0 +1,22 @@
+package websocket
+
+import (
+	"context"
+	"log"
+
+	"chat-app/internal/presence"
+)
+
+// handlePresence sets the user away or back online. The change reaches the
+// user's rooms, this connection's included, as a presence event.
+func (h *WebSocketHandler) handlePresence(conn *WSConnection, msg WSMessage) {
+	err := h.presence.SetStatus(context.Background(), conn.UserID, msg.Content)
+	switch err {
+	case nil:
+	case presence.ErrInvalidStatus:
+		conn.sendError(err.Error())
+	default:
+		log.Printf("Error setting presence of %s: %v", conn.UserID, err)
+		conn.sendError("Failed to set presence")
+	}
+}
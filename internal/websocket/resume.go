@@ -0,0 +1,163 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"chat-app/internal/models"
+)
+
+// resume joins the replay of messages a reconnecting client missed with
+// live delivery. Live events that arrive during the replay are held back
+// and delivered after it; live copies of replayed messages are dropped.
+type resume struct {
+	mu      sync.Mutex
+	done    bool
+	lastSeq int64 // highest seq the client has been sent
+	held    []WSMessage
+}
+
+// intercept reports whether broadcastToRoom must not deliver msg: either
+// it is held until the replay is over or the replay already sent it
+func (r *resume) intercept(msg WSMessage) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.done {
+		r.held = append(r.held, msg)
+		return true
+	}
+	return msg.Type == "message" && msg.Seq != 0 && msg.Seq <= r.lastSeq
+}
+
+// resumeKey identifies the replay state of one room on one connection
+func resumeKey(connID, roomID string) string {
+	return connID + "/" + roomID
+}
+
+// replay sends the messages of a room a connection missed since r.lastSeq
+// and the edits, deletions and reactions it missed, then the live events
+// held back meanwhile, then a resumed frame, all through send. Replies and
+// their changes are only replayed to connections following their thread,
+// like live ones.
+func (h *WebSocketHandler) replay(conn *WSConnection, roomID string, r *resume, send func(WSMessage) error) {
+	sinceSeq := r.lastSeq
+	lastSeq := sinceSeq
+	replayed := 0
+
+	missed, ok, err := h.messages.Since(context.Background(), roomID, conn.UserID, sinceSeq)
+	if err != nil {
+		log.Printf("Error replaying room %s since %d: %v", roomID, sinceSeq, err)
+	}
+
+	h.mu.RLock()
+	following := h.threads[conn.ID]
+	h.mu.RUnlock()
+
+	for _, m := range missed {
+		var frame WSMessage
+		if message := m.Message; message != nil {
+			lastSeq = message.Seq
+			if message.DeletedAt != nil {
+				continue
+			}
+			frame = messageFrame(*message)
+		} else if err := json.Unmarshal(m.Event, &frame); err != nil {
+			log.Printf("Error parsing missed event in room %s: %v", roomID, err)
+			continue
+		}
+		if frame.ThreadRootID != "" && frame.ThreadRootID != following {
+			continue
+		}
+		if err := send(frame); err != nil {
+			log.Printf("Error replaying %s %s: %v", frame.Type, frame.MessageID, err)
+			break
+		}
+		replayed++
+	}
+
+	// Flush held events in batches without holding the lock while writing;
+	// an empty batch ends the replay
+	for {
+		r.mu.Lock()
+		held := r.held
+		r.held = nil
+		if len(held) == 0 {
+			r.done = true
+			r.lastSeq = lastSeq
+		}
+		r.mu.Unlock()
+
+		if len(held) == 0 {
+			break
+		}
+		for _, msg := range held {
+			if msg.Type == "message" && msg.Seq != 0 {
+				if msg.Seq <= lastSeq {
+					continue
+				}
+				lastSeq = msg.Seq
+			}
+			send(msg)
+		}
+	}
+
+	resumed := WSMessage{
+		Type:      "resumed",
+		UserID:    "system",
+		Username:  "System",
+		RoomID:    roomID,
+		Timestamp: time.Now().Unix(),
+		Seq:       lastSeq,
+		Metadata: map[string]interface{}{
+			"since_seq": sinceSeq,
+			"replayed":  replayed,
+		},
+	}
+	if err != nil || !ok {
+		resumed.Content = resetReason(err)
+		resumed.Metadata["reset"] = true
+	}
+	send(resumed)
+}
+
+// resetReason tells a client why what it missed was not replayed
+func resetReason(err error) string {
+	if err != nil {
+		return "Missed messages could not be replayed; reload the history"
+	}
+	return "Too many messages or changes were missed; reload the history"
+}
+
+// messageFrame is the message frame of a stored message, as it was
+// broadcast when it was sent
+func messageFrame(message models.Message) WSMessage {
+	frame := WSMessage{
+		Type:        "message",
+		UserID:      message.UserID,
+		Username:    message.Username,
+		RoomID:      message.RoomID,
+		Content:     message.Content,
+		MessageID:   message.ID,
+		MessageType: message.MessageType,
+		Timestamp:   message.Timestamp.Unix(),
+		ClientMsgID: message.ClientMsgID,
+		Seq:         message.Seq,
+	}
+	if len(message.Metadata) > 0 {
+		frame.Metadata = make(map[string]interface{}, len(message.Metadata))
+		for key, value := range message.Metadata {
+			frame.Metadata[key] = value
+		}
+	}
+	if message.ParentID != nil {
+		frame.ParentID = *message.ParentID
+	}
+	if message.ThreadRootID != nil {
+		frame.ThreadRootID = *message.ThreadRootID
+	}
+	return frame
+}
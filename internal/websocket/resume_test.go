@@ -0,0 +1,24 @@
+package websocket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeIntercept(t *testing.T) {
+	r := &resume{lastSeq: 10}
+
+	// Everything is held during the replay
+	assert.True(t, r.intercept(WSMessage{Type: "message", Seq: 11}))
+	assert.True(t, r.intercept(WSMessage{Type: "typing"}))
+	assert.Len(t, r.held, 2)
+
+	r.done = true
+	assert.True(t, r.intercept(WSMessage{Type: "message", Seq: 9}))
+	assert.True(t, r.intercept(WSMessage{Type: "message", Seq: 10}))
+	assert.False(t, r.intercept(WSMessage{Type: "message", Seq: 12}))
+	assert.False(t, r.intercept(WSMessage{Type: "message_edited", Seq: 3}))
+	assert.False(t, r.intercept(WSMessage{Type: "typing"}))
+	assert.Len(t, r.held, 2)
+}
@@ -0,0 +1,129 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+)
+
+var errNotSubscribed = errors.New("not subscribed to room")
+
+// handleSubscribe adds the frame's room to the connection's subscriptions.
+// A non-zero seq replays the messages after it first, as since_seq does
+// when connecting.
+func (h *WebSocketHandler) handleSubscribe(conn *WSConnection, msg WSMessage) {
+	if msg.RoomID == "" {
+		conn.sendError("room_id is required")
+		return
+	}
+
+	err := h.authz.CanAccessRoom(context.Background(), conn.UserID, msg.RoomID)
+	if err == nil {
+		err = h.subscribe(conn, msg.RoomID, msg.Seq > 0, msg.Seq, conn.deliver)
+	}
+	if err != nil {
+		log.Printf("Rejected subscription of %s to room %s: %v", conn.UserID, msg.RoomID, err)
+		conn.sendError(clientError(err, "Failed to subscribe to room"))
+	}
+}
+
+// handleUnsubscribe removes the frame's room from the connection's
+// subscriptions
+func (h *WebSocketHandler) handleUnsubscribe(conn *WSConnection, msg WSMessage) {
+	if !h.unsubscribe(conn, msg.RoomID) {
+		conn.sendError(errNotSubscribed.Error())
+		return
+	}
+
+	conn.queueMessage(WSMessage{
+		Type:      "unsubscribed",
+		UserID:    "system",
+		Username:  "System",
+		RoomID:    msg.RoomID,
+		Timestamp: time.Now().Unix(),
+	})
+}
+
+// subscribe adds a room the user may access to the connection, confirms it
+// with a subscribed frame and, when resuming, replays what was missed since
+// sinceSeq through send
+func (h *WebSocketHandler) subscribe(conn *WSConnection, roomID string, resuming bool, sinceSeq int64, send func(WSMessage) error) error {
+	// Live events are held back from a resuming room until it has caught
+	// up, so the replay state must exist before the subscription does
+	var r *resume
+	key := resumeKey(conn.ID, roomID)
+	if resuming {
+		r = &resume{lastSeq: sinceSeq}
+		h.mu.Lock()
+		h.resumes[key] = r
+		h.mu.Unlock()
+	}
+
+	if err := h.hub.Subscribe(conn.Connection, roomID, h.maxSubscriptions); err != nil {
+		if r != nil {
+			h.mu.Lock()
+			delete(h.resumes, key)
+			h.mu.Unlock()
+		}
+		return err
+	}
+	h.awaitChannel(roomChannel(roomID))
+
+	send(WSMessage{
+		Type:      "subscribed",
+		UserID:    "system",
+		Username:  "System",
+		RoomID:    roomID,
+		Timestamp: time.Now().Unix(),
+		Metadata: map[string]interface{}{
+			"subscriptions": len(h.hub.Subscriptions(conn.Connection)),
+		},
+	})
+
+	if r != nil {
+		h.replay(conn, roomID, r, send)
+	}
+	return nil
+}
+
+// unsubscribe removes a room from the connection and reports whether it
+// was subscribed
+func (h *WebSocketHandler) unsubscribe(conn *WSConnection, roomID string) bool {
+	if !h.hub.Unsubscribe(conn.Connection, roomID) {
+		return false
+	}
+
+	h.mu.Lock()
+	delete(h.resumes, resumeKey(conn.ID, roomID))
+	h.mu.Unlock()
+	return true
+}
+
+// frameRoom returns the room a frame is for: its room_id, or the room the
+// connection was opened with. The connection must be subscribed to it.
+func (h *WebSocketHandler) frameRoom(conn *WSConnection, msg WSMessage) (string, error) {
+	roomID := msg.RoomID
+	if roomID == "" {
+		roomID = conn.RoomID
+	}
+	if roomID == "" || !h.hub.Subscribed(conn.Connection, roomID) {
+		return roomID, errNotSubscribed
+	}
+	return roomID, nil
+}
+
+// deliver queues a message for the write pump, holding it back within the
+// backlog budget if the client is behind
+func (conn *WSConnection) deliver(msg WSMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if !conn.Enqueue(data) {
+		return errors.New("connection is too far behind")
+	}
+	return nil
+}
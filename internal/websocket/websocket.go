@@ -6,28 +6,62 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"chat-app/internal/auth"
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/chat"
 	"chat-app/internal/database"
+	"chat-app/internal/fanout"
+	"chat-app/internal/messages"
 	"chat-app/internal/models"
-	"chat-app/internal/redis"
+	"chat-app/internal/moderation"
+	"chat-app/internal/presence"
 
 	"github.com/gorilla/websocket"
 	"github.com/google/uuid"
 )
 
+// Application close codes sent to clients
+const (
+	CloseTokenExpired    = 4001
+	CloseSessionRevoked  = 4002
+	CloseRemovedFromRoom = 4003
+	CloseSlowConsumer    = 4008
+)
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins for development
 	},
+	// Echo the bearer subprotocol back so browsers accept the handshake
+	Subprotocols: []string{auth.SubprotocolBearer},
 }
 
 type WebSocketHandler struct {
-	db    *database.DB
-	redis *redis.RedisClient
-	hub   *models.Hub
-	mu    sync.RWMutex
+	db       *database.DB
+	auth     *auth.Service
+	authz    *authz.Authorizer
+	messages *messages.Service
+	presence *presence.Service
+	chat     *chat.Service
+	hub      *models.Hub
+	node     *fanout.Node
+	mu       sync.RWMutex
+
+	// threads maps connection IDs to the thread root they follow, if any
+	threads map[string]string
+
+	// resumes holds the replay state of rooms subscribed to with a seq,
+	// keyed by resumeKey
+	resumes map[string]*resume
+
+	maxSubscriptions int
 }
 
 type WSMessage struct {
@@ -39,41 +73,111 @@ type WSMessage struct {
 	MessageID string                 `json:"message_id,omitempty"`
 	Timestamp int64                  `json:"timestamp"`
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+
+	// MessageType is text unless the sender says otherwise
+	MessageType string `json:"message_type,omitempty"`
+
+	// Threads: parent_id is set by clients to reply; thread_root_id is set
+	// on replies and routes them to the thread's followers only
+	ParentID     string `json:"parent_id,omitempty"`
+	ThreadRootID string `json:"thread_root_id,omitempty"`
+
+	// ClientMsgID is chosen by the sender of a message and echoed on its
+	// ack or error frame; retries with the same ID are not stored twice
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+
+	// Seq numbers the messages of a room; reconnect with since_seq set to
+	// the last one seen to have missed messages replayed
+	Seq int64 `json:"seq,omitempty"`
 }
 
 type WSConnection struct {
 	*models.Connection
-	wsConn *websocket.Conn
+	wsConn     *websocket.Conn
+	presenceID string // presence session, active while the socket is open
+
+	mu        sync.Mutex
+	expiresAt time.Time
 }
 
-// NewWebSocketHandler creates a new WebSocket handler
-func NewWebSocketHandler(db *database.DB, redis *redis.RedisClient) *WebSocketHandler {
-	hub := models.NewHub()
+// NewWebSocketHandler creates a new WebSocket handler. WS_MAX_SUBSCRIPTIONS
+// caps the rooms one connection may subscribe to (default 50, 0 = no limit);
+// WS_HUB_SHARDS sets how many shards the hub spreads rooms over (default 64).
+// WS_SEND_BUFFER, WS_EPHEMERAL_LIMIT and WS_BACKLOG_BYTES size what is
+// buffered for connections that fall behind.
+//
+// Events reach other instances through the broker. The handler only
+// listens on the room and user channels it has local connections for.
+func NewWebSocketHandler(db *database.DB, broker broker.Broker, authService *auth.Service, authorizer *authz.Authorizer, messageService *messages.Service, presenceService *presence.Service, chatService *chat.Service) *WebSocketHandler {
 	handler := &WebSocketHandler{
-		db:    db,
-		redis: redis,
-		hub:   hub,
+		db:       db,
+		auth:     authService,
+		authz:    authorizer,
+		messages: messageService,
+		presence: presenceService,
+		chat:     chatService,
+		threads:  make(map[string]string),
+		resumes:  make(map[string]*resume),
+
+		maxSubscriptions: getInt("WS_MAX_SUBSCRIPTIONS", 50),
 	}
+	handler.node = fanout.NewNode(broker, handler.deliverEvent)
+	handler.hub = models.NewHub(models.HubConfig{
+		Shards:         getInt("WS_HUB_SHARDS", models.DefaultHubShards),
+		SendBuffer:     getInt("WS_SEND_BUFFER", models.DefaultSendBuffer),
+		EphemeralLimit: getInt("WS_EPHEMERAL_LIMIT", 0),
+		BacklogBytes:   getInt("WS_BACKLOG_BYTES", models.DefaultBacklogBytes),
+		Overflow:       closeSlowConnection,
+		RoomActive: func(roomID string, active bool) {
+			handler.node.Want(roomChannel(roomID), active)
+		},
+		UserActive: func(userID string, active bool) {
+			handler.node.Want(userChannel(userID), active)
+		},
+	})
 
-	// Start the hub
-	go hub.Run()
-
-	// Start Redis message listener
-	go handler.listenRedisMessages()
+	// Start receiving events from other instances
+	go handler.node.Run(context.Background())
 
 	return handler
 }
 
 // HandleWebSocket handles WebSocket connections
 func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Get user info from query parameters (in production, use JWT tokens)
-	userID := r.URL.Query().Get("user_id")
-	username := r.URL.Query().Get("username")
+	// Identity comes from the token claims only
+	claims, err := h.auth.Authenticate(r.Context(), auth.TokenFromRequest(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	userID := claims.UserID
+	username := claims.Username
+	// room_id is optional: more rooms can be subscribed to with frames
 	roomID := r.URL.Query().Get("room_id")
 
-	if userID == "" || username == "" || roomID == "" {
-		http.Error(w, "Missing required parameters", http.StatusBadRequest)
-		return
+	var sinceSeq int64
+	resuming := r.URL.Query().Has("since_seq")
+	if resuming {
+		if sinceSeq, err = strconv.ParseInt(r.URL.Query().Get("since_seq"), 10, 64); err != nil || sinceSeq < 0 || roomID == "" {
+			http.Error(w, "Invalid since_seq", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if roomID != "" {
+		switch err := h.authz.CanAccessRoom(r.Context(), userID, roomID); err {
+		case nil:
+		case authz.ErrRoomNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case authz.ErrForbidden, authz.ErrBanned:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			http.Error(w, "Failed to check room access", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	// Upgrade HTTP connection to WebSocket
@@ -87,10 +191,15 @@ func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reques
 	wsConn := &WSConnection{
 		Connection: models.NewConnection(userID, username, roomID, conn, h.hub),
 		wsConn:     conn,
+		expiresAt:  claims.ExpiresAt.Time,
 	}
+	wsConn.Session = claims.SessionID
 
-	// Register connection
-	h.hub.Register <- wsConn.Connection
+	// Register connection, and wait for its user's events to reach this
+	// instance
+	h.hub.Register(wsConn.Connection)
+	h.awaitChannel(userChannel(userID))
+	wsConn.presenceID = h.presence.Connect(r.Context(), userID)
 
 	// Send welcome message
 	welcomeMsg := WSMessage{
@@ -98,15 +207,25 @@ func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reques
 		UserID:    "system",
 		Username:  "System",
 		RoomID:    roomID,
-		Content:   fmt.Sprintf("Welcome %s to room %s", username, roomID),
+		Content:   fmt.Sprintf("Welcome %s", username),
 		MessageID: uuid.New().String(),
 		Timestamp: time.Now().Unix(),
 	}
+	if roomID != "" {
+		welcomeMsg.Content = fmt.Sprintf("Welcome %s to room %s", username, roomID)
+	}
 
 	if err := wsConn.sendMessage(welcomeMsg); err != nil {
 		log.Printf("Error sending welcome message: %v", err)
 	}
 
+	// The write pump is not running yet, so the replay writes directly
+	if roomID != "" {
+		if err := h.subscribe(wsConn, roomID, resuming, sinceSeq, wsConn.sendMessage); err != nil {
+			log.Printf("Error subscribing %s to room %s: %v", userID, roomID, err)
+		}
+	}
+
 	// Start goroutines for reading and writing
 	go h.readPump(wsConn)
 	go h.writePump(wsConn)
@@ -115,11 +234,19 @@ func (h *WebSocketHandler) HandleWebSocket(w http.ResponseWriter, r *http.Reques
 // readPump reads messages from the WebSocket connection
 func (h *WebSocketHandler) readPump(conn *WSConnection) {
 	defer func() {
-		h.hub.Unregister <- conn.Connection
+		h.mu.Lock()
+		delete(h.threads, conn.ID)
+		for _, roomID := range h.hub.Subscriptions(conn.Connection) {
+			delete(h.resumes, resumeKey(conn.ID, roomID))
+		}
+		h.mu.Unlock()
+
+		h.hub.Unregister(conn.Connection)
+		h.presence.Disconnect(context.Background(), conn.presenceID)
 		conn.wsConn.Close()
 	}()
 
-	conn.wsConn.SetReadLimit(512) // 512 bytes
+	conn.wsConn.SetReadLimit(4096) // 4KB, enough for refresh_token frames
 	conn.wsConn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	conn.wsConn.SetPongHandler(func(string) error {
 		conn.wsConn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -150,8 +277,10 @@ func (h *WebSocketHandler) readPump(conn *WSConnection) {
 // writePump writes messages to the WebSocket connection
 func (h *WebSocketHandler) writePump(conn *WSConnection) {
 	ticker := time.NewTicker(54 * time.Second)
+	expiry := time.NewTimer(time.Until(conn.tokenExpiry()))
 	defer func() {
 		ticker.Stop()
+		expiry.Stop()
 		conn.wsConn.Close()
 	}()
 
@@ -173,17 +302,31 @@ func (h *WebSocketHandler) writePump(conn *WSConnection) {
 			if err := w.Close(); err != nil {
 				return
 			}
+			conn.Refill()
 		case <-ticker.C:
 			conn.wsConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := conn.wsConn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+		case <-expiry.C:
+			// The token may have been refreshed since the timer was armed
+			if remaining := time.Until(conn.tokenExpiry()); remaining > 0 {
+				expiry.Reset(remaining)
+				continue
+			}
+
+			closeMsg := websocket.FormatCloseMessage(CloseTokenExpired, "token expired")
+			conn.wsConn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(10*time.Second))
+			return
 		}
 	}
 }
 
 // handleMessage processes incoming messages
 func (h *WebSocketHandler) handleMessage(conn *WSConnection, msg WSMessage) {
+	// Every frame, heartbeats included, counts as activity
+	h.presence.Touch(context.Background(), conn.presenceID)
+
 	switch msg.Type {
 	case "message":
 		h.handleChatMessage(conn, msg)
@@ -193,6 +336,27 @@ func (h *WebSocketHandler) handleMessage(conn *WSConnection, msg WSMessage) {
 		h.handleLeaveRoom(conn, msg)
 	case "typing":
 		h.handleTyping(conn, msg)
+	case "edit":
+		h.handleEditMessage(conn, msg)
+	case "delete":
+		h.handleDeleteMessage(conn, msg)
+	case "reaction":
+		h.handleReaction(conn, msg)
+	case "read":
+		h.handleRead(conn, msg)
+	case "follow_thread":
+		h.handleFollowThread(conn, msg)
+	case "unfollow_thread":
+		h.handleUnfollowThread(conn, msg)
+	case "subscribe":
+		h.handleSubscribe(conn, msg)
+	case "unsubscribe":
+		h.handleUnsubscribe(conn, msg)
+	case "refresh_token":
+		h.handleRefreshToken(conn, msg)
+	case "presence":
+		h.handlePresence(conn, msg)
+	case "heartbeat":
 	default:
 		log.Printf("Unknown message type: %s", msg.Type)
 	}
@@ -200,109 +364,275 @@ func (h *WebSocketHandler) handleMessage(conn *WSConnection, msg WSMessage) {
 
 // handleChatMessage handles chat messages
 func (h *WebSocketHandler) handleChatMessage(conn *WSConnection, msg WSMessage) {
-	// Store message in database
-	messageID := uuid.New().String()
-	timestamp := time.Now()
+	roomID, err := h.frameRoom(conn, msg)
+	if err != nil {
+		conn.sendErrorFor(msg.ClientMsgID, clientError(err, "Failed to send message"))
+		return
+	}
 
-	query := `INSERT INTO messages (id, user_id, username, room_id, content, message_type, timestamp, metadata) 
-			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	
-	ctx := context.Background()
-	_, err := h.db.ExecContext(ctx, query, 
-		messageID, conn.UserID, conn.Username, conn.RoomID, 
-		msg.Content, "text", timestamp, msg.Metadata)
-	
+	message, duplicate, err := h.chat.Send(context.Background(), chat.Send{
+		RoomID:      roomID,
+		UserID:      conn.UserID,
+		Username:    conn.Username,
+		Content:     msg.Content,
+		MessageType: msg.MessageType,
+		Metadata:    msg.Metadata,
+		ParentID:    msg.ParentID,
+		ClientMsgID: msg.ClientMsgID,
+	})
 	if err != nil {
-		log.Printf("Error storing message: %v", err)
+		log.Printf("Rejected message from %s to room %s: %v", conn.UserID, roomID, err)
+		conn.sendErrorFor(msg.ClientMsgID, clientError(err, "Failed to send message"))
 		return
 	}
 
-	// Create message to broadcast
-	broadcastMsg := WSMessage{
-		Type:      "message",
+	conn.queueMessage(WSMessage{
+		Type:        "ack",
+		UserID:      "system",
+		Username:    "System",
+		RoomID:      message.RoomID,
+		MessageID:   message.ID,
+		Timestamp:   message.Timestamp.Unix(),
+		ClientMsgID: message.ClientMsgID,
+		Seq:         message.Seq,
+		Metadata: map[string]interface{}{
+			"duplicate": duplicate,
+		},
+	})
+}
+
+// handleEditMessage handles edits of the sender's own messages. The message
+// service publishes message_edited to the room on success.
+func (h *WebSocketHandler) handleEditMessage(conn *WSConnection, msg WSMessage) {
+	roomID, err := h.frameRoom(conn, msg)
+	if err != nil {
+		conn.sendError(clientError(err, "Failed to edit message"))
+		return
+	}
+
+	_, err = h.chat.Edit(context.Background(), chat.Edit{
+		RoomID:    roomID,
+		MessageID: msg.MessageID,
 		UserID:    conn.UserID,
-		Username:  conn.Username,
-		RoomID:    conn.RoomID,
 		Content:   msg.Content,
-		MessageID: messageID,
-		Timestamp: timestamp.Unix(),
-		Metadata:  msg.Metadata,
+	})
+	if err != nil {
+		log.Printf("Rejected edit of %s by %s: %v", msg.MessageID, conn.UserID, err)
+		conn.sendError(clientError(err, "Failed to edit message"))
 	}
+}
 
-	// Broadcast to all connections in the room
-	h.broadcastToRoom(conn.RoomID, broadcastMsg)
+// handleDeleteMessage handles deletes by authors and moderators. The message
+// service publishes message_deleted to the room on success.
+func (h *WebSocketHandler) handleDeleteMessage(conn *WSConnection, msg WSMessage) {
+	roomID, err := h.frameRoom(conn, msg)
+	if err != nil {
+		conn.sendError(clientError(err, "Failed to delete message"))
+		return
+	}
 
-	// Publish to Redis for other instances
-	h.publishToRedis(conn.RoomID, broadcastMsg)
+	_, err = h.chat.Delete(context.Background(), chat.Delete{
+		RoomID:    roomID,
+		MessageID: msg.MessageID,
+		UserID:    conn.UserID,
+	})
+	if err != nil {
+		log.Printf("Rejected delete of %s by %s: %v", msg.MessageID, conn.UserID, err)
+		conn.sendError(clientError(err, "Failed to delete message"))
+	}
 }
 
-// handleJoinRoom handles room join requests
-func (h *WebSocketHandler) handleJoinRoom(conn *WSConnection, msg WSMessage) {
-	// Add user to room in database
-	query := `INSERT INTO room_members (room_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
-	ctx := context.Background()
-	_, err := h.db.ExecContext(ctx, query, conn.RoomID, conn.UserID)
-	
+// handleReaction adds the emoji in content to a message, or removes it when
+// metadata.action is "remove". The message service publishes a reaction
+// event carrying only the change and the new count.
+func (h *WebSocketHandler) handleReaction(conn *WSConnection, msg WSMessage) {
+	roomID, err := h.frameRoom(conn, msg)
 	if err != nil {
-		log.Printf("Error joining room: %v", err)
+		conn.sendError(clientError(err, "Failed to react to message"))
 		return
 	}
 
-	// Update user status
-	updateQuery := `UPDATE users SET status = 'online', last_seen = NOW() WHERE id = $1`
-	h.db.ExecContext(ctx, updateQuery, conn.UserID)
+	if action, _ := msg.Metadata["action"].(string); action == messages.ReactionRemoved {
+		_, err = h.messages.RemoveReaction(context.Background(), roomID, msg.MessageID, conn.UserID, msg.Content)
+	} else {
+		_, err = h.messages.AddReaction(context.Background(), roomID, msg.MessageID, conn.UserID, msg.Content)
+	}
+	if err != nil {
+		log.Printf("Rejected reaction to %s by %s: %v", msg.MessageID, conn.UserID, err)
+		conn.sendError(clientError(err, "Failed to react to message"))
+	}
+}
 
-	// Send join notification
-	joinMsg := WSMessage{
-		Type:      "join",
-		UserID:    conn.UserID,
-		Username:  conn.Username,
-		RoomID:    conn.RoomID,
-		Content:   fmt.Sprintf("%s joined the room", conn.Username),
-		MessageID: uuid.New().String(),
-		Timestamp: time.Now().Unix(),
+// handleRead moves the user's read cursor to message_id. The message
+// service sends a read receipt to small rooms.
+func (h *WebSocketHandler) handleRead(conn *WSConnection, msg WSMessage) {
+	roomID, err := h.frameRoom(conn, msg)
+	if err != nil {
+		conn.sendError(clientError(err, "Failed to mark message read"))
+		return
 	}
 
-	h.broadcastToRoom(conn.RoomID, joinMsg)
+	if _, err := h.messages.MarkRead(context.Background(), roomID, msg.MessageID, conn.UserID); err != nil {
+		log.Printf("Rejected read of %s by %s: %v", msg.MessageID, conn.UserID, err)
+		conn.sendError(clientError(err, "Failed to mark message read"))
+	}
 }
 
-// handleLeaveRoom handles room leave requests
-func (h *WebSocketHandler) handleLeaveRoom(conn *WSConnection, msg WSMessage) {
-	// Remove user from room in database
-	query := `DELETE FROM room_members WHERE room_id = $1 AND user_id = $2`
-	ctx := context.Background()
-	h.db.ExecContext(ctx, query, conn.RoomID, conn.UserID)
+// handleFollowThread subscribes the connection to the replies of one
+// thread in a room it is subscribed to, replacing any thread it followed
+// before. message_id may be the root or any reply.
+func (h *WebSocketHandler) handleFollowThread(conn *WSConnection, msg WSMessage) {
+	message, err := h.messages.Get(context.Background(), msg.MessageID)
+	if err == nil && !h.hub.Subscribed(conn.Connection, message.RoomID) {
+		err = messages.ErrMessageNotFound
+	}
+	if err != nil {
+		conn.sendError(clientError(err, "Failed to follow thread"))
+		return
+	}
 
-	// Send leave notification
-	leaveMsg := WSMessage{
-		Type:      "leave",
-		UserID:    conn.UserID,
-		Username:  conn.Username,
-		RoomID:    conn.RoomID,
-		Content:   fmt.Sprintf("%s left the room", conn.Username),
-		MessageID: uuid.New().String(),
+	rootID := message.ID
+	if message.ThreadRootID != nil {
+		rootID = *message.ThreadRootID
+	}
+
+	h.mu.Lock()
+	h.threads[conn.ID] = rootID
+	h.mu.Unlock()
+
+	conn.queueMessage(WSMessage{
+		Type:      "thread_followed",
+		UserID:    "system",
+		Username:  "System",
+		RoomID:    message.RoomID,
+		MessageID: rootID,
 		Timestamp: time.Now().Unix(),
+	})
+}
+
+// handleUnfollowThread stops delivering thread replies to the connection
+func (h *WebSocketHandler) handleUnfollowThread(conn *WSConnection, msg WSMessage) {
+	h.mu.Lock()
+	delete(h.threads, conn.ID)
+	h.mu.Unlock()
+}
+
+// handleJoinRoom makes the user a member of the frame's room, or of the
+// connection's room if the frame has none, and subscribes to it. The
+// subscription comes first so the user sees their own join event, and is
+// undone if the join fails.
+func (h *WebSocketHandler) handleJoinRoom(conn *WSConnection, msg WSMessage) {
+	ctx := context.Background()
+	roomID := msg.RoomID
+	if roomID == "" {
+		roomID = conn.RoomID
+	}
+
+	subscribed := h.hub.Subscribed(conn.Connection, roomID)
+	err := h.authz.CanAccessRoom(ctx, conn.UserID, roomID)
+	if err == nil {
+		err = h.subscribe(conn, roomID, false, 0, conn.deliver)
+	}
+	if err != nil {
+		log.Printf("Rejected join of %s to room %s: %v", conn.UserID, roomID, err)
+		conn.sendError(clientError(err, "Failed to join room"))
+		return
 	}
 
-	h.broadcastToRoom(conn.RoomID, leaveMsg)
+	if err := h.chat.Join(ctx, chat.Join{RoomID: roomID, UserID: conn.UserID, Username: conn.Username}); err != nil {
+		log.Printf("Error joining room %s for %s: %v", roomID, conn.UserID, err)
+		if !subscribed && h.unsubscribe(conn, roomID) {
+			conn.queueMessage(WSMessage{
+				Type:      "unsubscribed",
+				UserID:    "system",
+				Username:  "System",
+				RoomID:    roomID,
+				Timestamp: time.Now().Unix(),
+			})
+		}
+		conn.sendError(clientError(err, "Failed to join room"))
+	}
+}
+
+// handleLeaveRoom handles room leave requests. The connection is
+// unsubscribed from the room once it has left.
+func (h *WebSocketHandler) handleLeaveRoom(conn *WSConnection, msg WSMessage) {
+	roomID, err := h.frameRoom(conn, msg)
+	if err != nil {
+		conn.sendError(clientError(err, "Failed to leave room"))
+		return
+	}
+
+	err = h.chat.Leave(context.Background(), chat.Leave{RoomID: roomID, UserID: conn.UserID, Username: conn.Username})
+	if err != nil {
+		log.Printf("Error leaving room %s for %s: %v", roomID, conn.UserID, err)
+		conn.sendError(clientError(err, "Failed to leave room"))
+		return
+	}
+	h.unsubscribe(conn, roomID)
 }
 
 // handleTyping handles typing indicators
 func (h *WebSocketHandler) handleTyping(conn *WSConnection, msg WSMessage) {
+	roomID, err := h.frameRoom(conn, msg)
+	if err != nil {
+		conn.sendError(clientError(err, "Failed to send typing indicator"))
+		return
+	}
+
 	typingMsg := WSMessage{
 		Type:      "typing",
 		UserID:    conn.UserID,
 		Username:  conn.Username,
-		RoomID:    conn.RoomID,
+		RoomID:    roomID,
 		Content:   msg.Content, // "start" or "stop"
 		MessageID: uuid.New().String(),
 		Timestamp: time.Now().Unix(),
 	}
 
-	h.broadcastToRoom(conn.RoomID, typingMsg)
+	h.publish(roomID, typingMsg)
 }
 
-// broadcastToRoom broadcasts a message to all connections in a room
+// handleRefreshToken extends the session of a long-lived socket. The new
+// token is carried in Content and must belong to the session the socket
+// was opened with.
+func (h *WebSocketHandler) handleRefreshToken(conn *WSConnection, msg WSMessage) {
+	claims, err := h.auth.Authenticate(context.Background(), msg.Content)
+	if err == nil && (claims.UserID != conn.UserID || claims.SessionID != conn.Session) {
+		err = auth.ErrInvalidToken
+	}
+
+	switch err {
+	case nil:
+	case auth.ErrMissingToken, auth.ErrInvalidToken, auth.ErrTokenExpired, auth.ErrTokenRevoked:
+		conn.sendError(err.Error())
+		return
+	default:
+		log.Printf("Error refreshing token of connection %s: %v", conn.ID, err)
+		conn.sendError("Failed to refresh token")
+		return
+	}
+
+	conn.mu.Lock()
+	conn.expiresAt = claims.ExpiresAt.Time
+	conn.mu.Unlock()
+
+	conn.queueMessage(WSMessage{
+		Type:      "token_refreshed",
+		UserID:    "system",
+		Username:  "System",
+		RoomID:    conn.RoomID,
+		Timestamp: time.Now().Unix(),
+		Metadata: map[string]interface{}{
+			"expires_at": claims.ExpiresAt.Unix(),
+		},
+	})
+}
+
+// broadcastToRoom broadcasts a message to all connections subscribed to a
+// room. Thread replies and their edits only go to connections following
+// the thread; the rest of the room gets thread_updated summaries instead.
+// The target of a kick or ban gets it on their own channel instead.
 func (h *WebSocketHandler) broadcastToRoom(roomID string, msg WSMessage) {
 	data, err := json.Marshal(msg)
 	if err != nil {
@@ -310,58 +640,213 @@ func (h *WebSocketHandler) broadcastToRoom(roomID string, msg WSMessage) {
 		return
 	}
 
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+	removed := removedUser(msg)
+	h.hub.Broadcast(roomID, outbound(msg, data), func(conn *models.Connection) bool {
+		if conn.UserID == removed {
+			return false
+		}
 
-	for _, conn := range h.hub.Connections {
-		if conn.RoomID == roomID {
-			select {
-			case conn.Send <- data:
-			default:
-				close(conn.Send)
-				delete(h.hub.Connections, conn.ID)
-			}
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+
+		if msg.ThreadRootID != "" && h.threads[conn.ID] != msg.ThreadRootID {
+			return false
 		}
+		r := h.resumes[resumeKey(conn.ID, roomID)]
+		return r == nil || !r.intercept(msg)
+	})
+}
+
+// removedUser returns the user a kick or ban event takes out of the room,
+// or "" for other events
+func removedUser(msg WSMessage) string {
+	if msg.Type != "system" {
+		return ""
+	}
+	action, _ := msg.Metadata["action"].(string)
+	if !moderation.RemovesTarget(action) {
+		return ""
 	}
+	target, _ := msg.Metadata["target_id"].(string)
+	return target
 }
 
-// publishToRedis publishes a message to Redis
-func (h *WebSocketHandler) publishToRedis(roomID string, msg WSMessage) {
-	channel := fmt.Sprintf("room:%s", roomID)
-	ctx := context.Background()
-	
-	if err := h.redis.Publish(ctx, channel, msg); err != nil {
-		log.Printf("Error publishing to Redis: %v", err)
+// outbound classifies a room event for connections that fall behind:
+// typing indicators and presence changes are dropped, read receipts and
+// thread summaries only matter in their latest state, and everything else
+// must arrive
+func outbound(msg WSMessage, data []byte) models.Outbound {
+	switch msg.Type {
+	case "typing", "presence":
+		return models.Outbound{Data: data, Class: models.ClassEphemeral}
+	case "read":
+		return models.Outbound{Data: data, Class: models.ClassCoalesce, Key: "read:" + msg.RoomID + ":" + msg.UserID}
+	case "thread_updated":
+		return models.Outbound{Data: data, Class: models.ClassCoalesce, Key: "thread:" + msg.MessageID}
+	default:
+		return models.Outbound{Data: data}
 	}
 }
 
-// listenRedisMessages listens for messages from Redis
-func (h *WebSocketHandler) listenRedisMessages() {
-	ctx := context.Background()
-	
-	// Subscribe to all room channels
-	pubsub := h.redis.Subscribe(ctx, "room:*")
-	defer pubsub.Close()
+// closeSlowConnection closes a connection that went over its backlog
+// budget with CloseSlowConsumer, telling the client to reconnect and resume
+// from its last seq; its read pump then unregisters it
+func closeSlowConnection(conn *models.Connection) {
+	log.Printf("Backlog full for connection %s, closing it", conn.ID)
+	wsConn, ok := conn.Conn.(*websocket.Conn)
+	if !ok {
+		return
+	}
 
-	for {
-		msg, err := pubsub.ReceiveMessage(ctx)
-		if err != nil {
-			log.Printf("Error receiving Redis message: %v", err)
+	// The hub calls this from a shard, which must not wait on the network
+	go func() {
+		closeMsg := websocket.FormatCloseMessage(CloseSlowConsumer, "too far behind, resume from your last seq")
+		wsConn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+		wsConn.Close()
+	}()
+}
+
+// HubStats reports the hub's connections, rooms and queue depths
+func (h *WebSocketHandler) HubStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.hub.Stats())
+}
+
+// publish sends an event to a room's connections on every instance
+func (h *WebSocketHandler) publish(roomID string, msg WSMessage) {
+	if err := h.node.Publish(context.Background(), roomChannel(roomID), msg); err != nil {
+		log.Printf("Error publishing to room %s: %v", roomID, err)
+	}
+}
+
+// deliverEvent delivers an event published on a room or user channel to
+// the local connections it is for
+func (h *WebSocketHandler) deliverEvent(channel string, event []byte) {
+	if userID, ok := strings.CutPrefix(channel, "user:"); ok {
+		h.deliverUserEvent(userID, event)
+		return
+	}
+
+	var wsMsg WSMessage
+	if err := json.Unmarshal(event, &wsMsg); err != nil {
+		log.Printf("Error parsing room event: %v", err)
+		return
+	}
+	roomID := strings.TrimPrefix(channel, "room:")
+	h.broadcastToRoom(roomID, wsMsg)
+
+	// A deleted room loses its subscribers, and with the last of them its
+	// hub entry and broker subscription
+	if wsMsg.Type == "room_deleted" {
+		h.removeRoom(roomID, wsMsg.Content)
+	}
+}
+
+// removeRoom disconnects every local subscriber from a room that no longer
+// exists
+func (h *WebSocketHandler) removeRoom(roomID, reason string) {
+	users := map[string]bool{}
+	for _, conn := range h.hub.RoomConnections(roomID) {
+		users[conn.UserID] = true
+	}
+	for userID := range users {
+		h.disconnectFromRoom(userID, roomID, reason)
+	}
+}
+
+// deliverUserEvent delivers an event published on a user's channel to the
+// user's local connections, whatever room they are in
+func (h *WebSocketHandler) deliverUserEvent(userID string, event []byte) {
+	h.sendToUser(userID, event)
+
+	var msg WSMessage
+	if err := json.Unmarshal(event, &msg); err == nil && msg.Type == "system" {
+		switch msg.Metadata["action"] {
+		case moderation.ActionKick, moderation.ActionBan:
+			h.disconnectFromRoom(userID, msg.RoomID, msg.Content)
+		case auth.ActionSessionRevoked:
+			sessionID, _ := msg.Metadata["session_id"].(string)
+			h.closeSession(userID, sessionID)
+		}
+	}
+}
+
+// closeSession closes a user's local connections opened with a session
+// that was revoked
+func (h *WebSocketHandler) closeSession(userID, sessionID string) {
+	if sessionID == "" {
+		return
+	}
+	for _, conn := range h.hub.UserConnections(userID) {
+		if conn.Session != sessionID {
+			continue
+		}
+		if wsConn, ok := conn.Conn.(*websocket.Conn); ok {
+			closeMsg := websocket.FormatCloseMessage(CloseSessionRevoked, "session revoked")
+			wsConn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(10*time.Second))
+			wsConn.Close()
+		}
+	}
+}
+
+// awaitChannel waits, for a bounded time, until a room or user channel that
+// just gained local connections is subscribed to
+func (h *WebSocketHandler) awaitChannel(channel string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.node.Ready(ctx, channel); err != nil {
+		log.Printf("Subscription to %s not confirmed: %v", channel, err)
+	}
+}
+
+func roomChannel(roomID string) string { return "room:" + roomID }
+
+func userChannel(userID string) string { return "user:" + userID }
+
+// disconnectFromRoom unsubscribes a user's local connections from a room
+// after they were kicked or banned from it, or it was deleted. Connections
+// left without rooms are closed.
+func (h *WebSocketHandler) disconnectFromRoom(userID, roomID, reason string) {
+	for _, conn := range h.hub.UserConnections(userID) {
+		if !h.hub.Unsubscribe(conn, roomID) {
 			continue
 		}
 
-		// Parse message
-		var wsMsg WSMessage
-		if err := json.Unmarshal([]byte(msg.Payload), &wsMsg); err != nil {
-			log.Printf("Error parsing Redis message: %v", err)
+		h.mu.Lock()
+		delete(h.resumes, resumeKey(conn.ID, roomID))
+		h.mu.Unlock()
+
+		if len(h.hub.Subscriptions(conn)) > 0 {
+			unsubscribed, _ := json.Marshal(WSMessage{
+				Type:      "unsubscribed",
+				UserID:    "system",
+				Username:  "System",
+				RoomID:    roomID,
+				Content:   reason,
+				Timestamp: time.Now().Unix(),
+				Metadata: map[string]interface{}{
+					"removed": true,
+				},
+			})
+			if !conn.Enqueue(unsubscribed) {
+				log.Printf("Dropped unsubscribed frame for connection %s", conn.ID)
+			}
 			continue
 		}
 
-		// Broadcast to local connections
-		h.broadcastToRoom(wsMsg.RoomID, wsMsg)
+		if wsConn, ok := conn.Conn.(*websocket.Conn); ok {
+			closeMsg := websocket.FormatCloseMessage(CloseRemovedFromRoom, reason)
+			wsConn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(10*time.Second))
+			wsConn.Close()
+		}
 	}
 }
 
+// sendToUser queues raw event data on every local connection of a user
+func (h *WebSocketHandler) sendToUser(userID string, data []byte) {
+	h.hub.SendToUser(userID, models.Outbound{Data: data})
+}
+
 // sendMessage sends a message to a specific connection
 func (conn *WSConnection) sendMessage(msg WSMessage) error {
 	data, err := json.Marshal(msg)
@@ -372,3 +857,66 @@ func (conn *WSConnection) sendMessage(msg WSMessage) error {
 	conn.wsConn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 	return conn.wsConn.WriteMessage(websocket.TextMessage, data)
 }
+
+// queueMessage hands a message to the write pump for this connection only
+func (conn *WSConnection) queueMessage(msg WSMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return
+	}
+
+	if !conn.Enqueue(data) {
+		log.Printf("Dropped %s frame for connection %s", msg.Type, conn.ID)
+	}
+}
+
+// sendError queues an error frame for this connection only
+func (conn *WSConnection) sendError(content string) {
+	conn.sendErrorFor("", content)
+}
+
+// sendErrorFor queues an error frame answering the message the client sent
+// with clientMsgID
+func (conn *WSConnection) sendErrorFor(clientMsgID, content string) {
+	conn.queueMessage(WSMessage{
+		Type:        "error",
+		UserID:      "system",
+		Username:    "System",
+		RoomID:      conn.RoomID,
+		Content:     content,
+		Timestamp:   time.Now().Unix(),
+		ClientMsgID: clientMsgID,
+	})
+}
+
+// clientError returns err's text if it is meant for clients, or fallback
+// for internal errors that should stay in the log
+func clientError(err error, fallback string) string {
+	switch err {
+	case messages.ErrEmptyContent, messages.ErrInvalidClientMsgID, messages.ErrMessageNotFound, messages.ErrMessageDeleted,
+		messages.ErrNotAuthor, messages.ErrEditWindowExpired, messages.ErrCannotDelete, messages.ErrInvalidEmoji,
+		authz.ErrRoomNotFound, authz.ErrForbidden, authz.ErrBanned, authz.ErrMuted, authz.ErrNotPermitted, authz.ErrArchived,
+		errNotSubscribed, models.ErrTooManySubscriptions:
+		return err.Error()
+	default:
+		return fallback
+	}
+}
+
+// tokenExpiry returns when the connection's current token expires
+func (conn *WSConnection) tokenExpiry() time.Time {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.expiresAt
+}
+
+func getInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if n, err := strconv.Atoi(value); err == nil {
+			return n
+		}
+		log.Printf("Invalid integer for %s: %q, using %d", key, value, defaultValue)
+	}
+	return defaultValue
+}
@@ -0,0 +1,67 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"chat-app/internal/authz"
+	"chat-app/internal/broker"
+	"chat-app/internal/messages"
+	"chat-app/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientError(t *testing.T) {
+	for _, err := range []error{messages.ErrNotAuthor, messages.ErrEditWindowExpired, messages.ErrCannotDelete, authz.ErrArchived, errNotSubscribed} {
+		assert.Equal(t, err.Error(), clientError(err, "Failed"))
+	}
+
+	// Database and Redis errors stay in the log
+	err := errors.New("error storing revision: pq: connection refused")
+	assert.Equal(t, "Failed to edit message", clientError(err, "Failed to edit message"))
+}
+
+func TestRoomDeletedUnsubscribes(t *testing.T) {
+	h := NewWebSocketHandler(nil, broker.NewMemory(), nil, nil, nil, nil, nil)
+	defer h.hub.Stop()
+
+	conn := models.NewConnection("u1", "alice", "", nil, h.hub)
+	h.hub.Register(conn)
+	require.NoError(t, h.hub.Subscribe(conn, "r1", 0))
+	require.NoError(t, h.hub.Subscribe(conn, "r2", 0))
+
+	event, err := json.Marshal(WSMessage{Type: "room_deleted", RoomID: "r1", Content: "This room was deleted"})
+	require.NoError(t, err)
+	h.deliverEvent("room:r1", event)
+
+	assert.False(t, h.hub.Subscribed(conn, "r1"))
+	assert.True(t, h.hub.Subscribed(conn, "r2"))
+	assert.Empty(t, h.hub.RoomConnections("r1"))
+}
+
+func TestKickDeliveredOnce(t *testing.T) {
+	h := NewWebSocketHandler(nil, broker.NewMemory(), nil, nil, nil, nil, nil)
+	defer h.hub.Stop()
+
+	target := models.NewConnection("u1", "alice", "", nil, h.hub)
+	other := models.NewConnection("u2", "bob", "", nil, h.hub)
+	for _, conn := range []*models.Connection{target, other} {
+		h.hub.Register(conn)
+		require.NoError(t, h.hub.Subscribe(conn, "r1", 0))
+	}
+
+	// The moderation service publishes a kick to the room and the target
+	event, err := json.Marshal(WSMessage{Type: "system", RoomID: "r1", Content: "carol removed alice from the room",
+		Metadata: map[string]interface{}{"action": "kick", "target_id": "u1"}})
+	require.NoError(t, err)
+	h.deliverEvent("room:r1", event)
+	h.deliverEvent("user:u1", event)
+	h.hub.Flush()
+
+	assert.Len(t, target.Send, 1)
+	assert.Len(t, other.Send, 1)
+	assert.False(t, h.hub.Subscribed(target, "r1"))
+}